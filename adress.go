@@ -17,6 +17,10 @@ const (
 	AddrBcc        AddressHeader = "Bcc"
 	AddrReplyTo    AddressHeader = "ReplyTo"
 	AddrFollowupTo AddressHeader = "FollowupTo"
+
+	// AddrDispositionNotificationTo requests a read receipt (RFC 8098) to be
+	// sent to the given address.
+	AddrDispositionNotificationTo AddressHeader = "Disposition-Notification-To"
 )
 
 // Addresses handles setting and encoding the mail address headers
@@ -127,6 +131,17 @@ func (a *Addresses) FollowupToAddr(address mail.Address) error {
 	return a.AddAddress(AddrFollowupTo, address)
 }
 
+// DispositionNotificationTo adds the given name, address pair to Disposition-Notification-To,
+// requesting a read receipt to be sent there.
+func (a *Addresses) DispositionNotificationTo(name, address string) error {
+	return a.AddPerson(AddrDispositionNotificationTo, name, address)
+}
+
+// DispositionNotificationToAddr adds the given address to Disposition-Notification-To.
+func (a *Addresses) DispositionNotificationToAddr(address mail.Address) error {
+	return a.AddAddress(AddrDispositionNotificationTo, address)
+}
+
 // AddPerson adds the given details to the given mail header field.
 // Field should be a valid address field. Use the predefined Addr... constants or
 // the corresponding methods.
@@ -150,7 +165,7 @@ func (a *Addresses) AddAddress(field AddressHeader, address mail.Address) error
 
 func valid(field AddressHeader) bool {
 	switch field {
-	case AddrSender, AddrFrom, AddrTo, AddrCc, AddrBcc, AddrReplyTo, AddrFollowupTo:
+	case AddrSender, AddrFrom, AddrTo, AddrCc, AddrBcc, AddrReplyTo, AddrFollowupTo, AddrDispositionNotificationTo:
 		return true
 	default:
 		return false
@@ -0,0 +1,457 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ARCStatus is the result of validating an ARC chain (RFC 8617 4.4).
+type ARCStatus string
+
+// Valid ARCStatus values
+const (
+	ARCNone ARCStatus = "none"
+	ARCPass ARCStatus = "pass"
+	ARCFail ARCStatus = "fail"
+)
+
+// maxARCInstances is the maximum number of ARC sets in a chain (RFC 8617 4.2.1).
+const maxARCInstances = 50
+
+// DefaultARCHeaders are the header fields signed by the ARC-Message-Signature
+// if ARC.Headers is empty.
+var DefaultARCHeaders = append(append([]string{}, DefaultDKIMHeaders...), "DKIM-Signature")
+
+// ARC holds the values needed to seal forwarded mail with an Authenticated
+// Received Chain (RFC 8617).
+type ARC struct {
+	// Domain is the sealing domain (d= tag).
+	Domain string
+
+	// Selector is the selector (s= tag), the public key is published at
+	// <Selector>._domainkey.<Domain>.
+	Selector string
+
+	// File holds the filesystem path from which the PEM encoded private key
+	// (RSA or Ed25519) should be read. If Key below is not empty it will take precedence.
+	File string
+
+	// Key holds the PEM encoded private key, mostly for usage in tests.
+	Key string
+
+	// AuthServID is the authserv-id used in ARC-Authentication-Results, defaults to Domain.
+	AuthServID string
+
+	// Headers lists the header fields signed by the ARC-Message-Signature,
+	// DefaultARCHeaders are used if it is empty.
+	Headers []string
+
+	// HeaderCanonicalization and BodyCanonicalization are used for the
+	// ARC-Message-Signature and default to CanonicalRelaxed.
+	// The ARC-Seal always uses relaxed canonicalization.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	// Resolver is used to look up the keys to validate the existing chain and
+	// DKIM signatures, net.DefaultResolver is used if it is nil.
+	Resolver TXTResolver
+}
+
+// ARCResult is the result of validating the ARC chain of a message.
+type ARCResult struct {
+	Status ARCStatus
+
+	// Instances is the number of ARC sets in the chain.
+	Instances int
+
+	// Err holds the reason if Status is ARCFail.
+	Err error
+}
+
+// Open returns a reader for the PEM encoded private key.
+func (a ARC) Open() (io.Reader, error) {
+	return openKey(a.File, a.Key)
+}
+
+// Signer loads the private key.
+func (a ARC) Signer() (crypto.Signer, error) {
+	return loadSigner(a)
+}
+
+// AuthResults holds the authentication results of a received message, as
+// recorded in the ARC-Authentication-Results field by ARC.Seal.
+type AuthResults struct {
+	DKIM []DKIMResult
+	ARC  ARCResult
+
+	// Other holds additional results, e.g. "spf=pass smtp.mailfrom=example.org".
+	Other []string
+}
+
+// Authenticate verifies the DKIM signatures and validates the ARC chain of the raw
+// message read from r, looking up the public keys with resolver. If resolver is nil,
+// net.DefaultResolver is used. Call it before modifying a message and pass
+// the results to ARC.Seal.
+func Authenticate(r io.Reader, resolver TXTResolver) (*AuthResults, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	return authenticate(context.Background(), resolver, toCRLF(msg)), nil
+}
+
+func authenticate(ctx context.Context, resolver TXTResolver, msg []byte) *AuthResults {
+	header, body := splitMessage(msg)
+	fields := parseHeaderFields(header)
+
+	auth := new(AuthResults)
+	auth.ARC, _ = validateARC(ctx, resolver, fields, body)
+	for _, field := range fields {
+		if strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			auth.DKIM = append(auth.DKIM, verifyDKIMSignature(ctx, resolver, fields, body, field))
+		}
+	}
+	return auth
+}
+
+// resinfo formats the results for an Authentication-Results style field.
+func (auth *AuthResults) resinfo() []string {
+	var results []string
+	for _, res := range auth.DKIM {
+		results = append(results, fmt.Sprintf("dkim=%s header.d=%s header.s=%s", res.Status, res.Domain, res.Selector))
+	}
+	if len(results) == 0 {
+		results = append(results, "dkim=none")
+	}
+	results = append(results, auth.Other...)
+	return append(results, "arc="+string(auth.ARC.Status))
+}
+
+// Seal adds a new ARC set (ARC-Seal, ARC-Message-Signature and ARC-Authentication-Results)
+// to msg. The set records the results in auth, which should be obtained with
+// Authenticate from the message as it was received, before any modifications.
+// If auth is not given, msg itself is authenticated. Line breaks in msg are converted to CRLF.
+// The chain validation status (cv) is none if msg has no ARC sets, pass if their seals
+// validate and auth records a passing chain of the same length, and fail otherwise.
+// As demanded by RFC 8617 5.1, msg is returned unchanged if the most recent
+// ARC-Seal already records a failed chain.
+func (a *ARC) Seal(msg []byte, auth ...*AuthResults) ([]byte, error) {
+	if a.Domain == "" || a.Selector == "" {
+		return nil, fmt.Errorf("ARC: domain and selector must be set")
+	}
+	signer, err := a.Signer()
+	if err != nil {
+		return nil, err
+	}
+	alg, err := signingAlgorithm(signer)
+	if err != nil {
+		return nil, err
+	}
+
+	msg = toCRLF(msg)
+	resolver := a.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	var results *AuthResults
+	if len(auth) != 0 {
+		results = auth[0]
+	}
+	if results == nil {
+		results = authenticate(context.Background(), resolver, msg)
+	}
+
+	header, _ := splitMessage(msg)
+	fields := parseHeaderFields(header)
+	last, lastSeal := lastARCSeal(fields)
+	if strings.EqualFold(lastSeal["cv"], string(ARCFail)) || last >= maxARCInstances {
+		return msg, nil
+	}
+	instance := strconv.Itoa(last + 1)
+
+	cv := ARCNone
+	sets, err := collectARCSets(fields)
+	switch {
+	case err != nil:
+		// the broken sets can't be sealed, the new one only covers itself.
+		cv, sets = ARCFail, nil
+	case len(sets) != 0:
+		cv = chainStatus(context.Background(), resolver, sets, results.ARC)
+	}
+	// the recorded result must match the seal.
+	recorded := *results
+	recorded.ARC.Status = cv
+	results = &recorded
+
+	authServID := a.AuthServID
+	if authServID == "" {
+		authServID = a.Domain
+	}
+	aar := foldResults("ARC-Authentication-Results", "i="+instance, authServID, results.resinfo())
+
+	ams, err := signDKIMStyle(msg, signer, dkimTags{
+		field:     "ARC-Message-Signature",
+		tags:      []string{"i=" + instance},
+		domain:    a.Domain,
+		selector:  a.Selector,
+		headers:   a.Headers,
+		headerC:   a.HeaderCanonicalization,
+		bodyC:     a.BodyCanonicalization,
+		signedDef: DefaultARCHeaders,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	seal := foldTags("ARC-Seal", []string{
+		"i=" + instance,
+		"a=" + alg,
+		"cv=" + string(cv),
+		"d=" + a.Domain,
+		"s=" + a.Selector,
+		"t=" + strconv.FormatInt(time.Now().Unix(), 10),
+		"b=",
+	})
+	sets = append(sets, arcSet{aar: aar, ams: ams, seal: seal})
+
+	sig, err := sign(signer, sealHash(sets))
+	if err != nil {
+		return nil, err
+	}
+	seal += foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n"
+
+	return append([]byte(seal+ams+aar), msg...), nil
+}
+
+// ValidateARC validates the ARC chain of the raw message read from r, looking up
+// the public keys with resolver. If resolver is nil, net.DefaultResolver is used.
+// The returned error is only non-nil if the message couldn't be read.
+func ValidateARC(r io.Reader, resolver TXTResolver) (ARCResult, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return ARCResult{}, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	header, body := splitMessage(toCRLF(msg))
+	res, _ := validateARC(context.Background(), resolver, parseHeaderFields(header), body)
+	return res, nil
+}
+
+// arcSet holds the raw header fields of a single ARC instance.
+type arcSet struct {
+	aar, ams, seal string
+	tags           map[string]string // tags of the ARC-Seal
+}
+
+// validateARC validates the chain in fields (RFC 8617 5.2) and returns the
+// result and the existing ARC sets, ordered by instance.
+func validateARC(ctx context.Context, resolver TXTResolver, fields []string, body []byte) (ARCResult, []arcSet) {
+	sets, err := collectARCSets(fields)
+	res := ARCResult{Status: ARCNone, Instances: len(sets)}
+	if err != nil {
+		res.Status, res.Err = ARCFail, err
+		return res, sets
+	}
+	if len(sets) == 0 {
+		return res, sets
+	}
+
+	last := sets[len(sets)-1]
+	if strings.EqualFold(last.tags["cv"], string(ARCFail)) {
+		res.Status, res.Err = ARCFail, fmt.Errorf("chain already failed at instance %d", len(sets))
+		return res, sets
+	}
+
+	// only the most recent ARC-Message-Signature needs to validate.
+	amsTags, err := parseTags(fieldValue(last.ams))
+	if err != nil {
+		res.Status, res.Err = ARCFail, fmt.Errorf("ARC-Message-Signature: %s", err)
+		return res, sets
+	}
+	if _, err := verifyDKIMStyle(ctx, resolver, fields, body, last.ams, amsTags); err != nil {
+		res.Status, res.Err = ARCFail, fmt.Errorf("ARC-Message-Signature i=%d: %s", len(sets), err)
+		return res, sets
+	}
+
+	for i := len(sets); i > 0; i-- {
+		if err := verifySeal(ctx, resolver, sets[:i]); err != nil {
+			res.Status, res.Err = ARCFail, fmt.Errorf("ARC-Seal i=%d: %s", i, err)
+			return res, sets
+		}
+	}
+
+	res.Status = ARCPass
+	return res, sets
+}
+
+// chainStatus returns the chain validation status (cv) of the existing ARC sets. The seals only cover
+// the ARC header fields, so they are verified on the message as it is. The most recent
+// ARC-Message-Signature can only be validated on the message as received, that's taken from received.
+func chainStatus(ctx context.Context, resolver TXTResolver, sets []arcSet, received ARCResult) ARCStatus {
+	if received.Status != ARCPass || received.Instances != len(sets) {
+		return ARCFail
+	}
+	for i := len(sets); i > 0; i-- {
+		if err := verifySeal(ctx, resolver, sets[:i]); err != nil {
+			return ARCFail
+		}
+	}
+	return ARCPass
+}
+
+// collectARCSets groups the ARC header fields by instance and checks that the
+// chain is complete.
+func collectARCSets(fields []string) ([]arcSet, error) {
+	byInstance := make(map[int]*arcSet)
+
+	for _, f := range fields {
+		name := strings.ToLower(fieldName(f))
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+
+		i, tags, err := arcInstance(name, f)
+		if err != nil {
+			return nil, err
+		}
+		if byInstance[i] == nil {
+			byInstance[i] = &arcSet{}
+		}
+		set := byInstance[i]
+
+		dst := &set.aar
+		switch name {
+		case "arc-seal":
+			dst = &set.seal
+			set.tags = tags
+		case "arc-message-signature":
+			dst = &set.ams
+		}
+		if *dst != "" {
+			return nil, fmt.Errorf("duplicate %s for instance %d", fieldName(f), i)
+		}
+		*dst = f
+	}
+
+	sets := make([]arcSet, len(byInstance))
+	for i := range sets {
+		set := byInstance[i+1]
+		if set == nil || set.aar == "" || set.ams == "" || set.seal == "" {
+			return nil, fmt.Errorf("incomplete ARC set for instance %d", i+1)
+		}
+		sets[i] = *set
+	}
+	return sets, nil
+}
+
+// arcInstance returns the instance of the ARC header field f named name
+// and the tags of f, if it's not an ARC-Authentication-Results field.
+func arcInstance(name, f string) (int, map[string]string, error) {
+	var tags map[string]string
+	var instance string
+	if name == "arc-authentication-results" {
+		v := fieldValue(f)
+		if j := strings.Index(v, ";"); j >= 0 {
+			v = v[:j]
+		}
+		instance = strings.TrimPrefix(strings.Join(strings.Fields(v), ""), "i=")
+	} else {
+		var err error
+		if tags, err = parseTags(fieldValue(f)); err != nil {
+			return 0, nil, fmt.Errorf("%s: %s", fieldName(f), err)
+		}
+		instance = tags["i"]
+	}
+
+	i, err := strconv.Atoi(instance)
+	if err != nil || i < 1 || i > maxARCInstances {
+		return 0, nil, fmt.Errorf("%s: invalid instance %q", fieldName(f), instance)
+	}
+	return i, tags, nil
+}
+
+// lastARCSeal returns the highest instance of the ARC header fields in fields and the tags
+// of it's ARC-Seal, even if the chain is incomplete. Invalid fields are ignored.
+func lastARCSeal(fields []string) (int, map[string]string) {
+	var last int
+	var seal map[string]string
+	for _, f := range fields {
+		name := strings.ToLower(fieldName(f))
+		if name != "arc-seal" && name != "arc-message-signature" && name != "arc-authentication-results" {
+			continue
+		}
+		i, tags, err := arcInstance(name, f)
+		if err != nil || i < last {
+			continue
+		}
+		if i > last {
+			last, seal = i, nil
+		}
+		if name == "arc-seal" {
+			seal = tags
+		}
+	}
+	return last, seal
+}
+
+// verifySeal verifies the ARC-Seal of the last set in sets.
+func verifySeal(ctx context.Context, resolver TXTResolver, sets []arcSet) error {
+	tags := sets[len(sets)-1].tags
+	for _, tag := range []string{"a", "b", "cv", "d", "s"} {
+		if tags[tag] == "" {
+			return fmt.Errorf("missing required tag %s=", tag)
+		}
+	}
+
+	cv := strings.ToLower(tags["cv"])
+	if (len(sets) == 1 && cv != string(ARCNone)) || (len(sets) > 1 && cv != string(ARCPass)) {
+		return fmt.Errorf("invalid chain validation status %q", tags["cv"])
+	}
+
+	alg := strings.ToLower(tags["a"])
+	sig, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return fmt.Errorf("invalid signature encoding: %s", err)
+	}
+	key, _, err := lookupKey(ctx, resolver, tags["s"], tags["d"])
+	if err != nil {
+		return err
+	}
+	return verifySignature(key, alg, sealHash(sets), sig)
+}
+
+// sealHash returns the hash signed by the ARC-Seal of the last set in sets (RFC 8617 5.1.1).
+func sealHash(sets []arcSet) []byte {
+	h := sha256.New()
+	for i, set := range sets {
+		h.Write(canonicalHeader(set.aar, CanonicalRelaxed))
+		h.Write(canonicalHeader(set.ams, CanonicalRelaxed))
+		if i < len(sets)-1 {
+			h.Write(canonicalHeader(set.seal, CanonicalRelaxed))
+			continue
+		}
+		h.Write(bytes.TrimSuffix(canonicalHeader(stripSignature(set.seal), CanonicalRelaxed), []byte("\r\n")))
+	}
+	return h.Sum(nil)
+}
+
+// foldResults formats an Authentication-Results style header field, one result per line.
+func foldResults(name, instance, authServID string, resinfo []string) string {
+	return name + ": " + instance + "; " + authServID + ";\r\n\t" + strings.Join(resinfo, ";\r\n\t") + "\r\n"
+}
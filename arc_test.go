@@ -0,0 +1,155 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestARCSeal(t *testing.T) {
+	rsaPEM, edPEM := testDKIMKeys(t)
+	origin := &DKIM{Domain: "example.com", Selector: "mail", Key: rsaPEM}
+	resolver := testResolver{records: map[string][]string{
+		"mail._domainkey.example.com":        {dkimRecord(t, origin)},
+		"arc._domainkey.lists.example.org":   {dkimRecord(t, &DKIM{Key: edPEM})},
+		"arc._domainkey.forward.example.net": {dkimRecord(t, &DKIM{Key: rsaPEM})},
+	}}
+	list := &ARC{Domain: "lists.example.org", Selector: "arc", Key: edPEM, Resolver: resolver}
+	forwarder := &ARC{Domain: "forward.example.net", Selector: "arc", Key: rsaPEM, Resolver: resolver}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err = origin.Sign(b); err != nil {
+		t.Fatal(err)
+	}
+
+	if res, _ := ValidateARC(bytes.NewReader(b), resolver); res.Status != ARCNone {
+		t.Errorf("unsealed message: expected none, got %s (%v)", res.Status, res.Err)
+	}
+
+	// the list authenticates the message on receipt, then rewrites the subject
+	// (breaking the DKIM signature) and seals it.
+	auth, err := Authenticate(bytes.NewReader(b), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth.Other = append(auth.Other, "spf=pass smtp.mailfrom=example.com")
+	modified := bytes.Replace(b, []byte("Subject: "), []byte("Subject: [list] "), 1)
+
+	sealed, err := list.Seal(modified, auth)
+	if err != nil {
+		t.Fatal(err)
+	}
+	header, _ := splitMessage(sealed)
+	fields := parseHeaderFields(header)
+	if !strings.HasPrefix(fields[0], "ARC-Seal: i=1; a=ed25519-sha256; cv=none;") ||
+		!strings.HasPrefix(fields[1], "ARC-Message-Signature: i=1;") ||
+		fieldValue(fields[2]) != "i=1; lists.example.org;\tdkim=pass header.d=example.com header.s=mail;\tspf=pass smtp.mailfrom=example.com;\tarc=none" {
+		t.Errorf("unexpected ARC set:\n%s", header)
+	}
+
+	if res, _ := VerifyDKIM(bytes.NewReader(sealed), resolver); len(res) != 1 || res[0].Status != DKIMFail {
+		t.Errorf("expected DKIM to fail after modification: %+v", res)
+	}
+	if res, _ := ValidateARC(bytes.NewReader(sealed), resolver); res.Status != ARCPass || res.Instances != 1 {
+		t.Errorf("expected pass with 1 instance, got %+v", res)
+	}
+
+	// the forwarder seals the message unmodified, authenticating it itself.
+	forwarded, err := forwarder.Seal(sealed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	res, err := ValidateARC(bytes.NewReader(forwarded), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Status != ARCPass || res.Instances != 2 {
+		t.Fatalf("expected pass with 2 instances, got %+v", res)
+	}
+	header, _ = splitMessage(forwarded)
+	fields = parseHeaderFields(header)
+	if !strings.HasPrefix(fields[0], "ARC-Seal: i=2; a=rsa-sha256; cv=pass;") || !strings.Contains(fields[2], "dkim=fail") || !strings.Contains(fields[2], "arc=pass") {
+		t.Errorf("unexpected ARC set:\n%s", header)
+	}
+
+	// modifications after sealing break the chain, it's sealed with cv=fail once
+	// but not extended afterwards.
+	broken := bytes.Replace(forwarded, []byte("hello"), []byte("bye"), 1)
+	if res, _ := ValidateARC(bytes.NewReader(broken), resolver); res.Status != ARCFail {
+		t.Errorf("modified after sealing: expected fail, got %s", res.Status)
+	}
+	failed, err := list.Seal(broken)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(failed, []byte("ARC-Seal: i=3; a=ed25519-sha256; cv=fail;")) {
+		t.Errorf("expected cv=fail seal:\n%s", failed)
+	}
+	again, err := forwarder.Seal(failed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(again, failed) {
+		t.Error("failed chain has been extended")
+	}
+
+	// an incomplete chain is sealed with cv=fail and the next instance.
+	header, _ = splitMessage(sealed)
+	ams := parseHeaderFields(header)[1]
+	incomplete := bytes.Replace(sealed, []byte(ams), nil, 1)
+	failed, err = forwarder.Seal(incomplete)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.HasPrefix(failed, []byte("ARC-Seal: i=2; a=rsa-sha256; cv=fail;")) {
+		t.Errorf("expected cv=fail seal with i=2:\n%s", failed)
+	}
+	if again, err = list.Seal(failed); err != nil || !bytes.Equal(again, failed) {
+		t.Errorf("failed chain has been extended: %v", err)
+	}
+
+	// cv is derived from the chain, not taken from the given results.
+	if first, err := list.Seal(b, &AuthResults{ARC: ARCResult{Status: ARCPass}}); err != nil || !bytes.HasPrefix(first, []byte("ARC-Seal: i=1; a=ed25519-sha256; cv=none;")) {
+		t.Errorf("expected cv=none for the first instance: %v\n%s", err, first)
+	}
+	if second, err := forwarder.Seal(sealed, new(AuthResults)); err != nil || !bytes.HasPrefix(second, []byte("ARC-Seal: i=2; a=rsa-sha256; cv=fail;")) {
+		t.Errorf("expected cv=fail without a passing chain in the results: %v\n%s", err, second)
+	} else if header, _ := splitMessage(second); !strings.HasSuffix(fieldValue(parseHeaderFields(header)[2]), "arc=fail") {
+		t.Errorf("expected arc=fail in the ARC-Authentication-Results:\n%s", header)
+	}
+}
+
+func TestClientForwardARC(t *testing.T) {
+	_, edPEM := testDKIMKeys(t)
+
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	acc := srv.account()
+	acc.ARC = &ARC{Domain: "example.com", Selector: "arc", Key: edPEM, Resolver: testResolver{}}
+
+	m := MessageFactory()
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Forward(b, NewEnvelope("list@example.com", "receiver@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 || !strings.HasPrefix(txs[0].data, "ARC-Seal: i=1; a=ed25519-sha256; cv=none;") {
+		t.Fatalf("mail not sealed: %+v", txs)
+	}
+}
@@ -0,0 +1,248 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net/mail"
+	"strings"
+	"sync"
+	"time"
+)
+
+// AutocryptRecommendation is the Autocrypt recommendation (Autocrypt Level 1, 2.4) for
+// encrypting mail to a peer.
+type AutocryptRecommendation string
+
+// Valid AutocryptRecommendation values
+const (
+	AutocryptDisable    AutocryptRecommendation = "disable"
+	AutocryptDiscourage AutocryptRecommendation = "discourage"
+	AutocryptAvailable  AutocryptRecommendation = "available"
+	AutocryptEncrypt    AutocryptRecommendation = "encrypt"
+)
+
+// autocryptStale is the time after which a peer's key is considered stale if
+// it has been seen without Autocrypt header since.
+const autocryptStale = 35 * 24 * time.Hour
+
+// AutocryptPeer is the Autocrypt state of a peer (Autocrypt Level 1, 2.3).
+type AutocryptPeer struct {
+	// Addr is the peer's (lower cased) address.
+	Addr string
+
+	// LastSeen is the date of the most recent message from the peer.
+	LastSeen time.Time
+
+	// Timestamp is the date of the most recent message with an Autocrypt header from the peer.
+	Timestamp time.Time
+
+	// Key is the peer's binary public key (the keydata attribute).
+	Key []byte
+
+	// PreferEncrypt reports whether the peer has set prefer-encrypt=mutual.
+	PreferEncrypt bool
+}
+
+// AutocryptStore stores the Autocrypt state of peers.
+// MemoryAutocryptStore implements it, provide your own implementation for persistent storage.
+type AutocryptStore interface {
+	// Peer returns the state of the peer with address addr, nil if it is unknown.
+	Peer(addr string) (*AutocryptPeer, error)
+
+	// SavePeer stores the state of a peer.
+	SavePeer(peer *AutocryptPeer) error
+}
+
+// MemoryAutocryptStore is an AutocryptStore which keeps the peer state in memory.
+type MemoryAutocryptStore struct {
+	mu    sync.Mutex
+	peers map[string]AutocryptPeer
+}
+
+// Peer implements AutocryptStore.
+func (s *MemoryAutocryptStore) Peer(addr string) (*AutocryptPeer, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[strings.ToLower(addr)]
+	if !ok {
+		return nil, nil
+	}
+	return &peer, nil
+}
+
+// SavePeer implements AutocryptStore.
+func (s *MemoryAutocryptStore) SavePeer(peer *AutocryptPeer) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.peers == nil {
+		s.peers = make(map[string]AutocryptPeer)
+	}
+	s.peers[strings.ToLower(peer.Addr)] = *peer
+	return nil
+}
+
+// Autocrypt holds the Autocrypt (Level 1) settings of an Account.
+// If it's set, Client.Send adds the Autocrypt header with the account's public key
+// and encrypts mail if Autocrypt recommends it for all recipients (see Keys).
+type Autocrypt struct {
+	// PreferEncrypt sets prefer-encrypt=mutual in the Autocrypt header.
+	PreferEncrypt bool
+
+	// Store holds the state of the peers, use Process to update it with received mail.
+	// It must not be nil, use a MemoryAutocryptStore if you don't need to persist it.
+	Store AutocryptStore
+}
+
+// Header returns the value of the Autocrypt header field for acc, with the public key from acc's Key.
+// The private key isn't needed, so no passphrase is asked for.
+func (a *Autocrypt) Header(acc *Account) (string, error) {
+	e, err := CreateEntity(acc)
+	if err != nil {
+		return "", err
+	}
+	var key bytes.Buffer
+	if err := e.Serialize(&key); err != nil {
+		return "", err
+	}
+
+	value := "addr=" + acc.Address + ";"
+	if a.PreferEncrypt {
+		value += " prefer-encrypt=mutual;"
+	}
+	return value + " keydata=\r\n\t" + foldBase64(base64.StdEncoding.EncodeToString(key.Bytes())), nil
+}
+
+// Process updates the peer state (Autocrypt Level 1, 2.3) with the raw received message read from r.
+func (a *Autocrypt) Process(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+	if mediatype, _, _ := mime.ParseMediaType(msg.Header.Get(content_type)); mediatype == "multipart/report" {
+		return nil
+	}
+	from, err := mail.ParseAddressList(msg.Header.Get("From"))
+	if err != nil || len(from) != 1 {
+		return nil
+	}
+	addr := strings.ToLower(from[0].Address)
+
+	date, err := msg.Header.Date()
+	if err != nil || date.After(time.Now()) {
+		date = time.Now()
+	}
+
+	var header *AutocryptPeer
+	for _, value := range msg.Header["Autocrypt"] {
+		h, err := parseAutocrypt(value)
+		if err != nil || !strings.EqualFold(h.Addr, addr) {
+			continue
+		}
+		if header != nil {
+			// more than one valid header, all are ignored.
+			header = nil
+			break
+		}
+		header = h
+	}
+
+	peer, err := a.Store.Peer(addr)
+	if err != nil {
+		return err
+	}
+	if peer == nil {
+		peer = &AutocryptPeer{Addr: addr}
+	}
+	if header != nil && date.After(peer.Timestamp) {
+		peer.Timestamp = date
+		peer.Key = header.Key
+		peer.PreferEncrypt = header.PreferEncrypt
+	}
+	if date.After(peer.LastSeen) {
+		peer.LastSeen = date
+	}
+	return a.Store.SavePeer(peer)
+}
+
+// parseAutocrypt parses the value of an Autocrypt header field.
+func parseAutocrypt(value string) (*AutocryptPeer, error) {
+	h := new(AutocryptPeer)
+	for _, attr := range strings.Split(value, ";") {
+		attr = strings.TrimSpace(attr)
+		if attr == "" {
+			continue
+		}
+		eq := strings.Index(attr, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("Autocrypt: invalid attribute %q", attr)
+		}
+		name, val := strings.TrimSpace(attr[:eq]), strings.TrimSpace(attr[eq+1:])
+		switch name {
+		case "addr":
+			h.Addr = strings.ToLower(val)
+		case "prefer-encrypt":
+			h.PreferEncrypt = val == "mutual"
+		case "keydata":
+			key, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(val), ""))
+			if err != nil {
+				return nil, err
+			}
+			h.Key = key
+		default:
+			// unknown non-critical attributes start with an underscore.
+			if !strings.HasPrefix(name, "_") {
+				return nil, fmt.Errorf("Autocrypt: unknown critical attribute %q", name)
+			}
+		}
+	}
+	if h.Addr == "" || len(h.Key) == 0 {
+		return nil, fmt.Errorf("Autocrypt: addr and keydata are required")
+	}
+	return h, nil
+}
+
+// Recommend returns the recommendation (Autocrypt Level 1, 2.4) for encrypting mail to addr.
+func (a *Autocrypt) Recommend(addr string) (AutocryptRecommendation, error) {
+	peer, err := a.Store.Peer(addr)
+	if err != nil || peer == nil || len(peer.Key) == 0 {
+		return AutocryptDisable, err
+	}
+	if keys, err := ReadKeyRing(bytes.NewReader(peer.Key)); err != nil || !hasUserID(keys, addr) {
+		return AutocryptDisable, nil
+	}
+	if peer.LastSeen.Sub(peer.Timestamp) > autocryptStale {
+		return AutocryptDiscourage, nil
+	}
+	if a.PreferEncrypt && peer.PreferEncrypt {
+		return AutocryptEncrypt, nil
+	}
+	return AutocryptAvailable, nil
+}
+
+// Keys returns the accounts holding the peer's keys for all of recipients, if Autocrypt
+// recommends to encrypt (AutocryptEncrypt) to each of them. Otherwise it returns nil:
+// if it's only available, the peers haven't both set prefer-encrypt=mutual.
+func (a *Autocrypt) Keys(recipients []string) ([]*Account, error) {
+	if len(recipients) == 0 {
+		return nil, nil
+	}
+	keys := make([]*Account, 0, len(recipients))
+	for _, addr := range recipients {
+		rec, err := a.Recommend(addr)
+		if err != nil {
+			return nil, err
+		}
+		if rec != AutocryptEncrypt {
+			return nil, nil
+		}
+		peer, err := a.Store.Peer(addr)
+		if err != nil {
+			return nil, err
+		}
+		keys = append(keys, &Account{Address: addr, Key: &PGP{Key: string(peer.Key)}})
+	}
+	return keys, nil
+}
@@ -0,0 +1,185 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+// autocryptMail returns a raw message from from sent at date with the given Autocrypt header values.
+func autocryptMail(from string, date time.Time, headers ...string) string {
+	var b strings.Builder
+	fmt.Fprintf(&b, "From: <%s>\r\nTo: <me@example.com>\r\nDate: %s\r\n", from, date.Format(time.RFC1123Z))
+	for _, h := range headers {
+		fmt.Fprintf(&b, "Autocrypt: %s\r\n", h)
+	}
+	b.WriteString("Subject: hi\r\n\r\nhello\r\n")
+	return b.String()
+}
+
+func TestAutocryptProcess(t *testing.T) {
+	peerKey, _ := testPGP(t, "peer@example.com")
+	peer := &Account{Address: "peer@example.com", Key: peerKey}
+	_, newKey := testPGP(t, "peer@example.com")
+
+	mutual, err := (&Autocrypt{PreferEncrypt: true}).Header(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the public key is enough for the header.
+	nopreference, err := (&Autocrypt{}).Header(&Account{Address: "peer@example.com", Key: &PGP{Key: newKey}})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := &Autocrypt{PreferEncrypt: true, Store: new(MemoryAutocryptStore)}
+	recommend := func(exp AutocryptRecommendation) {
+		t.Helper()
+		if rec, err := a.Recommend("Peer@example.com"); err != nil || rec != exp {
+			t.Errorf("expected %s, got %s (%v)", exp, rec, err)
+		}
+	}
+	process := func(msg string) {
+		t.Helper()
+		if err := a.Process(strings.NewReader(msg)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	now := time.Now().Truncate(time.Second)
+	recommend(AutocryptDisable)
+
+	process(autocryptMail("peer@example.com", now.Add(-48*time.Hour), mutual))
+	recommend(AutocryptEncrypt)
+	if keys, err := a.Keys([]string{"peer@example.com"}); err != nil || len(keys) != 1 {
+		t.Errorf("expected the peer's key: %v %v", keys, err)
+	}
+	a.PreferEncrypt = false
+	recommend(AutocryptAvailable)
+	a.PreferEncrypt = true
+
+	// older messages don't change the key, newer ones do.
+	process(autocryptMail("peer@example.com", now.Add(-72*time.Hour), nopreference))
+	recommend(AutocryptEncrypt)
+	process(autocryptMail("peer@example.com", now.Add(-24*time.Hour), nopreference))
+	recommend(AutocryptAvailable)
+	if keys, err := a.Keys([]string{"peer@example.com"}); err != nil || keys != nil {
+		t.Errorf("expected no keys without prefer-encrypt=mutual: %v %v", keys, err)
+	}
+
+	// invalid and ambiguous headers are ignored.
+	process(autocryptMail("peer@example.com", now.Add(-12*time.Hour), mutual, mutual))
+	process(autocryptMail("peer@example.com", now.Add(-12*time.Hour), strings.Replace(mutual, "addr=peer", "addr=other", 1)))
+	process(autocryptMail("peer@example.com", now.Add(-12*time.Hour), "critical=yes; "+mutual))
+	recommend(AutocryptAvailable)
+
+	// the key gets stale if the peer keeps sending without it.
+	process(autocryptMail("peer@example.com", now.Add(40*24*time.Hour)))
+	p, _ := a.Store.Peer("peer@example.com")
+	if p.LastSeen.After(time.Now()) || !p.Timestamp.Equal(now.Add(-24*time.Hour)) {
+		t.Errorf("unexpected peer state: %+v", p)
+	}
+	p.LastSeen = p.LastSeen.Add(40 * 24 * time.Hour)
+	a.Store.SavePeer(p)
+	recommend(AutocryptDiscourage)
+	if keys, err := a.Keys([]string{"peer@example.com"}); err != nil || keys != nil {
+		t.Errorf("expected no keys for a stale peer: %v %v", keys, err)
+	}
+}
+
+func TestClientSendAutocrypt(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	acc := srv.account()
+	acc.Key, _ = testPGP(t, acc.Address)
+	acc.Autocrypt = &Autocrypt{PreferEncrypt: true, Store: new(MemoryAutocryptStore)}
+	peerKey, _ := testPGP(t, "peer@example.com")
+	peer := &Account{Address: "peer@example.com", Key: peerKey}
+
+	m := NewMail()
+	m.From("", acc.Address)
+	m.To("", "peer@example.com")
+	m.Subject = "hi"
+	m.PlainTextBody().Write([]byte("secret"))
+
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// without the peer's key the mail is sent unencrypted, announcing our key.
+	env, _ := m.Envelope()
+	b, err := c.bytes(m, env)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p, err := ReadPart(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	h, err := parseAutocrypt(p.Get("Autocrypt"))
+	if err != nil || h.Addr != acc.Address || !h.PreferEncrypt {
+		t.Fatalf("unexpected Autocrypt header %q: %v", p.Get("Autocrypt"), err)
+	}
+	if mediatype, _ := p.MediaType(); mediatype != mime_multipart {
+		t.Errorf("expected an unencrypted mail, got %s", mediatype)
+	}
+
+	// the peer replies with it's key.
+	reply := &Autocrypt{PreferEncrypt: true, Store: new(MemoryAutocryptStore)}
+	header, err := reply.Header(peer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := acc.Autocrypt.Process(strings.NewReader(autocryptMail("peer@example.com", time.Now(), header))); err != nil {
+		t.Fatal(err)
+	}
+
+	// it's not encrypted if there are further envelope recipients without key, e.g. Bcc.
+	bcc := NewEnvelope(acc.Address, "peer@example.com", "bcc@example.com")
+	if b, err = c.bytes(m, bcc); err != nil {
+		t.Fatal(err)
+	}
+	if p, err = ReadPart(bytes.NewReader(b)); err != nil {
+		t.Fatal(err)
+	}
+	if mediatype, _ := p.MediaType(); mediatype != mime_multipart {
+		t.Errorf("expected an unencrypted mail for the Bcc recipient, got %s", mediatype)
+	}
+
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(txs))
+	}
+	data := toCRLF([]byte(txs[0].data))
+	if err := reply.Process(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	}
+	if rec, _ := reply.Recommend(acc.Address); rec != AutocryptEncrypt {
+		t.Errorf("peer didn't learn our key: %s", rec)
+	}
+	msg, err := ReadPGP(bytes.NewReader(data), peer, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Encrypted || !strings.Contains(string(msg.Content.raw), "secret") {
+		t.Errorf("expected an encrypted mail: %+v", msg)
+	}
+
+	// it's encrypted to the envelope recipients only, even if the header lists others.
+	m.Cc("", "other@example.com")
+	if b, err = c.bytes(m, NewEnvelope(acc.Address, "peer@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = ReadPGP(bytes.NewReader(b), peer, nil); err != nil || !msg.Encrypted {
+		t.Errorf("expected an encrypted mail for the envelope recipient: %v", err)
+	}
+}
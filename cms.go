@@ -0,0 +1,829 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/binary"
+	"fmt"
+	"math/big"
+	"sort"
+	"time"
+)
+
+// Object identifiers used in CMS (RFC 5652) structures.
+var (
+	oidData          = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 1}
+	oidSignedData    = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 2}
+	oidEnvelopedData = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 7, 3}
+
+	oidAttrContentType   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 3}
+	oidAttrMessageDigest = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 4}
+	oidAttrSigningTime   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 5}
+
+	oidSHA1   = asn1.ObjectIdentifier{1, 3, 14, 3, 2, 26}
+	oidSHA256 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 1}
+	oidSHA384 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 2}
+	oidSHA512 = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 2, 3}
+
+	oidRSAEncryption   = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 1}
+	oidRSAOAEP         = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 1, 7}
+	oidECDSAWithSHA256 = asn1.ObjectIdentifier{1, 2, 840, 10045, 4, 3, 2}
+	oidECPublicKey     = asn1.ObjectIdentifier{1, 2, 840, 10045, 2, 1}
+
+	oidAES128CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 2}
+	oidAES192CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 22}
+	oidAES256CBC  = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 42}
+	oidAES128Wrap = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 5}
+	oidAES192Wrap = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 25}
+	oidAES256Wrap = asn1.ObjectIdentifier{2, 16, 840, 1, 101, 3, 4, 1, 45}
+
+	// dhSinglePass-stdDH-sha*kdf-scheme (RFC 5753 7.1.4)
+	oidECDHSHA1KDF   = asn1.ObjectIdentifier{1, 3, 133, 16, 840, 63, 0, 2}
+	oidECDHSHA256KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 1}
+	oidECDHSHA384KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 2}
+	oidECDHSHA512KDF = asn1.ObjectIdentifier{1, 3, 132, 1, 11, 3}
+)
+
+// digestHashes maps the supported digest algorithms to their hash functions.
+var digestHashes = map[string]crypto.Hash{
+	oidSHA1.String():   crypto.SHA1,
+	oidSHA256.String(): crypto.SHA256,
+	oidSHA384.String(): crypto.SHA384,
+	oidSHA512.String(): crypto.SHA512,
+}
+
+// kdfHashes maps the supported ECDH key agreement algorithms to the hash functions of their KDF.
+var kdfHashes = map[string]crypto.Hash{
+	oidECDHSHA1KDF.String():   crypto.SHA1,
+	oidECDHSHA256KDF.String(): crypto.SHA256,
+	oidECDHSHA384KDF.String(): crypto.SHA384,
+	oidECDHSHA512KDF.String(): crypto.SHA512,
+}
+
+// contentKeySizes maps the supported content encryption algorithms to their key sizes.
+var contentKeySizes = map[string]int{
+	oidAES128CBC.String(): 16,
+	oidAES192CBC.String(): 24,
+	oidAES256CBC.String(): 32,
+}
+
+// wrapKeySizes maps the supported key wrap algorithms to their key sizes.
+var wrapKeySizes = map[string]int{
+	oidAES128Wrap.String(): 16,
+	oidAES192Wrap.String(): 24,
+	oidAES256Wrap.String(): 32,
+}
+
+// Note: encoding/asn1 doesn't unwrap (or add) explicit tags of RawValue fields,
+// they hold the tagged element itself.
+
+type contentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     asn1.RawValue `asn1:"explicit,tag:0"`
+}
+
+type signedData struct {
+	Version          int
+	DigestAlgorithms []pkix.AlgorithmIdentifier `asn1:"set"`
+	EncapContentInfo encapContentInfo
+	Certificates     asn1.RawValue `asn1:"optional,tag:0"`
+	CRLs             asn1.RawValue `asn1:"optional,tag:1"`
+	SignerInfos      []signerInfo  `asn1:"set"`
+}
+
+type encapContentInfo struct {
+	ContentType asn1.ObjectIdentifier
+	Content     []byte `asn1:"explicit,optional,tag:0"`
+}
+
+type signerInfo struct {
+	Version            int
+	SID                asn1.RawValue // issuerAndSerial or [0] SubjectKeyIdentifier
+	DigestAlgorithm    pkix.AlgorithmIdentifier
+	SignedAttrs        asn1.RawValue `asn1:"optional,tag:0"`
+	SignatureAlgorithm pkix.AlgorithmIdentifier
+	Signature          []byte
+	UnsignedAttrs      asn1.RawValue `asn1:"optional,tag:1"`
+}
+
+type issuerAndSerial struct {
+	Issuer       asn1.RawValue
+	SerialNumber *big.Int
+}
+
+type attribute struct {
+	Type   asn1.ObjectIdentifier
+	Values asn1.RawValue // SET OF AttributeValue
+}
+
+type envelopedData struct {
+	Version              int
+	OriginatorInfo       asn1.RawValue   `asn1:"optional,tag:0"`
+	RecipientInfos       []asn1.RawValue `asn1:"set"`
+	EncryptedContentInfo encryptedContentInfo
+}
+
+type encryptedContentInfo struct {
+	ContentType                asn1.ObjectIdentifier
+	ContentEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedContent           []byte `asn1:"optional,tag:0"`
+}
+
+type keyTransRecipientInfo struct {
+	Version                int
+	RID                    asn1.RawValue // issuerAndSerial or [0] SubjectKeyIdentifier
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	EncryptedKey           []byte
+}
+
+type keyAgreeRecipientInfo struct {
+	Version                int
+	Originator             asn1.RawValue `asn1:"explicit,tag:0"`
+	UKM                    []byte        `asn1:"explicit,optional,tag:1"`
+	KeyEncryptionAlgorithm pkix.AlgorithmIdentifier
+	RecipientEncryptedKeys []recipientEncryptedKey
+}
+
+type originatorPublicKey struct {
+	Algorithm pkix.AlgorithmIdentifier
+	PublicKey asn1.BitString
+}
+
+type recipientEncryptedKey struct {
+	RID          asn1.RawValue // issuerAndSerial or [0] RecipientKeyIdentifier
+	EncryptedKey []byte
+}
+
+// eccCMSSharedInfo is the input to the key derivation function (RFC 5753 7.2).
+type eccCMSSharedInfo struct {
+	KeyInfo     pkix.AlgorithmIdentifier
+	EntityUInfo []byte `asn1:"explicit,optional,tag:0"`
+	SuppPubInfo []byte `asn1:"explicit,tag:2"`
+}
+
+// cmsSign creates a detached CMS SignedData structure (RFC 5652 5) for content,
+// signed with key and including certs (the first one being the signer's).
+func cmsSign(content []byte, key crypto.Signer, certs []*x509.Certificate) ([]byte, error) {
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("S/MIME: no signer certificate")
+	}
+	cert := certs[0]
+
+	var sigAlg asn1.ObjectIdentifier
+	switch key.Public().(type) {
+	case *rsa.PublicKey:
+		sigAlg = oidRSAEncryption
+	case *ecdsa.PublicKey:
+		sigAlg = oidECDSAWithSHA256
+	default:
+		return nil, fmt.Errorf("S/MIME: unsupported signing key type %T (use RSA or ECDSA)", key.Public())
+	}
+
+	digest := sha256.Sum256(content)
+	attrs, err := marshalAttributes(
+		oidAttrContentType, oidData,
+		oidAttrSigningTime, time.Now().UTC(),
+		oidAttrMessageDigest, digest[:],
+	)
+	if err != nil {
+		return nil, err
+	}
+
+	attrsDigest := sha256.Sum256(attrs)
+	sig, err := key.Sign(rand.Reader, attrsDigest[:], crypto.SHA256)
+	if err != nil {
+		return nil, err
+	}
+
+	// the signed attributes are signed as SET, but encoded as [0] IMPLICIT.
+	signed, err := implicit(0, attrs)
+	if err != nil {
+		return nil, err
+	}
+
+	var raw []byte
+	for _, c := range certs {
+		raw = append(raw, c.Raw...)
+	}
+
+	sid, err := certID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	sha256Alg := pkix.AlgorithmIdentifier{Algorithm: oidSHA256, Parameters: asn1.NullRawValue}
+	sd := signedData{
+		Version:          1,
+		DigestAlgorithms: []pkix.AlgorithmIdentifier{sha256Alg},
+		EncapContentInfo: encapContentInfo{ContentType: oidData},
+		Certificates:     asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: 0, IsCompound: true, Bytes: raw},
+		SignerInfos: []signerInfo{{
+			Version:            1,
+			SID:                sid,
+			DigestAlgorithm:    sha256Alg,
+			SignedAttrs:        asn1.RawValue{FullBytes: signed},
+			SignatureAlgorithm: pkix.AlgorithmIdentifier{Algorithm: sigAlg},
+			Signature:          sig,
+		}},
+	}
+	if sigAlg.Equal(oidRSAEncryption) {
+		sd.SignerInfos[0].SignatureAlgorithm.Parameters = asn1.NullRawValue
+	}
+
+	return marshalContentInfo(oidSignedData, sd)
+}
+
+// marshalAttributes DER encodes the given type, value pairs as SET OF Attribute.
+func marshalAttributes(pairs ...interface{}) ([]byte, error) {
+	var encoded [][]byte
+	for i := 0; i < len(pairs); i += 2 {
+		value, err := asn1.Marshal(pairs[i+1])
+		if err != nil {
+			return nil, err
+		}
+		attr, err := asn1.Marshal(attribute{
+			Type:   pairs[i].(asn1.ObjectIdentifier),
+			Values: asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: value},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded = append(encoded, attr)
+	}
+
+	// DER demands the elements of a SET OF to be sorted by their encoding.
+	sort.Slice(encoded, func(i, j int) bool { return bytes.Compare(encoded[i], encoded[j]) < 0 })
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassUniversal, Tag: asn1.TagSet, IsCompound: true, Bytes: bytes.Join(encoded, nil)})
+}
+
+func marshalContentInfo(contentType asn1.ObjectIdentifier, content interface{}) ([]byte, error) {
+	inner, err := asn1.Marshal(content)
+	if err != nil {
+		return nil, err
+	}
+	// asn1.Marshal ignores the explicit tag of RawValue fields, so add it here.
+	return asn1.Marshal(contentInfo{ContentType: contentType, Content: explicit(0, inner)})
+}
+
+// cmsEncrypt creates a CMS EnvelopedData structure (RFC 5652 6) holding content
+// encrypted with AES-256-CBC for each of the recipients. RSA keys use key transport,
+// EC keys ephemeral-static ECDH (RFC 5753).
+func cmsEncrypt(content []byte, recipients []*x509.Certificate) ([]byte, error) {
+	if len(recipients) == 0 {
+		return nil, new(NoRecipients)
+	}
+
+	key := make([]byte, 32)
+	iv := make([]byte, aes.BlockSize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	if _, err := rand.Read(iv); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	padding := aes.BlockSize - len(content)%aes.BlockSize
+	encrypted := append(append([]byte{}, content...), bytes.Repeat([]byte{byte(padding)}, padding)...)
+	cipher.NewCBCEncrypter(block, iv).CryptBlocks(encrypted, encrypted)
+
+	ivParam, err := asn1.Marshal(iv)
+	if err != nil {
+		return nil, err
+	}
+
+	ed := envelopedData{
+		EncryptedContentInfo: encryptedContentInfo{
+			ContentType:                oidData,
+			ContentEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidAES256CBC, Parameters: asn1.RawValue{FullBytes: ivParam}},
+			EncryptedContent:           encrypted,
+		},
+	}
+	for _, cert := range recipients {
+		var ri []byte
+		switch pub := cert.PublicKey.(type) {
+		case *rsa.PublicKey:
+			ri, err = keyTransRecipient(cert, pub, key)
+		case *ecdsa.PublicKey:
+			ri, err = keyAgreeRecipient(cert, pub, key)
+			ed.Version = 2
+		default:
+			err = fmt.Errorf("S/MIME: unsupported recipient key type %T (use RSA or EC)", cert.PublicKey)
+		}
+		if err != nil {
+			return nil, err
+		}
+		ed.RecipientInfos = append(ed.RecipientInfos, asn1.RawValue{FullBytes: ri})
+	}
+
+	return marshalContentInfo(oidEnvelopedData, ed)
+}
+
+// certID returns the DER encoded issuer and serial number identifying cert.
+func certID(cert *x509.Certificate) (asn1.RawValue, error) {
+	der, err := asn1.Marshal(issuerAndSerial{Issuer: asn1.RawValue{FullBytes: cert.RawIssuer}, SerialNumber: cert.SerialNumber})
+	return asn1.RawValue{FullBytes: der}, err
+}
+
+// keyTransRecipient encrypts the content encryption key with the recipient's RSA key.
+func keyTransRecipient(cert *x509.Certificate, pub *rsa.PublicKey, key []byte) ([]byte, error) {
+	rid, err := certID(cert)
+	if err != nil {
+		return nil, err
+	}
+	encKey, err := rsa.EncryptPKCS1v15(rand.Reader, pub, key)
+	if err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(keyTransRecipientInfo{
+		RID:                    rid,
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidRSAEncryption, Parameters: asn1.NullRawValue},
+		EncryptedKey:           encKey,
+	})
+}
+
+// keyAgreeRecipient wraps the content encryption key with a key derived by ECDH
+// from an ephemeral key and the recipient's EC key.
+func keyAgreeRecipient(cert *x509.Certificate, pub *ecdsa.PublicKey, key []byte) ([]byte, error) {
+	if !pub.Curve.IsOnCurve(pub.X, pub.Y) {
+		return nil, fmt.Errorf("S/MIME: invalid EC key")
+	}
+	ephemeral, x, y, err := elliptic.GenerateKey(pub.Curve, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	z, err := ecdhSecret(pub.Curve, ephemeral, pub.X, pub.Y)
+	if err != nil {
+		return nil, err
+	}
+	ephemeralPub := elliptic.Marshal(pub.Curve, x, y)
+
+	wrapAlg := pkix.AlgorithmIdentifier{Algorithm: oidAES256Wrap}
+	kek, err := eccKDF(crypto.SHA256, z, wrapAlg, nil, 32)
+	if err != nil {
+		return nil, err
+	}
+	wrapped, err := aesKeyWrap(kek, key)
+	if err != nil {
+		return nil, err
+	}
+
+	curveOID, err := curveOID(pub.Curve)
+	if err != nil {
+		return nil, err
+	}
+	originator, err := asn1.Marshal(originatorPublicKey{
+		Algorithm: pkix.AlgorithmIdentifier{Algorithm: oidECPublicKey, Parameters: asn1.RawValue{FullBytes: curveOID}},
+		PublicKey: asn1.BitString{Bytes: ephemeralPub, BitLength: 8 * len(ephemeralPub)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	// originatorKey [1] IMPLICIT OriginatorPublicKey
+	if originator, err = implicit(1, originator); err != nil {
+		return nil, err
+	}
+
+	wrapParam, err := asn1.Marshal(wrapAlg)
+	if err != nil {
+		return nil, err
+	}
+	rid, err := certID(cert)
+	if err != nil {
+		return nil, err
+	}
+
+	kari, err := asn1.Marshal(keyAgreeRecipientInfo{
+		Version:                3,
+		Originator:             explicit(0, originator),
+		KeyEncryptionAlgorithm: pkix.AlgorithmIdentifier{Algorithm: oidECDHSHA256KDF, Parameters: asn1.RawValue{FullBytes: wrapParam}},
+		RecipientEncryptedKeys: []recipientEncryptedKey{{RID: rid, EncryptedKey: wrapped}},
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// kari [1] IMPLICIT KeyAgreeRecipientInfo
+	return implicit(1, kari)
+}
+
+// ecdhSecret returns the ECDH shared secret of the private key priv and the public key (x, y):
+// the x coordinate of the product, padded to the size of the curve (RFC 5753 3.3.1).
+func ecdhSecret(curve elliptic.Curve, priv []byte, x, y *big.Int) ([]byte, error) {
+	zx, zy := curve.ScalarMult(x, y, priv)
+	if zx.Sign() == 0 && zy.Sign() == 0 {
+		return nil, fmt.Errorf("S/MIME: invalid ECDH shared secret")
+	}
+	z := make([]byte, (curve.Params().BitSize+7)/8)
+	b := zx.Bytes()
+	copy(z[len(z)-len(b):], b)
+	return z, nil
+}
+
+// explicit wraps the DER encoded der in an explicit context specific tag.
+func explicit(tag int, der []byte) asn1.RawValue {
+	return asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: der}
+}
+
+// implicit replaces the tag of the DER encoded constructed value der with
+// an implicit context specific tag.
+func implicit(tag int, der []byte) ([]byte, error) {
+	var v asn1.RawValue
+	if _, err := asn1.Unmarshal(der, &v); err != nil {
+		return nil, err
+	}
+	return asn1.Marshal(asn1.RawValue{Class: asn1.ClassContextSpecific, Tag: tag, IsCompound: true, Bytes: v.Bytes})
+}
+
+// curveOID returns the DER encoded named curve identifier.
+func curveOID(curve elliptic.Curve) ([]byte, error) {
+	var oid asn1.ObjectIdentifier
+	switch curve {
+	case elliptic.P256():
+		oid = asn1.ObjectIdentifier{1, 2, 840, 10045, 3, 1, 7}
+	case elliptic.P384():
+		oid = asn1.ObjectIdentifier{1, 3, 132, 0, 34}
+	case elliptic.P521():
+		oid = asn1.ObjectIdentifier{1, 3, 132, 0, 35}
+	default:
+		return nil, fmt.Errorf("S/MIME: unsupported curve %s", curve.Params().Name)
+	}
+	return asn1.Marshal(oid)
+}
+
+// eccKDF derives the key encryption key from the shared secret z using the
+// ANSI X9.63 KDF with hash (RFC 5753 7.2).
+func eccKDF(hash crypto.Hash, z []byte, wrapAlg pkix.AlgorithmIdentifier, ukm []byte, size int) ([]byte, error) {
+	bits := make([]byte, 4)
+	binary.BigEndian.PutUint32(bits, uint32(size*8))
+	info, err := asn1.Marshal(eccCMSSharedInfo{KeyInfo: wrapAlg, EntityUInfo: ukm, SuppPubInfo: bits})
+	if err != nil {
+		return nil, err
+	}
+
+	var key []byte
+	counter := make([]byte, 4)
+	for i := uint32(1); len(key) < size; i++ {
+		binary.BigEndian.PutUint32(counter, i)
+		h := hash.New()
+		h.Write(z)
+		h.Write(counter)
+		h.Write(info)
+		key = h.Sum(key)
+	}
+	return key[:size], nil
+}
+
+// aesKeyWrapIV is the default initial value of RFC 3394 2.2.3.1.
+var aesKeyWrapIV = []byte{0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6, 0xa6}
+
+// aesKeyWrap wraps key with kek (RFC 3394).
+func aesKeyWrap(kek, key []byte) ([]byte, error) {
+	if len(key)%8 != 0 || len(key) < 16 {
+		return nil, fmt.Errorf("key wrap: invalid key length %d", len(key))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(key) / 8
+	out := make([]byte, 8+len(key))
+	copy(out, aesKeyWrapIV)
+	copy(out[8:], key)
+
+	buf := make([]byte, 16)
+	for j := 0; j < 6; j++ {
+		for i := 1; i <= n; i++ {
+			copy(buf, out[:8])
+			copy(buf[8:], out[i*8:i*8+8])
+			block.Encrypt(buf, buf)
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(out[:8], binary.BigEndian.Uint64(buf[:8])^t)
+			copy(out[i*8:], buf[8:])
+		}
+	}
+	return out, nil
+}
+
+// aesKeyUnwrap unwraps the key wrapped with kek (RFC 3394).
+func aesKeyUnwrap(kek, wrapped []byte) ([]byte, error) {
+	if len(wrapped)%8 != 0 || len(wrapped) < 24 {
+		return nil, fmt.Errorf("key unwrap: invalid length %d", len(wrapped))
+	}
+	block, err := aes.NewCipher(kek)
+	if err != nil {
+		return nil, err
+	}
+
+	n := len(wrapped)/8 - 1
+	a := make([]byte, 8)
+	copy(a, wrapped[:8])
+	key := make([]byte, len(wrapped)-8)
+	copy(key, wrapped[8:])
+
+	buf := make([]byte, 16)
+	for j := 5; j >= 0; j-- {
+		for i := n; i >= 1; i-- {
+			t := uint64(n*j + i)
+			binary.BigEndian.PutUint64(buf[:8], binary.BigEndian.Uint64(a)^t)
+			copy(buf[8:], key[(i-1)*8:i*8])
+			block.Decrypt(buf, buf)
+			copy(a, buf[:8])
+			copy(key[(i-1)*8:], buf[8:])
+		}
+	}
+
+	if subtle.ConstantTimeCompare(a, aesKeyWrapIV) != 1 {
+		return nil, fmt.Errorf("key unwrap: integrity check failed")
+	}
+	return key, nil
+}
+
+// matchesCert reports whether the recipient or signer identifier id refers to cert.
+func matchesCert(id asn1.RawValue, cert *x509.Certificate) bool {
+	if id.Class == asn1.ClassUniversal && id.Tag == asn1.TagSequence {
+		var ias issuerAndSerial
+		if _, err := asn1.Unmarshal(id.FullBytes, &ias); err != nil {
+			return false
+		}
+		return bytes.Equal(ias.Issuer.FullBytes, cert.RawIssuer) && ias.SerialNumber.Cmp(cert.SerialNumber) == 0
+	}
+
+	if id.Class != asn1.ClassContextSpecific || id.Tag != 0 || len(cert.SubjectKeyId) == 0 {
+		return false
+	}
+	ski := id.Bytes
+	if id.IsCompound {
+		// RecipientKeyIdentifier starts with the subjectKeyIdentifier
+		if _, err := asn1.Unmarshal(id.Bytes, &ski); err != nil {
+			return false
+		}
+	}
+	return bytes.Equal(ski, cert.SubjectKeyId)
+}
+
+// cmsDecrypt decrypts the CMS EnvelopedData structure der with key for the recipient cert.
+func cmsDecrypt(der []byte, cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, err
+	}
+	if !ci.ContentType.Equal(oidEnvelopedData) {
+		return nil, fmt.Errorf("S/MIME: content is not enveloped data (%s)", ci.ContentType)
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		return nil, err
+	}
+
+	contentAlg := ed.EncryptedContentInfo.ContentEncryptionAlgorithm
+	size, ok := contentKeySizes[contentAlg.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("S/MIME: unsupported content encryption algorithm %s", contentAlg.Algorithm)
+	}
+
+	var cek []byte
+	for _, ri := range ed.RecipientInfos {
+		var err error
+		switch {
+		case ri.Class == asn1.ClassUniversal && ri.Tag == asn1.TagSequence:
+			cek, err = decryptKeyTrans(ri.FullBytes, cert, key, size)
+		case ri.Class == asn1.ClassContextSpecific && ri.Tag == 1:
+			cek, err = decryptKeyAgree(ri.FullBytes, cert, key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if cek != nil {
+			break
+		}
+	}
+	if cek == nil {
+		return nil, fmt.Errorf("S/MIME: message is not encrypted for %s", cert.Subject)
+	}
+	if len(cek) != size {
+		return nil, fmt.Errorf("S/MIME: invalid content encryption key")
+	}
+
+	var iv []byte
+	if _, err := asn1.Unmarshal(contentAlg.Parameters.FullBytes, &iv); err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	content := ed.EncryptedContentInfo.EncryptedContent
+	if len(iv) != aes.BlockSize || len(content) == 0 || len(content)%aes.BlockSize != 0 {
+		return nil, fmt.Errorf("S/MIME: invalid encrypted content")
+	}
+	plain := make([]byte, len(content))
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, content)
+
+	padding := int(plain[len(plain)-1])
+	if padding == 0 || padding > aes.BlockSize || !bytes.Equal(plain[len(plain)-padding:], bytes.Repeat([]byte{byte(padding)}, padding)) {
+		return nil, fmt.Errorf("S/MIME: invalid padding")
+	}
+	return plain[:len(plain)-padding], nil
+}
+
+// decryptKeyTrans decrypts the content encryption key of size bytes from the
+// KeyTransRecipientInfo der, it returns nil if der is not meant for cert.
+func decryptKeyTrans(der []byte, cert *x509.Certificate, key crypto.Signer, size int) ([]byte, error) {
+	var ktri keyTransRecipientInfo
+	if _, err := asn1.Unmarshal(der, &ktri); err != nil || !matchesCert(ktri.RID, cert) {
+		return nil, nil
+	}
+	rsaKey, ok := key.(*rsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("S/MIME: key transport needs a RSA key, got %T", key)
+	}
+
+	switch alg := ktri.KeyEncryptionAlgorithm.Algorithm; {
+	case alg.Equal(oidRSAEncryption):
+		// a random key on failure avoids revealing padding errors (Bleichenbacher).
+		cek := make([]byte, size)
+		if _, err := rand.Read(cek); err != nil {
+			return nil, err
+		}
+		if err := rsa.DecryptPKCS1v15SessionKey(rand.Reader, rsaKey, ktri.EncryptedKey, cek); err != nil {
+			return nil, err
+		}
+		return cek, nil
+	case alg.Equal(oidRSAOAEP):
+		// only the default parameters (SHA-1, RFC 3560) are supported.
+		return rsa.DecryptOAEP(sha1.New(), rand.Reader, rsaKey, ktri.EncryptedKey, nil)
+	default:
+		return nil, fmt.Errorf("S/MIME: unsupported key encryption algorithm %s", alg)
+	}
+}
+
+// decryptKeyAgree unwraps the content encryption key from the KeyAgreeRecipientInfo der,
+// it returns nil if der is not meant for cert.
+func decryptKeyAgree(der []byte, cert *x509.Certificate, key crypto.Signer) ([]byte, error) {
+	var kari keyAgreeRecipientInfo
+	if _, err := asn1.UnmarshalWithParams(der, &kari, "tag:1"); err != nil {
+		return nil, nil
+	}
+	var wrapped []byte
+	for _, rek := range kari.RecipientEncryptedKeys {
+		if matchesCert(rek.RID, cert) {
+			wrapped = rek.EncryptedKey
+			break
+		}
+	}
+	if wrapped == nil {
+		return nil, nil
+	}
+
+	ecKey, ok := key.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, fmt.Errorf("S/MIME: key agreement needs an EC key, got %T", key)
+	}
+	var opk originatorPublicKey
+	if _, err := asn1.UnmarshalWithParams(kari.Originator.Bytes, &opk, "tag:1"); err != nil {
+		return nil, fmt.Errorf("S/MIME: unsupported originator: %s", err)
+	}
+	// Unmarshal checks that the point is on the curve.
+	x, y := elliptic.Unmarshal(ecKey.Curve, opk.PublicKey.Bytes)
+	if x == nil {
+		return nil, fmt.Errorf("S/MIME: invalid originator key")
+	}
+	z, err := ecdhSecret(ecKey.Curve, ecKey.D.Bytes(), x, y)
+	if err != nil {
+		return nil, err
+	}
+
+	hash, ok := kdfHashes[kari.KeyEncryptionAlgorithm.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("S/MIME: unsupported key agreement algorithm %s", kari.KeyEncryptionAlgorithm.Algorithm)
+	}
+	var wrapAlg pkix.AlgorithmIdentifier
+	if _, err := asn1.Unmarshal(kari.KeyEncryptionAlgorithm.Parameters.FullBytes, &wrapAlg); err != nil {
+		return nil, err
+	}
+	size, ok := wrapKeySizes[wrapAlg.Algorithm.String()]
+	if !ok {
+		return nil, fmt.Errorf("S/MIME: unsupported key wrap algorithm %s", wrapAlg.Algorithm)
+	}
+
+	kek, err := eccKDF(hash, z, wrapAlg, kari.UKM, size)
+	if err != nil {
+		return nil, err
+	}
+	return aesKeyUnwrap(kek, wrapped)
+}
+
+// cmsVerify verifies the first signature of the CMS SignedData structure der over content,
+// or over the content embedded in der if content is nil. It returns the signer's
+// certificate, all certificates in der and the signed content.
+func cmsVerify(der, content []byte) (*x509.Certificate, []*x509.Certificate, []byte, error) {
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		return nil, nil, nil, err
+	}
+	if !ci.ContentType.Equal(oidSignedData) {
+		return nil, nil, nil, fmt.Errorf("S/MIME: content is not signed data (%s)", ci.ContentType)
+	}
+	var sd signedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+		return nil, nil, nil, err
+	}
+
+	certs, err := x509.ParseCertificates(sd.Certificates.Bytes)
+	if err != nil {
+		return nil, nil, nil, err
+	}
+	if content == nil {
+		content = sd.EncapContentInfo.Content
+	}
+	if content == nil {
+		return nil, certs, nil, fmt.Errorf("S/MIME: no signed content")
+	}
+	if len(sd.SignerInfos) == 0 {
+		return nil, certs, content, fmt.Errorf("S/MIME: no signature")
+	}
+	si := sd.SignerInfos[0]
+
+	var signer *x509.Certificate
+	for _, c := range certs {
+		if matchesCert(si.SID, c) {
+			signer = c
+			break
+		}
+	}
+	if signer == nil {
+		return nil, certs, content, fmt.Errorf("S/MIME: signer certificate not included")
+	}
+
+	hash, ok := digestHashes[si.DigestAlgorithm.Algorithm.String()]
+	if !ok {
+		return signer, certs, content, fmt.Errorf("S/MIME: unsupported digest algorithm %s", si.DigestAlgorithm.Algorithm)
+	}
+	h := hash.New()
+	h.Write(content)
+	digest := h.Sum(nil)
+
+	signed := content
+	if len(si.SignedAttrs.FullBytes) != 0 {
+		// the signed attributes are encoded as [0] IMPLICIT, but signed as SET.
+		signed = append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+		var attrs []attribute
+		if _, err := asn1.UnmarshalWithParams(signed, &attrs, "set"); err != nil {
+			return signer, certs, content, err
+		}
+		var messageDigest []byte
+		for _, attr := range attrs {
+			if attr.Type.Equal(oidAttrMessageDigest) {
+				asn1.Unmarshal(attr.Values.Bytes, &messageDigest)
+			}
+		}
+		if !bytes.Equal(messageDigest, digest) {
+			return signer, certs, content, fmt.Errorf("S/MIME: message digest mismatch")
+		}
+	}
+
+	alg := signatureAlgorithm(signer, hash)
+	if alg == x509.UnknownSignatureAlgorithm {
+		return signer, certs, content, fmt.Errorf("S/MIME: unsupported signature algorithm %s", si.SignatureAlgorithm.Algorithm)
+	}
+	if err := signer.CheckSignature(alg, signed, si.Signature); err != nil {
+		return signer, certs, content, err
+	}
+	return signer, certs, content, nil
+}
+
+// signatureAlgorithm returns the x509 signature algorithm for the key type of cert and hash.
+func signatureAlgorithm(cert *x509.Certificate, hash crypto.Hash) x509.SignatureAlgorithm {
+	algs := map[x509.PublicKeyAlgorithm]map[crypto.Hash]x509.SignatureAlgorithm{
+		x509.RSA: {
+			crypto.SHA1:   x509.SHA1WithRSA,
+			crypto.SHA256: x509.SHA256WithRSA,
+			crypto.SHA384: x509.SHA384WithRSA,
+			crypto.SHA512: x509.SHA512WithRSA,
+		},
+		x509.ECDSA: {
+			crypto.SHA1:   x509.ECDSAWithSHA1,
+			crypto.SHA256: x509.ECDSAWithSHA256,
+			crypto.SHA384: x509.ECDSAWithSHA384,
+			crypto.SHA512: x509.ECDSAWithSHA512,
+		},
+	}
+	return algs[cert.PublicKeyAlgorithm][hash]
+}
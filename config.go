@@ -1,7 +1,10 @@
 package MIMEMail
 
 import (
+	"crypto/sha256"
 	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
 	"io"
 	"net"
 	"net/mail"
@@ -9,6 +12,7 @@ import (
 	"os"
 	"strings"
 
+	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
@@ -26,13 +30,37 @@ type Account struct {
 	// Key holds PGP related values.
 	Key *PGP
 
+	// WKD is used to look up the keys of recipients without a Key when encrypting
+	// mail signed by this account. If it is nil, keys won't be looked up.
+	WKD *WKD
+
+	// KeyPolicy decides whether recipient keys are used for encrypting mail signed by
+	// this account. If it is nil, keys that have expired, been revoked or aren't bound
+	// to the recipient's address are rejected.
+	KeyPolicy *KeyPolicy
+
+	// Autocrypt holds the Autocrypt settings and peer state, if it's nil
+	// Autocrypt isn't used (see Client.Send).
+	Autocrypt *Autocrypt
+
+	// SMIME holds the X.509 certificate (and private key) for S/MIME.
+	SMIME *SMIME
+
+	// DKIM holds the values to DKIM sign mail sent from this account.
+	// If it is nil, mail won't be signed.
+	DKIM *DKIM
+
+	// ARC holds the values to ARC seal mail forwarded through this account
+	// (see Client.Forward). If it is nil, mail won't be sealed.
+	ARC *ARC
+
 	// Server infos used to send mail from this account.
 	Server *Server
 }
 
 // Auth returns a smtp.PlainAuth.
 func (a Account) Auth() smtp.Auth {
-	return smtp.PlainAuth("", a.Address, a.Pass, a.Server.Addr())
+	return smtp.PlainAuth("", a.Address, a.Pass, a.Server.Host)
 }
 
 // Addr returns a mail.Address
@@ -53,27 +81,81 @@ type PGP struct {
 	// Pass holds the password to decrypt the key (if it is encrypted).
 	Pass string
 
+	// Passphrase is called to get the passphrase to decrypt e, if it is encrypted.
+	// If it is nil, Pass is used.
+	Passphrase func(e *openpgp.Entity) ([]byte, error)
+
+	// Store is used to look up the key by the account's Address (or by Fingerprint),
+	// if it is not nil, File and Key are ignored.
+	Store KeyStore
+
+	// Fingerprint is the (hex encoded) fingerprint of the key in Store.
+	// If it is empty, the key is looked up by the account's Address.
+	Fingerprint string
+
+	// EncryptToSelf makes mails signed with this key also encrypted for it,
+	// so the sent copy can be read.
+	EncryptToSelf bool
+
 	// Config holds pgp config values. If it is nil sane defaults will be used.
 	*packet.Config
 }
 
 func (p PGP) Open() (io.Reader, error) {
-	if p.Key != "" {
-		return strings.NewReader(p.Key), nil
+	return openKey(p.File, p.Key)
+}
+
+// openKey returns a reader for key if it is not empty, else for the contents of file.
+func openKey(file, key string) (io.Reader, error) {
+	if key != "" {
+		return strings.NewReader(key), nil
 	}
 
-	f, err := os.Open(p.File)
+	f, err := os.Open(file)
 	if err != nil {
 		return nil, err
 	}
 	return f, nil
 }
 
+// TLSPolicy selects whether STARTTLS is used on connections made by PlainClient.
+type TLSPolicy int
+
+// Valid TLSPolicy values
+const (
+	// TLSOpportunistic uses STARTTLS if the server offers it (the default).
+	TLSOpportunistic TLSPolicy = iota
+
+	// TLSRequired fails with a StartTLSFailed error if the server doesn't offer STARTTLS
+	// or the TLS handshake fails, so nothing is sent unencrypted.
+	TLSRequired
+
+	// TLSNone never uses STARTTLS.
+	TLSNone
+)
+
 // Server holds connection details for a mail server
 type Server struct {
 	Host string
 	Port string
 
+	// TLSPolicy selects whether STARTTLS is used on connections made by PlainClient,
+	// TLSClient connections always use TLS.
+	TLSPolicy TLSPolicy
+
+	// ClientCert is presented to the server for mutual TLS authentication, if it is not nil.
+	ClientCert *tls.Certificate
+
+	// MinTLSVersion is the minimum TLS version accepted (e.g. tls.VersionTLS12),
+	// if it is 0 the default of the tls package is used.
+	MinTLSVersion uint16
+
+	// Fingerprints pins the server's certificate: if it is not empty, the SHA-256 fingerprint
+	// of the server's certificate must be one of them (hex encoded, colons are ignored).
+	// The certificate is verified as usual too, unless InsecureSkipVerify is set in Config
+	// (e.g. to pin a self-signed certificate).
+	Fingerprints []string
+
 	// Config holds TLS connection configuration values.
 	// if it is nil, sane defaults will be used.
 	*tls.Config
@@ -83,3 +165,46 @@ type Server struct {
 func (s Server) Addr() string {
 	return net.JoinHostPort(s.Host, s.Port)
 }
+
+// TLSConfig returns the TLS configuration for connecting to the server: a copy of Config
+// (or an empty one if it's nil) with ServerName set to Host if it is empty and the
+// ClientCert, MinTLSVersion and Fingerprints options applied.
+func (s Server) TLSConfig() *tls.Config {
+	config := &tls.Config{}
+	if s.Config != nil {
+		config = s.Config.Clone()
+	}
+	if config.ServerName == "" {
+		config.ServerName = s.Host
+	}
+	if s.ClientCert != nil {
+		config.Certificates = append(config.Certificates, *s.ClientCert)
+	}
+	if s.MinTLSVersion != 0 {
+		config.MinVersion = s.MinTLSVersion
+	}
+
+	if len(s.Fingerprints) != 0 {
+		pins := make(map[string]bool, len(s.Fingerprints))
+		for _, fpr := range s.Fingerprints {
+			pins[strings.ToLower(strings.Replace(fpr, ":", "", -1))] = true
+		}
+		verify := config.VerifyPeerCertificate
+		config.VerifyPeerCertificate = func(rawCerts [][]byte, chains [][]*x509.Certificate) error {
+			if verify != nil {
+				if err := verify(rawCerts, chains); err != nil {
+					return err
+				}
+			}
+			if len(rawCerts) == 0 {
+				return UnpinnedCertificate("")
+			}
+			sum := sha256.Sum256(rawCerts[0])
+			if fpr := hex.EncodeToString(sum[:]); !pins[fpr] {
+				return UnpinnedCertificate(fpr)
+			}
+			return nil
+		}
+	}
+	return config
+}
@@ -0,0 +1,439 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Canonicalization is a DKIM canonicalization algorithm (RFC 6376 3.4).
+type Canonicalization string
+
+// Valid canonicalization algorithms
+const (
+	CanonicalSimple  Canonicalization = "simple"
+	CanonicalRelaxed Canonicalization = "relaxed"
+)
+
+// DKIM signing algorithms
+const (
+	AlgRSASHA256     = "rsa-sha256"
+	AlgEd25519SHA256 = "ed25519-sha256"
+)
+
+// DefaultDKIMHeaders are the header fields signed if DKIM.Headers is empty.
+// Only the fields present in a message are signed, except for From which is mandatory.
+var DefaultDKIMHeaders = []string{
+	"From", "Sender", "Reply-To", "To", "Cc", "Subject", "Date", "Message-ID",
+	"In-Reply-To", "References", "Disposition-Notification-To",
+	"MIME-Version", "Content-Type", "Content-Transfer-Encoding",
+}
+
+// DKIM holds the values needed to sign outgoing mail with DKIM (RFC 6376).
+type DKIM struct {
+	// Domain is the signing domain (d= tag).
+	Domain string
+
+	// Selector is the selector (s= tag), the public key is published at
+	// <Selector>._domainkey.<Domain>.
+	Selector string
+
+	// File holds the filesystem path from which the PEM encoded private key
+	// (RSA or Ed25519) should be read. If Key below is not empty it will take precedence.
+	File string
+
+	// Key holds the PEM encoded private key, mostly for usage in tests.
+	Key string
+
+	// Headers lists the header fields to sign, DefaultDKIMHeaders are used if it is empty.
+	Headers []string
+
+	// HeaderCanonicalization and BodyCanonicalization default to CanonicalRelaxed.
+	HeaderCanonicalization Canonicalization
+	BodyCanonicalization   Canonicalization
+
+	// Expiration sets the signature expiration (x= tag) relative to the signing time if it is not zero.
+	Expiration time.Duration
+}
+
+// Open returns a reader for the PEM encoded private key.
+func (d DKIM) Open() (io.Reader, error) {
+	return openKey(d.File, d.Key)
+}
+
+// Signer loads the private key.
+func (d DKIM) Signer() (crypto.Signer, error) {
+	return loadSigner(d)
+}
+
+// Sign signs msg (as returned by Mail.Bytes or written by Mail.WriteTo) and
+// returns it with the DKIM-Signature header field prepended. Line breaks in msg
+// are converted to CRLF, as they will be when msg is sent.
+func (d *DKIM) Sign(msg []byte) ([]byte, error) {
+	signer, err := d.Signer()
+	if err != nil {
+		return nil, err
+	}
+
+	msg = toCRLF(msg)
+	header, err := signDKIMStyle(msg, signer, dkimTags{
+		field:     "DKIM-Signature",
+		tags:      []string{"v=1"},
+		domain:    d.Domain,
+		selector:  d.Selector,
+		headers:   d.Headers,
+		headerC:   d.HeaderCanonicalization,
+		bodyC:     d.BodyCanonicalization,
+		expire:    d.Expiration,
+		signedDef: DefaultDKIMHeaders,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return append([]byte(header), msg...), nil
+}
+
+// keySource is implemented by all types holding a PEM encoded key (DKIM, ARC).
+type keySource interface {
+	Open() (io.Reader, error)
+}
+
+// loadSigner reads a PEM encoded RSA or Ed25519 private key from src.
+func loadSigner(src keySource) (crypto.Signer, error) {
+	r, err := src.Open()
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case ed25519.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T (use RSA or Ed25519)", key)
+	}
+}
+
+// dkimTags holds the parameters for signDKIMStyle.
+type dkimTags struct {
+	field     string   // name of the header field
+	tags      []string // leading tags, e.g. "v=1" or "i=1"
+	domain    string
+	selector  string
+	headers   []string
+	headerC   Canonicalization
+	bodyC     Canonicalization
+	expire    time.Duration
+	signedDef []string
+}
+
+// signDKIMStyle creates a DKIM-Signature style header field (also used for
+// ARC-Message-Signature) for msg, which must use CRLF line endings.
+func signDKIMStyle(msg []byte, signer crypto.Signer, t dkimTags) (string, error) {
+	if t.domain == "" || t.selector == "" {
+		return "", fmt.Errorf("%s: domain and selector must be set", t.field)
+	}
+
+	alg, err := signingAlgorithm(signer)
+	if err != nil {
+		return "", err
+	}
+
+	headerC, bodyC := t.headerC, t.bodyC
+	if headerC == "" {
+		headerC = CanonicalRelaxed
+	}
+	if bodyC == "" {
+		bodyC = CanonicalRelaxed
+	}
+	if err := checkCanonicalization(headerC, bodyC); err != nil {
+		return "", err
+	}
+
+	rawHeader, body := splitMessage(msg)
+	fields := parseHeaderFields(rawHeader)
+
+	names := t.headers
+	if len(names) == 0 {
+		names = t.signedDef
+	}
+	signed, names := selectHeaderFields(fields, names)
+
+	bodyHash := sha256.Sum256(canonicalBody(body, bodyC))
+
+	now := time.Now()
+	tags := append([]string{}, t.tags...)
+	tags = append(tags,
+		"a="+alg,
+		"c="+string(headerC)+"/"+string(bodyC),
+		"d="+t.domain,
+		"s="+t.selector,
+		"t="+strconv.FormatInt(now.Unix(), 10),
+	)
+	if t.expire != 0 {
+		tags = append(tags, "x="+strconv.FormatInt(now.Add(t.expire).Unix(), 10))
+	}
+	tags = append(tags,
+		"h="+strings.Join(names, ":"),
+		"bh="+base64.StdEncoding.EncodeToString(bodyHash[:]),
+		"b=",
+	)
+	field := foldTags(t.field, tags)
+
+	h := sha256.New()
+	for _, f := range signed {
+		h.Write(canonicalHeader(f, headerC))
+	}
+	// the signature field itself is hashed without the trailing CRLF.
+	h.Write(bytes.TrimSuffix(canonicalHeader(field, headerC), []byte("\r\n")))
+
+	sig, err := sign(signer, h.Sum(nil))
+	if err != nil {
+		return "", err
+	}
+
+	return field + foldBase64(base64.StdEncoding.EncodeToString(sig)) + "\r\n", nil
+}
+
+// signingAlgorithm returns the DKIM algorithm name for signer's key type.
+func signingAlgorithm(signer crypto.Signer) (string, error) {
+	switch signer.Public().(type) {
+	case *rsa.PublicKey:
+		return AlgRSASHA256, nil
+	case ed25519.PublicKey:
+		return AlgEd25519SHA256, nil
+	default:
+		return "", fmt.Errorf("unsupported key type %T (use RSA or Ed25519)", signer.Public())
+	}
+}
+
+// sign signs the SHA-256 digest with signer. Ed25519 signs the digest itself (RFC 8463).
+func sign(signer crypto.Signer, digest []byte) ([]byte, error) {
+	if _, ok := signer.Public().(ed25519.PublicKey); ok {
+		return signer.Sign(rand.Reader, digest, crypto.Hash(0))
+	}
+	return signer.Sign(rand.Reader, digest, crypto.SHA256)
+}
+
+func checkCanonicalization(c ...Canonicalization) error {
+	for _, can := range c {
+		if can != CanonicalSimple && can != CanonicalRelaxed {
+			return fmt.Errorf("invalid canonicalization %q", can)
+		}
+	}
+	return nil
+}
+
+// foldTags formats the tag list as header field, folding long lines.
+// The last tag (b=) is left open for the signature.
+func foldTags(name string, tags []string) string {
+	var b strings.Builder
+	b.WriteString(name + ":")
+	lineLen := b.Len()
+	for i, tag := range tags {
+		if i < len(tags)-1 {
+			tag += ";"
+		}
+		if lineLen+len(tag)+1 > 76 {
+			b.WriteString("\r\n\t")
+			lineLen = 1
+		} else {
+			b.WriteString(" ")
+			lineLen++
+		}
+		b.WriteString(tag)
+		lineLen += len(tag)
+	}
+	return b.String()
+}
+
+// foldBase64 folds a long base64 value to lines of 72 characters.
+func foldBase64(s string) string {
+	var b strings.Builder
+	for len(s) > 72 {
+		b.WriteString(s[:72] + "\r\n\t")
+		s = s[72:]
+	}
+	b.WriteString(s)
+	return b.String()
+}
+
+// toCRLF converts all line endings in msg to CRLF.
+func toCRLF(msg []byte) []byte {
+	var b bytes.Buffer
+	b.Grow(len(msg) + len(msg)/40)
+	for i, c := range msg {
+		if c == '\n' && (i == 0 || msg[i-1] != '\r') {
+			b.WriteByte('\r')
+		}
+		b.WriteByte(c)
+	}
+	return b.Bytes()
+}
+
+// splitMessage splits msg at the first empty line into header (including the
+// CRLF of the last field) and body.
+func splitMessage(msg []byte) (header, body []byte) {
+	if bytes.HasPrefix(msg, []byte("\r\n")) {
+		return nil, msg[2:]
+	}
+	i := bytes.Index(msg, []byte("\r\n\r\n"))
+	if i < 0 {
+		return msg, nil
+	}
+	return msg[:i+2], msg[i+4:]
+}
+
+// parseHeaderFields splits a raw header into it's fields, keeping continuation lines
+// and the terminating CRLF.
+func parseHeaderFields(header []byte) []string {
+	var fields []string
+	for _, line := range strings.SplitAfter(string(header), "\r\n") {
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(fields) > 0 {
+			fields[len(fields)-1] += line
+			continue
+		}
+		fields = append(fields, line)
+	}
+	return fields
+}
+
+// fieldName returns the name of a raw header field.
+func fieldName(field string) string {
+	if i := strings.Index(field, ":"); i >= 0 {
+		return strings.TrimSpace(field[:i])
+	}
+	return ""
+}
+
+// selectHeaderFields returns the fields to sign for the given names. All instances
+// of a field are signed, starting with the last one (RFC 6376 5.4.2), the name
+// is repeated in the returned names for each instance. Names without an instance
+// are dropped, except for From.
+func selectHeaderFields(fields []string, names []string) ([]string, []string) {
+	used := make(map[int]bool)
+	var signed, signedNames []string
+	for _, name := range names {
+		found := false
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				signed = append(signed, fields[i])
+				signedNames = append(signedNames, name)
+				found = true
+			}
+		}
+		if !found && strings.EqualFold(name, "From") {
+			signedNames = append(signedNames, name)
+		}
+	}
+	return signed, signedNames
+}
+
+// canonicalHeader canonicalizes a single header field (RFC 6376 3.4.1, 3.4.2).
+func canonicalHeader(field string, c Canonicalization) []byte {
+	if c == CanonicalSimple {
+		if !strings.HasSuffix(field, "\r\n") {
+			field += "\r\n"
+		}
+		return []byte(field)
+	}
+
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return nil
+	}
+	name := strings.ToLower(strings.TrimRight(field[:i], " \t"))
+	value := strings.Replace(field[i+1:], "\r\n", "", -1)
+	value = strings.Join(strings.FieldsFunc(value, isWSP), " ")
+	return []byte(name + ":" + value + "\r\n")
+}
+
+func isWSP(r rune) bool {
+	return r == ' ' || r == '\t'
+}
+
+// canonicalBody canonicalizes the body (RFC 6376 3.4.3, 3.4.4).
+func canonicalBody(body []byte, c Canonicalization) []byte {
+	lines := strings.SplitAfter(string(body), "\r\n")
+
+	var b bytes.Buffer
+	for _, line := range lines {
+		if line == "" {
+			continue
+		}
+		if c == CanonicalRelaxed {
+			content := strings.TrimSuffix(line, "\r\n")
+			content = strings.TrimRight(content, " \t")
+			// the body may be 8bit and not valid UTF-8, so it's reduced byte by byte.
+			var reduced strings.Builder
+			wsp := false
+			for i := 0; i < len(content); i++ {
+				if isWSP(rune(content[i])) {
+					wsp = true
+					continue
+				}
+				if wsp {
+					reduced.WriteByte(' ')
+					wsp = false
+				}
+				reduced.WriteByte(content[i])
+			}
+			line = reduced.String() + "\r\n"
+		} else if !strings.HasSuffix(line, "\r\n") {
+			line += "\r\n"
+		}
+		b.WriteString(line)
+	}
+
+	// ignore all empty lines at the end of the body.
+	out := b.Bytes()
+	for bytes.HasSuffix(out, []byte("\r\n\r\n")) {
+		out = out[:len(out)-2]
+	}
+	if bytes.Equal(out, []byte("\r\n")) {
+		out = nil
+	}
+	if len(out) == 0 && c == CanonicalSimple {
+		return []byte("\r\n")
+	}
+	return out
+}
@@ -0,0 +1,167 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"strings"
+	"testing"
+)
+
+// testDKIMKeys returns PEM encoded RSA and Ed25519 test keys.
+func testDKIMKeys(t *testing.T) (rsaPEM, edPEM string) {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaPEM = string(pem.EncodeToMemory(&pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(rsaKey)}))
+
+	_, edKey, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(edKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	edPEM = string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}))
+	return rsaPEM, edPEM
+}
+
+func TestDKIMCanonicalization(t *testing.T) {
+	// example from RFC 6376 3.4.5
+	header := []string{"A: X\r\n", "B : Y\t\r\n\tZ  \r\n"}
+	body := []byte(" C \r\nD \t E\r\n\r\n\r\n")
+
+	var relaxed, simple bytes.Buffer
+	for _, f := range header {
+		relaxed.Write(canonicalHeader(f, CanonicalRelaxed))
+		simple.Write(canonicalHeader(f, CanonicalSimple))
+	}
+	if relaxed.String() != "a:X\r\nb:Y Z\r\n" {
+		t.Errorf("relaxed header: %q", relaxed.String())
+	}
+	if simple.String() != strings.Join(header, "") {
+		t.Errorf("simple header: %q", simple.String())
+	}
+
+	if c := canonicalBody(body, CanonicalRelaxed); string(c) != " C\r\nD E\r\n" {
+		t.Errorf("relaxed body: %q", c)
+	}
+	if c := canonicalBody(body, CanonicalSimple); string(c) != " C \r\nD \t E\r\n" {
+		t.Errorf("simple body: %q", c)
+	}
+	if c := canonicalBody(nil, CanonicalSimple); string(c) != "\r\n" {
+		t.Errorf("simple empty body: %q", c)
+	}
+	if c := canonicalBody([]byte("\r\n\r\n"), CanonicalRelaxed); len(c) != 0 {
+		t.Errorf("relaxed empty body: %q", c)
+	}
+	// 8bit bodies aren't necessarily valid UTF-8.
+	if c := canonicalBody([]byte("Gr\xfc\xdfe  aus\tK\xf6ln \r\n"), CanonicalRelaxed); string(c) != "Gr\xfc\xdfe aus K\xf6ln\r\n" {
+		t.Errorf("relaxed 8bit body: %q", c)
+	}
+}
+
+func TestDKIMSign(t *testing.T) {
+	rsaPEM, edPEM := testDKIMKeys(t)
+
+	for _, test := range []struct {
+		key string
+		alg string
+		c   Canonicalization
+	}{
+		{rsaPEM, AlgRSASHA256, CanonicalRelaxed},
+		{rsaPEM, AlgRSASHA256, CanonicalSimple},
+		{edPEM, AlgEd25519SHA256, CanonicalRelaxed},
+	} {
+		d := &DKIM{Domain: "example.com", Selector: "mail", Key: test.key, HeaderCanonicalization: test.c, BodyCanonicalization: test.c}
+
+		m := MessageFactory()
+		m.PlainTextBody().Write([]byte("hello\nworld\n"))
+		b, err := m.Bytes()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signed, err := d.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, _ := splitMessage(signed)
+		fields := parseHeaderFields(header)
+		sigField := fields[0]
+		tags := strings.Replace(sigField, "\r\n\t", " ", -1)
+		if !strings.HasPrefix(tags, "DKIM-Signature: v=1; a="+test.alg+"; c="+string(test.c)+"/"+string(test.c)+"; d=example.com; s=mail;") {
+			t.Fatalf("unexpected signature header:\n%s", sigField)
+		}
+		if !strings.Contains(tags, "h=From:To:To:Subject:MIME-Version:Content-Type;") {
+			t.Errorf("unexpected signed header fields: %s", tags)
+		}
+
+		// check the signature against the hash of the signed fields.
+
+		i := strings.LastIndex(sigField, "b=")
+		sig, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(sigField[i+2:]), ""))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		signedFields, _ := selectHeaderFields(fields[1:], []string{"From", "To", "Subject", "MIME-Version", "Content-Type"})
+		h := sha256.New()
+		for _, f := range signedFields {
+			h.Write(canonicalHeader(f, test.c))
+		}
+		h.Write(bytes.TrimSuffix(canonicalHeader(sigField[:i+2], test.c), []byte("\r\n")))
+
+		signer, err := d.Signer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch pub := signer.Public().(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, h.Sum(nil), sig)
+		case ed25519.PublicKey:
+			if !ed25519.Verify(pub, h.Sum(nil), sig) {
+				t.Error("invalid ed25519 signature")
+			}
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestClientSendDKIM(t *testing.T) {
+	_, edPEM := testDKIMKeys(t)
+
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	acc := srv.account()
+	acc.DKIM = &DKIM{Domain: "example.com", Selector: "mail", Key: edPEM}
+
+	m := NewMail()
+	m.From("Mr. Sender", "sender@example.com")
+	m.To("Mr. Receiver", "receiver@example.com")
+
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 || !strings.HasPrefix(txs[0].data, "DKIM-Signature: v=1; a=ed25519-sha256;") {
+		t.Fatalf("mail not signed: %+v", txs)
+	}
+}
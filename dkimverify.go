@@ -0,0 +1,323 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// TXTResolver looks up DNS TXT records, *net.Resolver implements it.
+// Provide your own implementation to use a different DNS client or for testing.
+type TXTResolver interface {
+	LookupTXT(ctx context.Context, name string) ([]string, error)
+}
+
+// DKIMStatus is the result of verifying a single signature (RFC 8601 2.7.1).
+type DKIMStatus string
+
+// Valid DKIMStatus values
+const (
+	DKIMPass      DKIMStatus = "pass"
+	DKIMFail      DKIMStatus = "fail"
+	DKIMTempError DKIMStatus = "temperror"
+	DKIMPermError DKIMStatus = "permerror"
+)
+
+// DKIMResult is the result of verifying a single DKIM-Signature.
+type DKIMResult struct {
+	Status DKIMStatus
+
+	// Domain (d= tag) and Selector (s= tag) of the signature.
+	Domain   string
+	Selector string
+
+	// Err holds the reason if Status is not DKIMPass.
+	Err error
+}
+
+// VerifyDKIM verifies all DKIM-Signature header fields of the raw message read from r,
+// looking up the public keys with resolver. If resolver is nil, net.DefaultResolver is used.
+// It returns one result per signature, so a message without signatures yields
+// no results. The returned error is only non-nil if the message couldn't be read.
+func VerifyDKIM(r io.Reader, resolver TXTResolver) ([]DKIMResult, error) {
+	msg, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	header, body := splitMessage(toCRLF(msg))
+	fields := parseHeaderFields(header)
+
+	var results []DKIMResult
+	for _, field := range fields {
+		if !strings.EqualFold(fieldName(field), "DKIM-Signature") {
+			continue
+		}
+		results = append(results, verifyDKIMSignature(context.Background(), resolver, fields, body, field))
+	}
+	return results, nil
+}
+
+// verifyDKIMSignature verifies the DKIM-Signature field sig.
+func verifyDKIMSignature(ctx context.Context, resolver TXTResolver, fields []string, body []byte, sig string) DKIMResult {
+	tags, err := parseTags(fieldValue(sig))
+	if err != nil {
+		return DKIMResult{Status: DKIMPermError, Err: err}
+	}
+	res := DKIMResult{Domain: tags["d"], Selector: tags["s"]}
+
+	if tags["v"] != "1" {
+		return res.failed(DKIMPermError, "unsupported version %q", tags["v"])
+	}
+	if id := tags["i"]; id != "" {
+		at := strings.LastIndex(id, "@")
+		domain := strings.ToLower(id[at+1:])
+		d := strings.ToLower(res.Domain)
+		if domain != d && !strings.HasSuffix(domain, "."+d) {
+			return res.failed(DKIMPermError, "identity %q not in domain %q", id, res.Domain)
+		}
+	}
+	if x := tags["x"]; x != "" {
+		exp, err := strconv.ParseInt(x, 10, 64)
+		if err != nil {
+			return res.failed(DKIMPermError, "invalid expiration %q", x)
+		}
+		if time.Now().Unix() > exp {
+			return res.failed(DKIMPermError, "signature expired")
+		}
+	}
+
+	status, err := verifyDKIMStyle(ctx, resolver, fields, body, sig, tags)
+	res.Status = status
+	res.Err = err
+	return res
+}
+
+func (r DKIMResult) failed(status DKIMStatus, format string, args ...interface{}) DKIMResult {
+	r.Status = status
+	r.Err = fmt.Errorf(format, args...)
+	return r
+}
+
+// verifyDKIMStyle verifies a DKIM-Signature style field (also used for ARC-Message-Signature).
+func verifyDKIMStyle(ctx context.Context, resolver TXTResolver, fields []string, body []byte, sig string, tags map[string]string) (DKIMStatus, error) {
+	for _, tag := range []string{"a", "b", "bh", "d", "h", "s"} {
+		if tags[tag] == "" {
+			return DKIMPermError, fmt.Errorf("missing required tag %s=", tag)
+		}
+	}
+
+	alg := strings.ToLower(tags["a"])
+	if alg != AlgRSASHA256 && alg != AlgEd25519SHA256 {
+		return DKIMPermError, fmt.Errorf("unsupported algorithm %q", alg)
+	}
+
+	headerC, bodyC := CanonicalSimple, CanonicalSimple
+	if c := tags["c"]; c != "" {
+		parts := strings.SplitN(strings.ToLower(c), "/", 2)
+		headerC = Canonicalization(parts[0])
+		if len(parts) == 2 {
+			bodyC = Canonicalization(parts[1])
+		}
+	}
+	if err := checkCanonicalization(headerC, bodyC); err != nil {
+		return DKIMPermError, err
+	}
+
+	names := strings.Split(tags["h"], ":")
+	fromSigned := false
+	for i := range names {
+		names[i] = strings.TrimSpace(names[i])
+		if strings.EqualFold(names[i], "From") {
+			fromSigned = true
+		}
+	}
+	if !fromSigned && strings.EqualFold(fieldName(sig), "DKIM-Signature") {
+		return DKIMPermError, fmt.Errorf("From field not signed")
+	}
+
+	canonical := canonicalBody(body, bodyC)
+	if l := tags["l"]; l != "" {
+		n, err := strconv.Atoi(l)
+		if err != nil || n < 0 || n > len(canonical) {
+			return DKIMPermError, fmt.Errorf("invalid body length %q", l)
+		}
+		canonical = canonical[:n]
+	}
+	bodyHash := sha256.Sum256(canonical)
+	if base64.StdEncoding.EncodeToString(bodyHash[:]) != tags["bh"] {
+		return DKIMFail, fmt.Errorf("body hash did not verify")
+	}
+
+	sigBytes, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return DKIMPermError, fmt.Errorf("invalid signature encoding: %s", err)
+	}
+
+	key, status, err := lookupKey(ctx, resolver, tags["s"], tags["d"])
+	if err != nil {
+		return status, err
+	}
+
+	h := sha256.New()
+	for _, f := range fieldsForNames(fields, names) {
+		h.Write(canonicalHeader(f, headerC))
+	}
+	h.Write(bytes.TrimSuffix(canonicalHeader(stripSignature(sig), headerC), []byte("\r\n")))
+
+	if err := verifySignature(key, alg, h.Sum(nil), sigBytes); err != nil {
+		return DKIMFail, err
+	}
+	return DKIMPass, nil
+}
+
+// verifySignature verifies sig over digest with key.
+func verifySignature(key crypto.PublicKey, alg string, digest, sig []byte) error {
+	switch key := key.(type) {
+	case *rsa.PublicKey:
+		if alg != AlgRSASHA256 {
+			return fmt.Errorf("key type doesn't match algorithm %s", alg)
+		}
+		return rsa.VerifyPKCS1v15(key, crypto.SHA256, digest, sig)
+	case ed25519.PublicKey:
+		if alg != AlgEd25519SHA256 {
+			return fmt.Errorf("key type doesn't match algorithm %s", alg)
+		}
+		if !ed25519.Verify(key, digest, sig) {
+			return fmt.Errorf("signature did not verify")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unsupported key type %T", key)
+	}
+}
+
+// lookupKey retrieves the public key published at <selector>._domainkey.<domain>.
+func lookupKey(ctx context.Context, resolver TXTResolver, selector, domain string) (crypto.PublicKey, DKIMStatus, error) {
+	name := selector + "._domainkey." + domain
+	txts, err := resolver.LookupTXT(ctx, name)
+	if err != nil {
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, DKIMPermError, fmt.Errorf("no key for signature at %s", name)
+		}
+		if tmp, ok := err.(interface{ Temporary() bool }); ok && !tmp.Temporary() {
+			return nil, DKIMPermError, fmt.Errorf("key lookup for %s: %s", name, err)
+		}
+		return nil, DKIMTempError, fmt.Errorf("key lookup for %s: %s", name, err)
+	}
+	if len(txts) == 0 {
+		return nil, DKIMPermError, fmt.Errorf("no key for signature at %s", name)
+	}
+
+	tags, err := parseTags(strings.Join(txts, ""))
+	if err != nil {
+		return nil, DKIMPermError, fmt.Errorf("invalid key record at %s: %s", name, err)
+	}
+	if v, ok := tags["v"]; ok && v != "DKIM1" {
+		return nil, DKIMPermError, fmt.Errorf("invalid key record version %q", v)
+	}
+	if tags["p"] == "" {
+		return nil, DKIMPermError, fmt.Errorf("key at %s has been revoked", name)
+	}
+
+	der, err := base64.StdEncoding.DecodeString(tags["p"])
+	if err != nil {
+		return nil, DKIMPermError, fmt.Errorf("invalid key encoding at %s: %s", name, err)
+	}
+
+	switch k := strings.ToLower(tags["k"]); k {
+	case "", "rsa":
+		if key, err := x509.ParsePKIXPublicKey(der); err == nil {
+			if rsaKey, ok := key.(*rsa.PublicKey); ok {
+				return rsaKey, "", nil
+			}
+			return nil, DKIMPermError, fmt.Errorf("key at %s is not a RSA key", name)
+		}
+		key, err := x509.ParsePKCS1PublicKey(der)
+		if err != nil {
+			return nil, DKIMPermError, fmt.Errorf("invalid key at %s: %s", name, err)
+		}
+		return key, "", nil
+	case "ed25519":
+		if len(der) != ed25519.PublicKeySize {
+			return nil, DKIMPermError, fmt.Errorf("invalid ed25519 key at %s", name)
+		}
+		return ed25519.PublicKey(der), "", nil
+	default:
+		return nil, DKIMPermError, fmt.Errorf("unsupported key type %q at %s", k, name)
+	}
+}
+
+// parseTags parses a DKIM style tag list "a=b; c=d", removing all white space from the values.
+func parseTags(s string) (map[string]string, error) {
+	tags := make(map[string]string)
+	for _, spec := range strings.Split(s, ";") {
+		if strings.TrimSpace(spec) == "" {
+			continue
+		}
+		eq := strings.Index(spec, "=")
+		if eq < 0 {
+			return nil, fmt.Errorf("invalid tag %q", strings.TrimSpace(spec))
+		}
+		name := strings.TrimSpace(spec[:eq])
+		if _, dup := tags[name]; dup {
+			return nil, fmt.Errorf("duplicate tag %s=", name)
+		}
+		tags[name] = strings.Join(strings.Fields(spec[eq+1:]), "")
+	}
+	return tags, nil
+}
+
+// fieldValue returns the unfolded value of a raw header field.
+func fieldValue(field string) string {
+	i := strings.Index(field, ":")
+	if i < 0 {
+		return ""
+	}
+	return strings.TrimSpace(strings.Replace(field[i+1:], "\r\n", "", -1))
+}
+
+// fieldsForNames returns the header fields listed in names for verification:
+// for each name the last not yet used instance, non existing fields are skipped.
+func fieldsForNames(fields, names []string) []string {
+	used := make(map[int]bool)
+	var selected []string
+	for _, name := range names {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if !used[i] && strings.EqualFold(fieldName(fields[i]), name) {
+				used[i] = true
+				selected = append(selected, fields[i])
+				break
+			}
+		}
+	}
+	return selected
+}
+
+// stripSignature removes the value of the b= tag from the signature field sig.
+func stripSignature(sig string) string {
+	i := strings.Index(sig, ":")
+	parts := strings.Split(sig[i+1:], ";")
+	for j, p := range parts {
+		eq := strings.Index(p, "=")
+		if eq >= 0 && strings.TrimSpace(p[:eq]) == "b" {
+			parts[j] = p[:eq+1]
+		}
+	}
+	return sig[:i+1] + strings.Join(parts, ";")
+}
@@ -0,0 +1,161 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"context"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"net"
+	"testing"
+)
+
+// testResolver is an in-memory TXTResolver, names missing in records are not found
+// and names in fail return a temporary error.
+type testResolver struct {
+	records map[string][]string
+	fail    map[string]bool
+}
+
+func (r testResolver) LookupTXT(ctx context.Context, name string) ([]string, error) {
+	if r.fail[name] {
+		return nil, &net.DNSError{Err: "server misbehaving", Name: name, IsTemporary: true}
+	}
+	txt, ok := r.records[name]
+	if !ok {
+		return nil, &net.DNSError{Err: "no such host", Name: name, IsNotFound: true}
+	}
+	return txt, nil
+}
+
+// dkimRecord returns the DNS TXT record publishing the public key of d.
+func dkimRecord(t *testing.T, d *DKIM) string {
+	signer, err := d.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if pub, ok := signer.Public().(*rsa.PublicKey); ok {
+		der, err := x509.MarshalPKIXPublicKey(pub)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return "v=DKIM1; k=rsa; p=" + base64.StdEncoding.EncodeToString(der)
+	}
+	return "v=DKIM1; k=ed25519; p=" + base64.StdEncoding.EncodeToString(signer.Public().(ed25519.PublicKey))
+}
+
+func TestVerifyDKIM(t *testing.T) {
+	rsaPEM, edPEM := testDKIMKeys(t)
+	rsaDKIM := &DKIM{Domain: "example.com", Selector: "rsa", Key: rsaPEM}
+	edDKIM := &DKIM{Domain: "example.com", Selector: "ed", Key: edPEM, HeaderCanonicalization: CanonicalSimple, BodyCanonicalization: CanonicalSimple}
+
+	resolver := testResolver{
+		records: map[string][]string{
+			"rsa._domainkey.example.com": {dkimRecord(t, rsaDKIM)},
+			"ed._domainkey.example.com":  {dkimRecord(t, edDKIM)},
+		},
+		fail: map[string]bool{"down._domainkey.example.com": true},
+	}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err := rsaDKIM.Sign(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed, err = edDKIM.Sign(signed)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	results, err := VerifyDKIM(bytes.NewReader(signed), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 2 {
+		t.Fatalf("expected 2 results, got %+v", results)
+	}
+	for _, res := range results {
+		if res.Status != DKIMPass || res.Domain != "example.com" {
+			t.Errorf("%s: %s (%v)", res.Selector, res.Status, res.Err)
+		}
+	}
+
+	for _, test := range []struct {
+		name   string
+		msg    []byte
+		status DKIMStatus
+	}{
+		{"body", bytes.Replace(signed, []byte("world"), []byte("there"), 1), DKIMFail},
+		{"header", bytes.Replace(signed, []byte("Subject: "), []byte("Subject: Re: "), 1), DKIMFail},
+	} {
+		results, err := VerifyDKIM(bytes.NewReader(test.msg), resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, res := range results {
+			if res.Status != test.status {
+				t.Errorf("modified %s, %s: expected %s, got %s (%v)", test.name, res.Selector, test.status, res.Status, res.Err)
+			}
+		}
+	}
+
+	for _, test := range []struct {
+		selector string
+		status   DKIMStatus
+	}{
+		{"missing", DKIMPermError},
+		{"down", DKIMTempError},
+	} {
+		d := &DKIM{Domain: "example.com", Selector: test.selector, Key: edPEM}
+		signed, err := d.Sign(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		results, err := VerifyDKIM(bytes.NewReader(signed), resolver)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(results) != 1 || results[0].Status != test.status {
+			t.Errorf("selector %s: expected %s, got %+v", test.selector, test.status, results)
+		}
+	}
+}
+
+func TestVerifyDKIM8bit(t *testing.T) {
+	rsaPEM, _ := testDKIMKeys(t)
+	d := &DKIM{Domain: "example.com", Selector: "rsa", Key: rsaPEM}
+	resolver := testResolver{records: map[string][]string{"rsa._domainkey.example.com": {dkimRecord(t, d)}}}
+
+	// a Latin-1 body, which isn't valid UTF-8.
+	msg := []byte("From: sender@example.com\r\nSubject: 8bit\r\nContent-Type: text/plain; charset=iso-8859-1\r\n" +
+		"Content-Transfer-Encoding: 8bit\r\n\r\nGr\xfc\xdfe  aus K\xf6ln\r\n")
+	signed, err := d.Sign(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	fields := parseHeaderFields(signed[:bytes.Index(signed, []byte("\r\n\r\n"))+2])
+	tags, err := parseTags(fieldValue(fields[0]))
+	if err != nil {
+		t.Fatal(err)
+	}
+	bh := sha256.Sum256([]byte("Gr\xfc\xdfe aus K\xf6ln\r\n"))
+	if tags["bh"] != base64.StdEncoding.EncodeToString(bh[:]) {
+		t.Errorf("unexpected body hash %s", tags["bh"])
+	}
+
+	results, err := VerifyDKIM(bytes.NewReader(signed), resolver)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(results) != 1 || results[0].Status != DKIMPass {
+		t.Errorf("expected the signature to pass: %+v", results)
+	}
+}
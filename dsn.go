@@ -0,0 +1,285 @@
+package MIMEMail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"regexp"
+	"strings"
+)
+
+// DSN Actions (RFC 3464 2.3.3)
+const (
+	ActionFailed    = "failed"
+	ActionDelayed   = "delayed"
+	ActionDelivered = "delivered"
+	ActionRelayed   = "relayed"
+	ActionExpanded  = "expanded"
+)
+
+// DSN holds the results of parsing a Delivery Status Notification (a bounce message).
+type DSN struct {
+	// ReportingMTA is the MTA that generated the report (without the "dns;" type prefix).
+	ReportingMTA string
+
+	// OriginalMessageID is the Message-ID of the message the report is about,
+	// if it could be determined.
+	OriginalMessageID string
+
+	// OriginalEnvelopeID is the envelope ID given with the ENVID parameter of the
+	// MAIL FROM command (RFC 3461), if it has been reported. It is not a Message-ID.
+	OriginalEnvelopeID string
+
+	// Recipients holds the delivery status of each recipient in the report.
+	Recipients []DSNRecipient
+
+	// Heuristic is true if the message is not a RFC 3464 report and the
+	// results have been guessed from the human readable text.
+	Heuristic bool
+}
+
+// DSNRecipient holds the delivery status of a single recipient.
+type DSNRecipient struct {
+	// FinalRecipient is the address the delivery was attempted to.
+	FinalRecipient string
+
+	// OriginalRecipient is the address as given by the sender (if reported).
+	OriginalRecipient string
+
+	// Action is one of the Action... constants.
+	Action string
+
+	// Status is the enhanced status code (RFC 3463), e.g. "5.1.1".
+	Status string
+
+	// DiagnosticCode holds the response of the remote server, e.g. "550 5.1.1 User unknown".
+	DiagnosticCode string
+
+	// RemoteMTA is the server that returned the DiagnosticCode (if reported).
+	RemoteMTA string
+}
+
+// Permanent reports whether the delivery failed permanently (Status class 5).
+func (r DSNRecipient) Permanent() bool {
+	return strings.HasPrefix(r.Status, "5.")
+}
+
+// Temporary reports whether the delivery failed temporarily (Status class 4).
+func (r DSNRecipient) Temporary() bool {
+	return strings.HasPrefix(r.Status, "4.")
+}
+
+// ParseDSN parses the raw message read from r as a delivery status notification.
+// multipart/report; report-type=delivery-status messages (RFC 3464) are parsed as such,
+// other messages are checked for the common non standard bounce formats (qmail,
+// exim, postfix and the big mail providers) and the results are guessed from the text.
+// If the message doesn't look like a bounce at all, a NotAReport error is returned.
+func ParseDSN(r io.Reader) (*DSN, error) {
+	msg, err := ReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+
+	report := findReport(msg, "delivery-status")
+	if report == nil {
+		return parseBounce(msg)
+	}
+
+	status := report.find("message/delivery-status", "message/global-delivery-status")
+	if status == nil {
+		return parseBounce(msg)
+	}
+
+	groups, err := readFieldGroups(status)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, NotAReport("delivery-status")
+	}
+
+	dsn := &DSN{
+		ReportingMTA:       typedValue(groups[0].Get("Reporting-Mta")),
+		OriginalMessageID:  originalMessageID(report),
+		OriginalEnvelopeID: strings.TrimSpace(groups[0].Get("Original-Envelope-Id")),
+	}
+
+	for _, group := range groups[1:] {
+		rcpt := DSNRecipient{
+			FinalRecipient:    typedValue(group.Get("Final-Recipient")),
+			OriginalRecipient: typedValue(group.Get("Original-Recipient")),
+			Action:            strings.ToLower(strings.TrimSpace(group.Get("Action"))),
+			Status:            strings.TrimSpace(group.Get("Status")),
+			DiagnosticCode:    typedValue(group.Get("Diagnostic-Code")),
+			RemoteMTA:         typedValue(group.Get("Remote-Mta")),
+		}
+		if m := enhancedStatus.FindString(rcpt.Status); m != "" {
+			rcpt.Status = m
+		}
+		dsn.Recipients = append(dsn.Recipients, rcpt)
+	}
+
+	return dsn, nil
+}
+
+var (
+	enhancedStatus = regexp.MustCompile(`\b[245]\.\d{1,3}\.\d{1,3}\b`)
+	basicStatus    = regexp.MustCompile(`\b([245])\d\d\b`)
+
+	bounceAddress = `[A-Za-z0-9._%+=/'!#$&*?^{|}~-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`
+
+	// qmail, postfix and yahoo: "<user@example.com>: diagnostic" or "<user@example.com>:" followed by the diagnostic.
+	bracketedRecipient = regexp.MustCompile(`^<(` + bounceAddress + `)>:\s*(.*)$`)
+	// exim: the failed address on an indented line of it's own, followed by the further indented diagnostic.
+	indentedRecipient = regexp.MustCompile(`^(\s+)(` + bounceAddress + `)\s*$`)
+
+	bodyMessageID = regexp.MustCompile(`(?im)^\s*Message-ID:\s*(<[^>\s]+>)`)
+
+	bounceSubject = regexp.MustCompile(`(?i)undeliver|delivery status notification|delivery failure|failure notice|returned mail|could not be delivered|mail delivery failed|delivery has failed`)
+	bounceSender  = regexp.MustCompile(`(?i)mailer-daemon|postmaster`)
+	delayedText   = regexp.MustCompile(`(?i)delayed|will (be )?retr(y|ied)|still trying|not yet been delivered`)
+)
+
+// parseBounce applies heuristics to msg that is not a RFC 3464 report.
+func parseBounce(msg *MIMEPart) (*DSN, error) {
+	failed := msg.Get("X-Failed-Recipients")
+	if failed == "" && !bounceSubject.MatchString(msg.Get("Subject")) && !bounceSender.MatchString(msg.Get("From")) {
+		return nil, NotAReport("delivery-status")
+	}
+
+	var text []byte
+	if p := msg.find(mime_text); p != nil {
+		if content, err := p.Content(); err == nil {
+			text = content
+		}
+	}
+
+	dsn := &DSN{Heuristic: true, OriginalMessageID: originalMessageID(msg)}
+	if dsn.OriginalMessageID == "" {
+		if m := bodyMessageID.FindSubmatch(text); m != nil {
+			dsn.OriginalMessageID = string(m[1])
+		}
+	}
+
+	diagnostics := bounceDiagnostics(text)
+
+	var recipients []string
+	for _, addr := range strings.Split(failed, ",") {
+		if addr = strings.Trim(strings.TrimSpace(addr), "<>"); addr != "" {
+			recipients = append(recipients, addr)
+		}
+	}
+	for _, d := range diagnostics {
+		recipients = append(recipients, d.addr)
+	}
+
+	seen := make(map[string]bool)
+	for _, addr := range recipients {
+		key := strings.ToLower(addr)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		rcpt := DSNRecipient{FinalRecipient: addr}
+		for _, d := range diagnostics {
+			if strings.EqualFold(d.addr, addr) {
+				rcpt.DiagnosticCode = d.text
+				break
+			}
+		}
+		rcpt.Status, rcpt.Action = guessStatus(rcpt.DiagnosticCode, text)
+		dsn.Recipients = append(dsn.Recipients, rcpt)
+	}
+
+	if len(dsn.Recipients) == 0 {
+		return nil, NotAReport("delivery-status")
+	}
+	return dsn, nil
+}
+
+type bounceDiagnostic struct {
+	addr string
+	text string
+}
+
+// bounceDiagnostics extracts the failed addresses and the diagnostic text following
+// them from the human readable part of a bounce.
+func bounceDiagnostics(text []byte) []bounceDiagnostic {
+	var (
+		diags  []bounceDiagnostic
+		cur    *bounceDiagnostic
+		indent string
+		lines  []string
+	)
+	flush := func() {
+		if cur != nil {
+			cur.text = strings.Join(lines, " ")
+			diags = append(diags, *cur)
+		}
+		cur, indent, lines = nil, "", nil
+	}
+
+	sc := bufio.NewScanner(bytes.NewReader(text))
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r ")
+
+		if m := bracketedRecipient.FindStringSubmatch(line); m != nil {
+			flush()
+			cur = &bounceDiagnostic{addr: m[1]}
+			if m[2] != "" {
+				lines = append(lines, m[2])
+			}
+			continue
+		}
+		if m := indentedRecipient.FindStringSubmatch(line); m != nil && (cur == nil || len(m[1]) <= len(indent)) {
+			flush()
+			cur = &bounceDiagnostic{addr: m[2]}
+			indent = m[1]
+			continue
+		}
+
+		if cur == nil {
+			continue
+		}
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			if len(lines) > 0 {
+				flush()
+			}
+			continue
+		}
+		if indent != "" && !strings.HasPrefix(line, indent+" ") && !strings.HasPrefix(line, indent+"\t") {
+			flush()
+			continue
+		}
+		lines = append(lines, trimmed)
+	}
+	flush()
+
+	return diags
+}
+
+// guessStatus derives the enhanced status code and the action from a diagnostic
+// text, falling back to the whole text of the bounce.
+func guessStatus(diagnostic string, text []byte) (status, action string) {
+	if m := enhancedStatus.FindString(diagnostic); m != "" {
+		status = m
+	} else if m := basicStatus.FindStringSubmatch(diagnostic); m != nil {
+		status = m[1] + ".0.0"
+	} else if delayedText.Match(text) {
+		status = "4.0.0"
+	} else {
+		status = "5.0.0"
+	}
+
+	switch status[0] {
+	case '2':
+		action = ActionDelivered
+	case '4':
+		action = ActionDelayed
+	default:
+		action = ActionFailed
+	}
+	return status, action
+}
@@ -0,0 +1,211 @@
+package MIMEMail
+
+import (
+	"strings"
+	"testing"
+)
+
+const postfixDSN = "From: MAILER-DAEMON@mail.example.org (Mail Delivery System)\r\n" +
+	"Subject: Undelivered Mail Returned to Sender\r\n" +
+	"To: sender@example.org\r\n" +
+	"MIME-Version: 1.0\r\n" +
+	"Content-Type: multipart/report; report-type=delivery-status;\r\n" +
+	"\tboundary=\"B1\"\r\n" +
+	"\r\n" +
+	"This is a MIME-encapsulated message.\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Description: Notification\r\n" +
+	"Content-Type: text/plain; charset=us-ascii\r\n" +
+	"\r\n" +
+	"I'm sorry to have to inform you that your message could not\r\n" +
+	"be delivered to one or more recipients.\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Description: Delivery report\r\n" +
+	"Content-Type: message/delivery-status\r\n" +
+	"\r\n" +
+	"Reporting-MTA: dns; mail.example.org\r\n" +
+	"Original-Envelope-Id: QQ314159\r\n" +
+	"X-Postfix-Queue-ID: 3F2A1C0042\r\n" +
+	"Arrival-Date: Sun, 18 Oct 2026 10:00:00 +0200 (CEST)\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; nobody@example.com\r\n" +
+	"Original-Recipient: rfc822;Nobody@example.com\r\n" +
+	"Action: failed\r\n" +
+	"Status: 5.1.1\r\n" +
+	"Remote-MTA: dns; mx.example.com\r\n" +
+	"Diagnostic-Code: smtp; 550 5.1.1 <nobody@example.com>: Recipient address\r\n" +
+	"    rejected: User unknown\r\n" +
+	"\r\n" +
+	"Final-Recipient: rfc822; slow@example.com\r\n" +
+	"Action: delayed\r\n" +
+	"Status: 4.4.1\r\n" +
+	"\r\n" +
+	"--B1\r\n" +
+	"Content-Description: Undelivered Message Headers\r\n" +
+	"Content-Type: text/rfc822-headers\r\n" +
+	"\r\n" +
+	"From: sender@example.org\r\n" +
+	"To: nobody@example.com\r\n" +
+	"Subject: hello\r\n" +
+	"Message-ID: <1234@example.org>\r\n" +
+	"\r\n" +
+	"--B1--\r\n"
+
+func TestParseDSN(t *testing.T) {
+	dsn, err := ParseDSN(strings.NewReader(postfixDSN))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if dsn.Heuristic {
+		t.Error("standard report parsed heuristically")
+	}
+	if dsn.ReportingMTA != "mail.example.org" {
+		t.Errorf("unexpected Reporting-MTA: %q", dsn.ReportingMTA)
+	}
+	if dsn.OriginalMessageID != "<1234@example.org>" {
+		t.Errorf("unexpected original Message-ID: %q", dsn.OriginalMessageID)
+	}
+	if dsn.OriginalEnvelopeID != "QQ314159" {
+		t.Errorf("unexpected original envelope ID: %q", dsn.OriginalEnvelopeID)
+	}
+
+	// the envelope ID isn't taken for the Message-ID.
+	noMsgID := strings.Replace(postfixDSN, "Message-ID: <1234@example.org>\r\n", "", 1)
+	if other, err := ParseDSN(strings.NewReader(noMsgID)); err != nil || other.OriginalMessageID != "" || other.OriginalEnvelopeID != "QQ314159" {
+		t.Errorf("unexpected IDs without Message-ID: %+v (%v)", other, err)
+	}
+	if len(dsn.Recipients) != 2 {
+		t.Fatalf("expected 2 recipients, got %d", len(dsn.Recipients))
+	}
+
+	exp := DSNRecipient{
+		FinalRecipient:    "nobody@example.com",
+		OriginalRecipient: "Nobody@example.com",
+		Action:            ActionFailed,
+		Status:            "5.1.1",
+		DiagnosticCode:    "550 5.1.1 <nobody@example.com>: Recipient address rejected: User unknown",
+		RemoteMTA:         "mx.example.com",
+	}
+	if dsn.Recipients[0] != exp {
+		t.Errorf("expected\n%+v\ngot\n%+v", exp, dsn.Recipients[0])
+	}
+	if !dsn.Recipients[0].Permanent() {
+		t.Error("5.1.1 should be permanent")
+	}
+
+	if r := dsn.Recipients[1]; r.FinalRecipient != "slow@example.com" || r.Action != ActionDelayed || !r.Temporary() {
+		t.Errorf("unexpected second recipient: %+v", r)
+	}
+}
+
+func TestParseBounceHeuristics(t *testing.T) {
+	tests := []struct {
+		name   string
+		msg    string
+		rcpt   string
+		status string
+		action string
+		msgID  string
+	}{
+		{
+			name: "qmail",
+			msg: "From: MAILER-DAEMON@mail.example.org\r\n" +
+				"Subject: failure notice\r\n" +
+				"\r\n" +
+				"Hi. This is the qmail-send program at mail.example.org.\r\n" +
+				"I'm afraid I wasn't able to deliver your message to the following addresses.\r\n" +
+				"This is a permanent error; I've given up. Sorry it didn't work out.\r\n" +
+				"\r\n" +
+				"<nobody@example.com>:\r\n" +
+				"192.0.2.1 does not like recipient.\r\n" +
+				"Remote host said: 550 5.1.1 No such user\r\n" +
+				"Giving up on 192.0.2.1.\r\n" +
+				"\r\n" +
+				"--- Below this line is a copy of the message.\r\n" +
+				"\r\n" +
+				"Message-ID: <qmail@example.org>\r\n",
+			rcpt:   "nobody@example.com",
+			status: "5.1.1",
+			action: ActionFailed,
+			msgID:  "<qmail@example.org>",
+		},
+		{
+			name: "exim",
+			msg: "From: Mail Delivery System <Mailer-Daemon@mail.example.org>\r\n" +
+				"Subject: Mail delivery failed: returning message to sender\r\n" +
+				"X-Failed-Recipients: nobody@example.com\r\n" +
+				"\r\n" +
+				"This message was created automatically by mail delivery software.\r\n" +
+				"\r\n" +
+				"A message that you sent could not be delivered to one or more of its\r\n" +
+				"recipients. This is a permanent error. The following address(es) failed:\r\n" +
+				"\r\n" +
+				"  nobody@example.com\r\n" +
+				"    host mx.example.com [192.0.2.1]\r\n" +
+				"    SMTP error from remote mail server after RCPT TO:<nobody@example.com>:\r\n" +
+				"    550 5.1.1 User unknown\r\n",
+			rcpt:   "nobody@example.com",
+			status: "5.1.1",
+			action: ActionFailed,
+		},
+		{
+			name: "postfix without report",
+			msg: "From: MAILER-DAEMON@mail.example.org\r\n" +
+				"Subject: Delayed Mail (still being retried)\r\n" +
+				"\r\n" +
+				"<later@example.com>: host mx.example.com[192.0.2.1] said: 450 4.2.0\r\n" +
+				"    Mailbox busy (in reply to RCPT TO command)\r\n",
+			rcpt:   "later@example.com",
+			status: "4.2.0",
+			action: ActionDelayed,
+		},
+		{
+			name: "provider with basic status only",
+			msg: "From: postmaster@provider.example\r\n" +
+				"Subject: Delivery Status Notification (Failure)\r\n" +
+				"X-Failed-Recipients: gone@example.com\r\n" +
+				"\r\n" +
+				"Delivery to the following recipient failed permanently:\r\n" +
+				"\r\n" +
+				"     gone@example.com\r\n" +
+				"\r\n",
+			rcpt:   "gone@example.com",
+			status: "5.0.0",
+			action: ActionFailed,
+		},
+	}
+
+	for _, test := range tests {
+		dsn, err := ParseDSN(strings.NewReader(test.msg))
+		if err != nil {
+			t.Errorf("%s: %s", test.name, err)
+			continue
+		}
+		if !dsn.Heuristic {
+			t.Errorf("%s: expected heuristic results", test.name)
+		}
+		if len(dsn.Recipients) != 1 {
+			t.Errorf("%s: expected 1 recipient, got %+v", test.name, dsn.Recipients)
+			continue
+		}
+		r := dsn.Recipients[0]
+		if r.FinalRecipient != test.rcpt || r.Status != test.status || r.Action != test.action {
+			t.Errorf("%s: unexpected result %+v", test.name, r)
+		}
+		if dsn.OriginalMessageID != test.msgID {
+			t.Errorf("%s: expected Message-ID %q, got %q", test.name, test.msgID, dsn.OriginalMessageID)
+		}
+	}
+}
+
+func TestParseDSNNoBounce(t *testing.T) {
+	msg := "From: friend@example.com\r\nSubject: lunch?\r\n\r\nsee you at noon\r\n"
+	if _, err := ParseDSN(strings.NewReader(msg)); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(NotAReport); !ok {
+		t.Fatalf("expected NotAReport, got %T: %s", err, err)
+	}
+}
@@ -0,0 +1,188 @@
+package MIMEMail
+
+import (
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/smtp"
+	"strings"
+)
+
+// Envelope holds the SMTP envelope of a message, that is the reverse path
+// passed with MAIL FROM (where bounces are sent to) and the forward paths
+// passed with RCPT TO. It is independent of the address header fields of the
+// message, so mail can be delivered to recipients that don't appear in the header
+// or with a bounce address that differs from Sender / From.
+type Envelope struct {
+	// From is the envelope sender (MAIL FROM / Return-Path).
+	// If it is empty, the null reverse path "<>" is used.
+	From string
+
+	// To holds the envelope recipients (RCPT TO).
+	To []Rcpt
+}
+
+// Rcpt is a single envelope recipient.
+type Rcpt struct {
+	// Address is the recipients mail address.
+	Address string
+
+	// Params holds additional ESMTP parameters for the RCPT TO command,
+	// e.g. "NOTIFY=FAILURE,DELAY" or "ORCPT=rfc822;foo@example.com" (RFC 3461).
+	Params []string
+}
+
+// NewEnvelope creates a new Envelope with the given envelope sender and recipients.
+func NewEnvelope(from string, to ...string) *Envelope {
+	e := &Envelope{From: from, To: make([]Rcpt, 0, len(to))}
+	for _, addr := range to {
+		e.Add(addr)
+	}
+	return e
+}
+
+// Add adds address with the optional RCPT TO parameters to the envelope recipients.
+func (e *Envelope) Add(address string, params ...string) {
+	e.To = append(e.To, Rcpt{Address: address, Params: params})
+}
+
+// Recipients returns just the mail addresses of the envelope recipients.
+func (e *Envelope) Recipients() []string {
+	to := make([]string, 0, len(e.To))
+	for _, rcpt := range e.To {
+		to = append(to, rcpt.Address)
+	}
+	return to
+}
+
+// Envelope derives the SMTP envelope from the address header fields:
+// EffectiveSender is used as the envelope sender and Recipients as the envelope
+// recipients.
+func (a Addresses) Envelope() (*Envelope, error) {
+	from, err := a.EffectiveSender()
+	if err != nil {
+		return nil, err
+	}
+	return NewEnvelope(from, a.Recipients()...), nil
+}
+
+// envelope returns the first of the given envelopes or derives one from the address header
+// fields of m if there is none.
+func (m *Mail) envelope(env []*Envelope) (*Envelope, error) {
+	if len(env) != 0 && env[0] != nil {
+		return env[0], nil
+	}
+	return m.Envelope()
+}
+
+func (e *Envelope) validate() error {
+	if len(e.To) == 0 {
+		return new(NoRecipients)
+	}
+
+	lines := []string{e.From}
+	for _, rcpt := range e.To {
+		lines = append(lines, rcpt.Address)
+		lines = append(lines, rcpt.Params...)
+	}
+	for _, line := range lines {
+		if strings.ContainsAny(line, "\r\n") {
+			return fmt.Errorf("smtp: A line must not contain CR or LF")
+		}
+	}
+	return nil
+}
+
+// open starts a mail transaction for the envelope on c and returns the
+// writer for the message data.
+func (e *Envelope) open(c *smtp.Client) (io.WriteCloser, error) {
+	if err := e.validate(); err != nil {
+		return nil, err
+	}
+
+	if err := c.Mail(e.From); err != nil {
+		return nil, err
+	}
+
+	for _, rcpt := range e.To {
+		if len(rcpt.Params) == 0 {
+			if err := c.Rcpt(rcpt.Address); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// smtp.Client.Rcpt doesn't support parameters, so issue the command ourselves.
+		id, err := c.Text.Cmd("RCPT TO:<%s> %s", rcpt.Address, strings.Join(rcpt.Params, " "))
+		if err != nil {
+			return nil, err
+		}
+		c.Text.StartResponse(id)
+		_, _, err = c.Text.ReadResponse(25)
+		c.Text.EndResponse(id)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return c.Data()
+}
+
+// send transmits msg using the envelope on c.
+func (e *Envelope) send(c *smtp.Client, msg []byte) error {
+	w, err := e.open(c)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+
+	return w.Close()
+}
+
+// sendMail mirrors smtp.SendMail, but passes the parameters of the envelope recipients
+// on to the server.
+func sendMail(adr string, auth smtp.Auth, env *Envelope, msg []byte) error {
+	if err := env.validate(); err != nil {
+		return err
+	}
+
+	c, err := smtp.Dial(adr)
+	if err != nil {
+		return err
+	}
+	defer c.Close()
+
+	if err := c.Hello("localhost"); err != nil {
+		return err
+	}
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		host, _, err := net.SplitHostPort(adr)
+		if err != nil {
+			return err
+		}
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+
+	if auth != nil {
+		if ok, _ := c.Extension("AUTH"); !ok {
+			return fmt.Errorf("smtp: server doesn't support AUTH")
+		}
+		if err := c.Auth(auth); err != nil {
+			return err
+		}
+	}
+
+	if err := env.send(c, msg); err != nil {
+		return err
+	}
+
+	return c.Quit()
+}
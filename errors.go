@@ -1,5 +1,10 @@
 package MIMEMail
 
+import (
+	"fmt"
+	"strings"
+)
+
 // NoSender is returned when trying to send a mail with no From or Sender
 // address set.
 type NoSender int
@@ -13,5 +18,115 @@ func (e NoSender) Error() string {
 type InvalidField AddressHeader
 
 func (e InvalidField) Error() string {
-	return string(e) + " is not a valid field (use: From, Sender, To, Cc, Bcc, ReplyTo or FollowupTo)"
+	return string(e) + " is not a valid field (use: From, Sender, To, Cc, Bcc, ReplyTo, FollowupTo or Disposition-Notification-To)"
+}
+
+// NoRecipients is returned when trying to send a mail without any envelope
+// recipients.
+type NoRecipients int
+
+func (e NoRecipients) Error() string {
+	return "You have no recipients set on your Mail!"
+}
+
+// NotAReport is returned by the report parsers (e.g. ParseDSN) if the message is
+// not a report of the expected type.
+type NotAReport string
+
+func (e NotAReport) Error() string {
+	return "message is not a " + string(e) + " report"
+}
+
+// NoReceiptRequested is returned by NewMDN if the original message has no
+// (valid) Disposition-Notification-To field.
+type NoReceiptRequested int
+
+func (e NoReceiptRequested) Error() string {
+	return "the original message doesn't request a read receipt (no Disposition-Notification-To)"
+}
+
+// MissingKeys is returned when encrypting a mail for it's recipients, if there is
+// no PGP key for some of them. It holds the addresses of those recipients.
+type MissingKeys []string
+
+func (e MissingKeys) Error() string {
+	return "no PGP key for recipient(s): " + strings.Join(e, ", ")
+}
+
+// KeyNotFound is returned if no PGP key could be found for an address (or URL)
+// in a Web Key Directory.
+type KeyNotFound string
+
+func (e KeyNotFound) Error() string {
+	return "no PGP key found for " + string(e)
+}
+
+// InvalidKey is returned if a recipient's PGP key fails the validity checks of the KeyPolicy
+// (it has expired, been revoked or isn't bound to the recipient's address).
+type InvalidKey struct {
+	Address     string
+	Fingerprint string
+	Reason      string
+}
+
+func (e InvalidKey) Error() string {
+	return fmt.Sprintf("invalid PGP key %s for %s: %s", e.Fingerprint, e.Address, e.Reason)
+}
+
+// KeyChanged is passed to KeyPolicy.Warn (and returned if that is nil) if the key of a recipient
+// differs from the one pinned for it's address in KeyTOFU mode.
+type KeyChanged struct {
+	Address     string
+	Pinned      string
+	Fingerprint string
+}
+
+func (e KeyChanged) Error() string {
+	return fmt.Sprintf("the PGP key for %s changed from %s to %s", e.Address, e.Pinned, e.Fingerprint)
+}
+
+// UnsupportedAlgorithm is returned by GenerateKey if the requested key algorithm isn't supported.
+type UnsupportedAlgorithm string
+
+func (e UnsupportedAlgorithm) Error() string {
+	return "unsupported key algorithm: " + string(e)
+}
+
+// UnpinnedCertificate is returned when connecting to a Server with Fingerprints set, if the
+// SHA-256 fingerprint of the server's certificate (hex encoded) isn't one of them.
+type UnpinnedCertificate string
+
+func (e UnpinnedCertificate) Error() string {
+	return "the server's TLS certificate (SHA-256 " + string(e) + ") doesn't match the pinned fingerprints"
+}
+
+// StartTLSFailed is returned when connecting to a Server with TLSRequired, if the server doesn't
+// offer STARTTLS (Err is nil) or the TLS handshake fails. It is also returned if the handshake
+// fails with TLSOpportunistic, as the connection can't be used afterwards.
+type StartTLSFailed struct {
+	Host string
+	Err  error
+}
+
+func (e StartTLSFailed) Error() string {
+	if e.Err == nil {
+		return "STARTTLS is required, but not offered by " + e.Host
+	}
+	return fmt.Sprintf("STARTTLS with %s failed: %v", e.Host, e.Err)
+}
+
+// Unwrap returns the handshake error.
+func (e StartTLSFailed) Unwrap() error {
+	return e.Err
+}
+
+// MTASTSViolation is returned by MTASTS.Enforce if the MX host isn't allowed by the
+// MTA-STS policy of the recipient domain.
+type MTASTSViolation struct {
+	Domain string
+	MX     string
+}
+
+func (e MTASTSViolation) Error() string {
+	return fmt.Sprintf("MX host %s doesn't match the MTA-STS policy of %s", e.MX, e.Domain)
 }
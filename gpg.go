@@ -1,16 +1,22 @@
 package MIMEMail
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
 	"io"
 	"net/mail"
+	"strings"
+	"time"
 
 	"golang.org/x/crypto/openpgp"
 	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
 	"golang.org/x/crypto/openpgp/packet"
 )
 
 // UnpackKey parses the ASCIIArmored data read from r.
+// Only the first packet is read, use ReadKeyRing for complete keys with subkeys.
 func UnpackKey(r io.Reader) (*packet.PublicKey, error) {
 	deArmored, err := armor.Decode(r)
 	if err != nil {
@@ -48,68 +54,247 @@ func UnPackPrivateKey(r io.Reader) (*packet.PrivateKey, error) {
 	return pubKey, nil
 }
 
-// addrToPGPUserID converts the given mail.Address into a pgp.UserId.
-func addrToPGPUserID(addr mail.Address) *packet.UserId {
-	return packet.NewUserId(addr.Name, "", addr.Address)
+// ReadKeyRing reads the OpenPGP keys (public or private, with their subkeys and user IDs)
+// from r, which may be ASCII armored or binary, as exported by GnuPG, or a GnuPG keybox.
+func ReadKeyRing(r io.Reader) (openpgp.EntityList, error) {
+	br := bufio.NewReader(r)
+	if start, _ := br.Peek(len(armorStart)); string(start) == armorStart {
+		return openpgp.ReadArmoredKeyRing(br)
+	}
+	if isKeybox(br) {
+		keyring, err := readKeybox(br)
+		if err != nil {
+			return nil, err
+		}
+		return openpgp.ReadKeyRing(bytes.NewReader(keyring))
+	}
+	return openpgp.ReadKeyRing(br)
 }
 
+const armorStart = "-----BEGIN"
+
 // CreateEntity creates a reciepient entity using the given account.
+// If the account's Key holds several keys, the one with a user ID matching the account's Address is used.
+// The subkey used for encryption and the preferred algorithms are determined from the self-signatures
+// when encrypting, where the key is also checked for expiry and revocation (see KeyPolicy).
 func CreateEntity(a *Account) (*openpgp.Entity, error) {
-	key, err := a.Key.Open()
+	keys, err := a.Key.keyRing(a.Address)
 	if err != nil {
 		return nil, err
 	}
+	return selectEntity(keys, a.Address), nil
+}
 
-	pubKey, err := UnpackKey(key)
+// CreateSigningEntity creates a signing entity for the given Account
+// If the account's Key holds several keys, the one with a user ID matching the account's Address is used.
+// The private keys are decrypted using the Key's Passphrase or Pass.
+func CreateSigningEntity(a *Account) (*openpgp.Entity, error) {
+	keys, err := privateKeyRing(a)
 	if err != nil {
 		return nil, err
 	}
-
-	userID := addrToPGPUserID(mail.Address{})
-	prim := true
-
-	return &openpgp.Entity{
-		PrimaryKey: pubKey,
-		Identities: map[string]*openpgp.Identity{
-			userID.Id: &openpgp.Identity{
-				Name:   userID.Id,
-				UserId: userID,
-				SelfSignature: &packet.Signature{
-					IsPrimaryId: &prim,
-					PreferredSymmetric: []uint8{
-						uint8(packet.CipherAES128),
-						uint8(packet.CipherAES256),
-						uint8(packet.CipherCAST5),
-					},
-					PreferredHash: []uint8{8, 10},
-					//PreferredCompression: []uint8{0},
-				},
-			},
-		},
-	}, nil
+	return selectEntity(keys, a.Address), nil
 }
 
-// CreateSigningEntity creates a signing entity for the given Account
-func CreateSigningEntity(a *Account) (*openpgp.Entity, error) {
-	key, err := a.Key.Open()
+// privateKeyRing returns the private keys from the account's Key, decrypted using the Key's Passphrase or Pass.
+// The keys are copies, so the (cached) keys of the Key stay encrypted.
+func privateKeyRing(a *Account) (openpgp.EntityList, error) {
+	keys, err := a.Key.keyRing(a.Address)
 	if err != nil {
 		return nil, err
 	}
 
-	privKey, err := UnPackPrivateKey(key)
+	private := make(openpgp.EntityList, 0, len(keys))
+	for _, e := range keys {
+		if e.PrivateKey == nil {
+			return nil, fmt.Errorf("not a private key")
+		}
+		e = copyEntity(e)
+		if err := a.Key.decrypt(e); err != nil {
+			return nil, err
+		}
+		private = append(private, e)
+	}
+	return private, nil
+}
+
+// keyRing returns the keys for address from Store, or the keys read from Key or File.
+// The keys are cached, so they are only parsed once.
+func (p *PGP) keyRing(address string) (openpgp.EntityList, error) {
+	var (
+		keys openpgp.EntityList
+		err  error
+	)
+	switch {
+	case p.Store != nil && p.Fingerprint != "":
+		var e *openpgp.Entity
+		if e, err = p.Store.ByFingerprint(p.Fingerprint); e != nil {
+			keys = openpgp.EntityList{e}
+		}
+	case p.Store != nil:
+		keys, err = p.Store.ByEmail(address)
+	case p.Key != "":
+		keys, err = loadKeyString(p.Key)
+	default:
+		keys, err = loadKeyFile(p.File)
+	}
 	if err != nil {
 		return nil, err
 	}
-	if privKey.Encrypted {
-		if err := privKey.Decrypt([]byte(a.Key.Pass)); err != nil {
-			return nil, err
+	// the built-in stores return a KeyNotFound error, others may return nothing.
+	if len(keys) == 0 {
+		return nil, KeyNotFound(address)
+	}
+	return keys, nil
+}
+
+// decrypt decrypts the private keys of e, if they are encrypted.
+func (p *PGP) decrypt(e *openpgp.Entity) error {
+	if !isEncrypted(e) {
+		return nil
+	}
+
+	pass := []byte(p.Pass)
+	if p.Passphrase != nil {
+		var err error
+		if pass, err = p.Passphrase(e); err != nil {
+			return err
+		}
+	}
+	return decryptEntity(e, pass)
+}
+
+// copyEntity returns a copy of e with copies of it's private keys, so they can be decrypted
+// without changing e.
+func copyEntity(e *openpgp.Entity) *openpgp.Entity {
+	c := *e
+	if e.PrivateKey != nil {
+		pk := *e.PrivateKey
+		c.PrivateKey = &pk
+	}
+	c.Subkeys = make([]openpgp.Subkey, len(e.Subkeys))
+	for i, sub := range e.Subkeys {
+		if sub.PrivateKey != nil {
+			pk := *sub.PrivateKey
+			sub.PrivateKey = &pk
+		}
+		c.Subkeys[i] = sub
+	}
+	return &c
+}
+
+// isEncrypted reports whether any of the private keys of e is encrypted.
+func isEncrypted(e *openpgp.Entity) bool {
+	if e.PrivateKey != nil && e.PrivateKey.Encrypted {
+		return true
+	}
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			return true
+		}
+	}
+	return false
+}
+
+// selectEntity returns the entity from keys with a user ID for address,
+// or the first one if there is none.
+func selectEntity(keys openpgp.EntityList, address string) *openpgp.Entity {
+	for _, e := range keys {
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, address) {
+				return e
+			}
+		}
+	}
+	return keys[0]
+}
+
+// decryptEntity decrypts the primary and subkey private keys of e using pass.
+func decryptEntity(e *openpgp.Entity, pass []byte) error {
+	if e.PrivateKey.Encrypted {
+		if err := e.PrivateKey.Decrypt(pass); err != nil {
+			return err
+		}
+	}
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil && sub.PrivateKey.Encrypted {
+			if err := sub.PrivateKey.Decrypt(pass); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// signingKey returns the key of e to create signatures with: the first valid signing subkey
+// or the primary key, if it may be used for signing (see openpgp.Sign).
+func signingKey(e *openpgp.Entity, now time.Time) (*packet.PrivateKey, error) {
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey != nil && sub.Sig.FlagsValid && sub.Sig.FlagSign &&
+			sub.PublicKey.PubKeyAlgo.CanSign() && !sub.Sig.KeyExpired(now) {
+			return sub.PrivateKey, nil
+		}
+	}
+
+	for _, id := range e.Identities {
+		if id.SelfSignature.IsPrimaryId == nil || !*id.SelfSignature.IsPrimaryId {
+			continue
+		}
+		if id.SelfSignature.FlagsValid && !id.SelfSignature.FlagSign {
+			return nil, fmt.Errorf("key %X has no signing key", e.PrimaryKey.KeyId)
+		}
+		if id.SelfSignature.KeyExpired(now) {
+			return nil, fmt.Errorf("key %X has expired", e.PrimaryKey.KeyId)
 		}
 	}
+	return e.PrivateKey, nil
+}
 
+// detachSign writes an ASCII armored detached signature of message by signer's signing key to w.
+func detachSign(w io.Writer, signer *openpgp.Entity, message io.Reader, config *packet.Config) error {
+	key, err := signingKey(signer, config.Now())
+	if err != nil {
+		return err
+	}
+
+	sig := &packet.Signature{
+		SigType:      packet.SigTypeBinary,
+		PubKeyAlgo:   key.PubKeyAlgo,
+		Hash:         config.Hash(),
+		CreationTime: config.Now(),
+		IssuerKeyId:  &key.KeyId,
+	}
+	h := sig.Hash.New()
+	if _, err := io.Copy(h, message); err != nil {
+		return err
+	}
+	if err := sig.Sign(h, key, config); err != nil {
+		return err
+	}
+
+	arm, err := armor.Encode(w, openpgp.SignatureType, nil)
+	if err != nil {
+		return err
+	}
+	if err := sig.Serialize(arm); err != nil {
+		return err
+	}
+	return arm.Close()
+}
+
+// addrToPGPUserID converts the given mail.Address into a pgp.UserId.
+func addrToPGPUserID(addr mail.Address) *packet.UserId {
+	return packet.NewUserId(addr.Name, "", addr.Address)
+}
+
+// bareEntity creates an entity for a bare primary key, as there is no
+// self-signature the default preferences are assumed.
+func bareEntity(pubKey *packet.PublicKey, privKey *packet.PrivateKey) *openpgp.Entity {
 	userID := addrToPGPUserID(mail.Address{})
 	prim := true
+
 	return &openpgp.Entity{
-		PrimaryKey: &privKey.PublicKey,
+		PrimaryKey: pubKey,
 		PrivateKey: privKey,
 		Identities: map[string]*openpgp.Identity{
 			userID.Id: &openpgp.Identity{
@@ -127,7 +312,7 @@ func CreateSigningEntity(a *Account) (*openpgp.Entity, error) {
 				},
 			},
 		},
-	}, nil
+	}
 }
 
 // newASCIIArmorer returns an ASCII armor encoding writer for pgp messages.
@@ -138,20 +323,67 @@ func newASCIIArmorer(w io.Writer) (io.WriteCloser, error) {
 // Encrypt encrypts (and ASCII armor encodes) the data written to the returned writer
 // Remember to Close the writer when you are done.
 func Encrypt(out io.Writer, to *Account, signer *Account) (io.WriteCloser, error) {
-	enc, err := CreateEntity(to)
+	return EncryptAll(out, []*Account{to}, signer)
+}
+
+// EncryptAll works like Encrypt, but encrypts the data for all the accounts in to.
+// If signer's Key has EncryptToSelf set, it's also encrypted for signer.
+// The recipient's keys are checked according to signer's KeyPolicy.
+func EncryptAll(out io.Writer, to []*Account, signer *Account) (io.WriteCloser, error) {
+	keys, err := encryptionKeys(to, signer)
 	if err != nil {
 		return nil, err
 	}
+	return keys.encrypt(out, true)
+}
 
-	var (
-		sign   *openpgp.Entity
-		config *packet.Config
-	)
+// pgpKeys holds the entities used for encrypting (and signing) a message.
+type pgpKeys struct {
+	recipients []*openpgp.Entity
+	signer     *openpgp.Entity
+	config     *packet.Config
+}
+
+// encryptionKeys returns the keys for encrypting to the accounts in to, signed by signer (see EncryptAll).
+func encryptionKeys(to []*Account, signer *Account) (*pgpKeys, error) {
+	var policy *KeyPolicy
 	if signer != nil {
-		if sign, err = CreateSigningEntity(signer); err != nil {
+		if signer.Key == nil {
+			return nil, fmt.Errorf("signer and it's Key field cannot be nil!")
+		}
+		policy = signer.KeyPolicy
+	}
+
+	now := time.Now()
+	keys := &pgpKeys{recipients: make([]*openpgp.Entity, 0, len(to)+1)}
+	for _, a := range to {
+		enc, err := CreateEntity(a)
+		if err != nil {
 			return nil, err
 		}
-		config = signer.Key.Config
+		if enc, err = policy.check(enc, a.Address, now); err != nil {
+			return nil, err
+		}
+		keys.recipients = append(keys.recipients, enc)
+	}
+
+	if signer != nil {
+		var err error
+		if keys.signer, err = CreateSigningEntity(signer); err != nil {
+			return nil, err
+		}
+		keys.config = signer.Key.Config
+		if signer.Key.EncryptToSelf {
+			keys.recipients = append(keys.recipients, keys.signer)
+		}
+	}
+	return keys, nil
+}
+
+// encrypt returns a writer encrypting (and ASCII armor encoding, if armored is true) the data written to it.
+func (k *pgpKeys) encrypt(out io.Writer, armored bool) (io.WriteCloser, error) {
+	if !armored {
+		return openpgp.Encrypt(out, k.recipients, k.signer, nil, k.config)
 	}
 
 	arm, err := newASCIIArmorer(out)
@@ -159,7 +391,7 @@ func Encrypt(out io.Writer, to *Account, signer *Account) (io.WriteCloser, error
 		return nil, err
 	}
 
-	plain, err := openpgp.Encrypt(arm, []*openpgp.Entity{enc}, sign, nil, config)
+	plain, err := openpgp.Encrypt(arm, k.recipients, k.signer, nil, k.config)
 	if err != nil {
 		return nil, err
 	}
@@ -193,6 +425,26 @@ func Sign(out io.Writer, signer *Account) (io.WriteCloser, error) {
 	return closeWrapper{WriteCloser: plain, close: arm}, nil
 }
 
+// ClearSign cleartext signs the text written to the returned writer ("-----BEGIN PGP SIGNED MESSAGE-----"),
+// so it stays readable without PGP support. Remember to Close the writer when you are done.
+func ClearSign(out io.Writer, signer *Account) (io.WriteCloser, error) {
+	if signer == nil || signer.Key == nil {
+		return nil, fmt.Errorf("signer and it's Key field cannot be nil!")
+	}
+
+	sign, err := CreateSigningEntity(signer)
+	if err != nil {
+		return nil, err
+	}
+	config := signer.Key.Config
+
+	key, err := signingKey(sign, config.Now())
+	if err != nil {
+		return nil, err
+	}
+	return clearsign.Encode(out, key, config)
+}
+
 // closeWrapper works arround a quirk in the openpgp implementation.
 // The implementation wraps it's writer in a NoOPCloser to guard against closing
 // before all data has been written if signer is not nil.
@@ -2,7 +2,18 @@ package MIMEMail
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"reflect"
+	"strings"
 	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
 )
 
 func TestPGPRead(t *testing.T) {
@@ -59,3 +70,270 @@ func TestPGPEncrypt(t *testing.T) {
 
 	t.Log(out.String())
 }
+
+// decryptPGPMIME decrypts the PGP/MIME encrypted msg with the armored private key priv.
+func decryptPGPMIME(t *testing.T, msg []byte, priv string) ([]byte, error) {
+	t.Helper()
+	p, err := ReadPart(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediatype, _ := p.MediaType(); mediatype != "multipart/encrypted" || len(p.Parts()) != 2 {
+		t.Fatalf("not a PGP/MIME encrypted message:\n%s", msg)
+	}
+	enc, err := p.Parts()[1].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(priv))
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	md, err := openpgp.ReadMessage(block.Body, keys, nil, nil)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(md.UnverifiedBody)
+}
+
+func TestMailEncryptToAll(t *testing.T) {
+	senderKey, _ := testPGP(t, "foobar@example.com")
+	senderKey.EncryptToSelf = true
+	sender := &Account{Address: "foobar@example.com", Key: senderKey}
+
+	aliceKey, alicePub := testPGP(t, "blabla@example.com")
+	bobKey, bobPub := testPGP(t, "xiao_mao@example.com")
+	keys := []*Account{
+		{Address: "BlaBla@example.com", Key: &PGP{Key: alicePub}},
+		{Address: "xiao_mao@example.com", Key: &PGP{Key: bobPub}},
+	}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello all"))
+	enc, err := m.EncryptToAll(keys, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, priv := range []string{aliceKey.Key, bobKey.Key, senderKey.Key} {
+		plain, err := decryptPGPMIME(t, enc, priv)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(plain, []byte("hello all")) {
+			t.Errorf("unexpected content: %s", plain)
+		}
+	}
+
+	senderKey.EncryptToSelf = false
+	if enc, err = m.EncryptToAll(keys, sender); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := decryptPGPMIME(t, enc, senderKey.Key); err == nil {
+		t.Error("encrypted to self without EncryptToSelf")
+	}
+	if _, err := m.EncryptToAll(keys, &Account{Address: "foobar@example.com"}); err == nil {
+		t.Error("expected an error for a signer without Key")
+	}
+
+	m.Cc("", "carol@example.com")
+	m.Bcc("", "dave@example.com")
+	_, err = m.EncryptToAll(keys, sender)
+	missing, ok := err.(MissingKeys)
+	if !ok || !reflect.DeepEqual(missing, MissingKeys{"carol@example.com", "dave@example.com"}) {
+		t.Errorf("expected MissingKeys for carol and dave, got %v", err)
+	}
+}
+
+func TestClientSendEncryptedToAll(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	acc := srv.account()
+	acc.Key, _ = testPGP(t, acc.Address)
+	priv, pub := testPGP(t, "receiver@example.com")
+
+	m := NewMail()
+	m.From("", acc.Address)
+	m.To("", "receiver@example.com")
+	m.PlainTextBody().Write([]byte("secret"))
+
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendEncryptedToAll(m, []*Account{{Address: "receiver@example.com", Key: &PGP{Key: pub}}}); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 || !reflect.DeepEqual(txs[0].rcpt, []string{"<receiver@example.com>"}) {
+		t.Fatalf("unexpected transactions: %+v", txs)
+	}
+	plain, err := decryptPGPMIME(t, toCRLF([]byte(txs[0].data)), priv.Key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(plain, []byte("secret")) {
+		t.Errorf("unexpected content: %s", plain)
+	}
+}
+
+// addTestSubkey adds a new RSA subkey to e, created at created and valid for lifetime
+// (if not 0), for signing or encryption.
+func addTestSubkey(t *testing.T, e *openpgp.Entity, created time.Time, lifetime time.Duration, sign bool) *openpgp.Subkey {
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sub := openpgp.Subkey{
+		PublicKey:  packet.NewRSAPublicKey(created, &rsaKey.PublicKey),
+		PrivateKey: packet.NewRSAPrivateKey(created, rsaKey),
+		Sig: &packet.Signature{
+			CreationTime:              created,
+			SigType:                   packet.SigTypeSubkeyBinding,
+			PubKeyAlgo:                packet.PubKeyAlgoRSA,
+			Hash:                      crypto.SHA256,
+			FlagsValid:                true,
+			FlagSign:                  sign,
+			FlagEncryptCommunications: !sign,
+			FlagEncryptStorage:        !sign,
+			IssuerKeyId:               &e.PrimaryKey.KeyId,
+		},
+	}
+	sub.PublicKey.IsSubkey = true
+	sub.PrivateKey.IsSubkey = true
+	if lifetime != 0 {
+		secs := uint32(lifetime.Seconds())
+		sub.Sig.KeyLifetimeSecs = &secs
+	}
+	if err := sub.Sig.SignKey(sub.PublicKey, e.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	e.Subkeys = append(e.Subkeys, sub)
+	return &e.Subkeys[len(e.Subkeys)-1]
+}
+
+// encryptedTo returns the key IDs the PGP/MIME encrypted msg is encrypted to.
+func encryptedTo(t *testing.T, msg []byte) []uint64 {
+	t.Helper()
+	p, err := ReadPart(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	enc, err := p.Parts()[1].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []uint64
+	packets := packet.NewReader(block.Body)
+	for {
+		p, err := packets.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		ek, ok := p.(*packet.EncryptedKey)
+		if !ok {
+			return ids
+		}
+		ids = append(ids, ek.KeyId)
+	}
+}
+
+func TestCreateEntityKeyRing(t *testing.T) {
+	e := testPGPEntity(t, "receiver@example.com")
+	_, otherPub := testPGP(t, "other@example.com")
+	_, pub := armorEntity(t, e)
+	var ring bytes.Buffer
+	for _, key := range []string{otherPub, pub} {
+		block, err := armor.Decode(strings.NewReader(key))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring.ReadFrom(block.Body)
+	}
+
+	// a binary keyring holding several keys, the one for the address is picked.
+	receiver := &Account{Address: "receiver@example.com", Key: &PGP{Key: ring.String()}}
+	m := MessageFactory()
+	enc, err := m.Encrypt(receiver, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ids := encryptedTo(t, enc); len(ids) != 1 || ids[0] != e.Subkeys[0].PublicKey.KeyId {
+		t.Errorf("expected encryption to the subkey %X, got %X", e.Subkeys[0].PublicKey.KeyId, ids)
+	}
+
+	// the newest valid encryption subkey is used, expired ones are ignored.
+	now := time.Now()
+	e.Subkeys = nil
+	addTestSubkey(t, e, now.Add(-2*time.Hour), time.Hour, false)
+	current := addTestSubkey(t, e, now.Add(-time.Hour), 0, false)
+	addTestSubkey(t, e, now.Add(-time.Minute), time.Second, false)
+	_, pub = armorEntity(t, e)
+	receiver.Key.Key = pub
+	if enc, err = m.Encrypt(receiver, nil); err != nil {
+		t.Fatal(err)
+	}
+	if ids := encryptedTo(t, enc); len(ids) != 1 || ids[0] != current.PublicKey.KeyId {
+		t.Errorf("expected encryption to the newest subkey %X, got %X", current.PublicKey.KeyId, ids)
+	}
+
+	onlyExpired := testPGPEntity(t, "receiver@example.com")
+	onlyExpired.Subkeys = nil
+	addTestSubkey(t, onlyExpired, now.Add(-2*time.Hour), time.Hour, false)
+	_, pub = armorEntity(t, onlyExpired)
+	receiver.Key.Key = pub
+	if _, err := m.Encrypt(receiver, nil); err == nil {
+		t.Error("encrypted to an expired key")
+	}
+}
+
+func TestPGPSigningKey(t *testing.T) {
+	// signing subkeys can't be serialized without the cross signature, which the
+	// openpgp package doesn't support, so the entity is used directly.
+	e := testPGPEntity(t, "sender@example.com")
+	now := time.Now()
+	addTestSubkey(t, e, now.Add(-2*time.Hour), time.Hour, true)
+	if key, err := signingKey(e, now); err != nil || key != e.PrivateKey {
+		t.Errorf("expected the primary key without a valid signing subkey: %v", err)
+	}
+
+	sub := addTestSubkey(t, e, now.Add(-time.Minute), 0, true)
+	var sig bytes.Buffer
+	if err := detachSign(&sig, e, strings.NewReader("hello"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(openpgp.EntityList{e}, strings.NewReader("hello"), bytes.NewReader(sig.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+
+	block, err := armor.Decode(&sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pkt, err := packet.Read(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s, ok := pkt.(*packet.Signature); !ok || *s.IssuerKeyId != sub.PublicKey.KeyId {
+		t.Errorf("expected a signature by the signing subkey %X", sub.PublicKey.KeyId)
+	}
+
+	for _, id := range e.Identities {
+		id.SelfSignature.FlagSign = false
+	}
+	e.Subkeys = nil
+	if _, err := signingKey(e, now); err == nil {
+		t.Error("expected an error for a key without signing capability")
+	}
+}
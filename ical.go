@@ -0,0 +1,830 @@
+package MIMEMail
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// iTIP methods (RFC 5546)
+const (
+	MethodPublish = "PUBLISH"
+	MethodRequest = "REQUEST"
+	MethodReply   = "REPLY"
+	MethodCancel  = "CANCEL"
+)
+
+// Participation status of an Attendee (RFC 5545 3.2.12)
+const (
+	PartStatNeedsAction = "NEEDS-ACTION"
+	PartStatAccepted    = "ACCEPTED"
+	PartStatDeclined    = "DECLINED"
+	PartStatTentative   = "TENTATIVE"
+	PartStatDelegated   = "DELEGATED"
+)
+
+// Participation roles of an Attendee (RFC 5545 3.2.16)
+const (
+	RoleChair          = "CHAIR"
+	RoleRequired       = "REQ-PARTICIPANT"
+	RoleOptional       = "OPT-PARTICIPANT"
+	RoleNonParticipant = "NON-PARTICIPANT"
+)
+
+// Event status values (RFC 5545 3.8.1.11)
+const (
+	StatusTentative = "TENTATIVE"
+	StatusConfirmed = "CONFIRMED"
+	StatusCancelled = "CANCELLED"
+)
+
+const (
+	mime_calendar = "text/calendar"
+
+	icalProdID   = "-//tike//MIMEMail//EN"
+	icalUTC      = "20060102T150405Z"
+	icalLocal    = "20060102T150405"
+	icalDate     = "20060102"
+	icalMaxOctet = 75
+)
+
+// Calendar is an iCalendar object (RFC 5545) as used for scheduling (iTIP, RFC 5546).
+type Calendar struct {
+	// Method is the iTIP method, one of the Method... constants.
+	Method string
+
+	// ProdID identifies the product that created the calendar, defaults to MIMEMail.
+	ProdID string
+
+	// Events holds the VEVENT components of the calendar.
+	Events []*Event
+}
+
+// Event is a VEVENT component.
+type Event struct {
+	// UID uniquely identifies the event, replies and cancellations refer to it.
+	UID string
+
+	// Sequence is the revision of the event, increment it when rescheduling.
+	Sequence int
+
+	// Stamp is the creation time of the iCalendar object (DTSTAMP), defaults to now.
+	Stamp time.Time
+
+	// Start and End of the event. Times are written in their time zone (with a
+	// VTIMEZONE definition) unless they are in UTC or time.Local, which are written in UTC.
+	Start, End time.Time
+
+	// AllDay events are written as dates, ignoring the time of Start and End.
+	AllDay bool
+
+	Summary     string
+	Description string
+	Location    string
+
+	// Status is one of the Status... constants.
+	Status string
+
+	// RRule is the recurrence rule, e.g. "FREQ=WEEKLY;BYDAY=MO;COUNT=10".
+	RRule string
+
+	// Organizer of the event, replies are sent there.
+	Organizer Attendee
+
+	// Attendees of the event.
+	Attendees []Attendee
+}
+
+// Attendee is an organizer or attendee of an Event.
+type Attendee struct {
+	Name    string
+	Address string
+
+	// Role is one of the Role... constants.
+	Role string
+
+	// PartStat is one of the PartStat... constants.
+	PartStat string
+
+	// RSVP requests a reply from the attendee.
+	RSVP bool
+}
+
+// NewCalendar creates a new calendar with the given iTIP method and events.
+func NewCalendar(method string, events ...*Event) *Calendar {
+	return &Calendar{Method: method, ProdID: icalProdID, Events: events}
+}
+
+// Cancel returns a CANCEL calendar for the event, with the sequence incremented
+// and the status set to cancelled. Send it to the attendees to cancel the event.
+func (e *Event) Cancel() *Calendar {
+	cancelled := *e
+	cancelled.Sequence++
+	cancelled.Status = StatusCancelled
+	cancelled.Stamp = time.Time{}
+	return NewCalendar(MethodCancel, &cancelled)
+}
+
+// Bytes returns the calendar in iCalendar format.
+func (c *Calendar) Bytes() []byte {
+	var b bytes.Buffer
+	c.write(&b)
+	return b.Bytes()
+}
+
+func (c *Calendar) write(w *bytes.Buffer) {
+	prodID := c.ProdID
+	if prodID == "" {
+		prodID = icalProdID
+	}
+
+	icalLine(w, "BEGIN:VCALENDAR")
+	icalLine(w, "PRODID:"+prodID)
+	icalLine(w, "VERSION:2.0")
+	icalLine(w, "CALSCALE:GREGORIAN")
+	if c.Method != "" {
+		icalLine(w, "METHOD:"+c.Method)
+	}
+
+	for _, tz := range c.timezones() {
+		writeTimezone(w, tz.loc, tz.from, tz.to)
+	}
+
+	for _, e := range c.Events {
+		e.write(w)
+	}
+
+	icalLine(w, "END:VCALENDAR")
+}
+
+func (e *Event) write(w *bytes.Buffer) {
+	stamp := e.Stamp
+	if stamp.IsZero() {
+		stamp = time.Now()
+	}
+
+	icalLine(w, "BEGIN:VEVENT")
+	icalLine(w, "UID:"+icalText(e.UID))
+	icalLine(w, "SEQUENCE:"+strconv.Itoa(e.Sequence))
+	icalLine(w, "DTSTAMP:"+stamp.UTC().Format(icalUTC))
+	if e.AllDay {
+		icalLine(w, "DTSTART;VALUE=DATE:"+e.Start.Format(icalDate))
+		end := e.End
+		if !end.After(e.Start) {
+			end = e.Start.AddDate(0, 0, 1)
+		}
+		icalLine(w, "DTEND;VALUE=DATE:"+end.Format(icalDate))
+	} else {
+		icalLine(w, "DTSTART"+icalTime(e.Start))
+		if !e.End.IsZero() {
+			icalLine(w, "DTEND"+icalTime(e.End))
+		}
+	}
+	if e.RRule != "" {
+		icalLine(w, "RRULE:"+e.RRule)
+	}
+	if e.Summary != "" {
+		icalLine(w, "SUMMARY:"+icalText(e.Summary))
+	}
+	if e.Description != "" {
+		icalLine(w, "DESCRIPTION:"+icalText(e.Description))
+	}
+	if e.Location != "" {
+		icalLine(w, "LOCATION:"+icalText(e.Location))
+	}
+	if e.Status != "" {
+		icalLine(w, "STATUS:"+e.Status)
+	}
+	if e.Organizer.Address != "" {
+		icalLine(w, "ORGANIZER"+e.Organizer.params(false)+":mailto:"+e.Organizer.Address)
+	}
+	for _, a := range e.Attendees {
+		icalLine(w, "ATTENDEE"+a.params(true)+":mailto:"+a.Address)
+	}
+	icalLine(w, "END:VEVENT")
+}
+
+func (a Attendee) params(attendee bool) string {
+	var p strings.Builder
+	if a.Name != "" {
+		p.WriteString(";CN=" + icalParam(a.Name))
+	}
+	if !attendee {
+		return p.String()
+	}
+
+	role := a.Role
+	if role == "" {
+		role = RoleRequired
+	}
+	partstat := a.PartStat
+	if partstat == "" {
+		partstat = PartStatNeedsAction
+	}
+	p.WriteString(";ROLE=" + role + ";PARTSTAT=" + partstat)
+	if a.RSVP {
+		p.WriteString(";RSVP=TRUE")
+	}
+	return p.String()
+}
+
+// icalLine writes line folded to 75 octets (RFC 5545 3.1).
+func icalLine(w *bytes.Buffer, line string) {
+	limit := icalMaxOctet
+	for len(line) > limit {
+		i := limit
+		for i > 0 && !utf8.RuneStart(line[i]) {
+			i--
+		}
+		w.WriteString(line[:i] + "\r\n ")
+		line = line[i:]
+		// the leading space of continuation lines counts towards the limit.
+		limit = icalMaxOctet - 1
+	}
+	w.WriteString(line + "\r\n")
+}
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icalText escapes a TEXT value.
+func icalText(s string) string {
+	return icalEscaper.Replace(s)
+}
+
+// icalParam quotes a parameter value if necessary.
+func icalParam(s string) string {
+	s = strings.NewReplacer(`"`, "'", "\r", "", "\n", " ").Replace(s)
+	if strings.ContainsAny(s, ":;,") {
+		return `"` + s + `"`
+	}
+	return s
+}
+
+// icalTime formats t as ";TZID=...:local time" or ":UTC time".
+func icalTime(t time.Time) string {
+	if tzid(t.Location()) == "" {
+		return ":" + t.UTC().Format(icalUTC)
+	}
+	return ";TZID=" + icalParam(tzid(t.Location())) + ":" + t.Format(icalLocal)
+}
+
+// tzid returns the TZID for loc, or "" if times in loc are written in UTC.
+func tzid(loc *time.Location) string {
+	if loc == nil || loc == time.UTC || loc == time.Local {
+		return ""
+	}
+	switch name := loc.String(); name {
+	case "", "UTC", "Local":
+		return ""
+	default:
+		return name
+	}
+}
+
+type icalZone struct {
+	loc      *time.Location
+	from, to time.Time
+}
+
+// timezones returns the time zones used by the events and the time span they're needed for.
+func (c *Calendar) timezones() []icalZone {
+	zones := make(map[string]*icalZone)
+	for _, e := range c.Events {
+		if e.AllDay {
+			continue
+		}
+		for _, t := range []time.Time{e.Start, e.End} {
+			id := tzid(t.Location())
+			if t.IsZero() || id == "" {
+				continue
+			}
+			z, ok := zones[id]
+			if !ok {
+				z = &icalZone{loc: t.Location(), from: t, to: t}
+				zones[id] = z
+			}
+			if t.Before(z.from) {
+				z.from = t
+			}
+			if t.After(z.to) {
+				z.to = t
+			}
+			if e.RRule != "" && t.AddDate(1, 0, 0).After(z.to) {
+				// recurring events need the rules of the following year(s), too.
+				z.to = t.AddDate(1, 0, 0)
+			}
+		}
+	}
+
+	ids := make([]string, 0, len(zones))
+	for id := range zones {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+
+	tzs := make([]icalZone, 0, len(ids))
+	for _, id := range ids {
+		tzs = append(tzs, *zones[id])
+	}
+	return tzs
+}
+
+// writeTimezone writes a VTIMEZONE component for loc, covering the times from from to to.
+// Go's time package doesn't expose the rules of a zone, so the UTC offset transitions from the
+// year before from to the year of to are searched for. Transitions recurring yearly by the same
+// rule are written as observances with a RRULE, those still in effect in the last year without
+// an end, so the zone is defined for recurring events beyond to as well.
+func writeTimezone(w *bytes.Buffer, loc *time.Location, from, to time.Time) {
+	start := time.Date(from.Year()-1, 1, 1, 0, 0, 0, 0, loc)
+	end := time.Date(to.Year()+1, 1, 1, 0, 0, 0, 0, loc)
+
+	type transition struct {
+		at         time.Time
+		offsetFrom int
+		offsetTo   int
+		name       string
+	}
+	var transitions []transition
+
+	name, offset := start.Zone()
+	minOffset := offset
+	for t := start; t.Before(end); {
+		next := t.Add(24 * time.Hour)
+		if _, o := next.Zone(); o != offset {
+			// binary search for the second of the transition.
+			lo, hi := t, next
+			for hi.Sub(lo) > time.Second {
+				mid := lo.Add(hi.Sub(lo) / 2)
+				if _, o := mid.Zone(); o == offset {
+					lo = mid
+				} else {
+					hi = mid
+				}
+			}
+			n, o := hi.Zone()
+			transitions = append(transitions, transition{at: hi, offsetFrom: offset, offsetTo: o, name: n})
+			name, offset = n, o
+			if o < minOffset {
+				minOffset = o
+			}
+		}
+		t = next
+	}
+
+	// group the transitions into observances recurring yearly.
+	var observances []*icalObservance
+	for _, tr := range transitions {
+		kind := "STANDARD"
+		if tr.offsetTo > minOffset {
+			kind = "DAYLIGHT"
+		}
+		// DTSTART of an observance is given in the local time before the transition.
+		local := tr.at.UTC().Add(time.Duration(tr.offsetFrom) * time.Second)
+		rules := yearlyRules(local)
+
+		var obs *icalObservance
+		for _, o := range observances {
+			if o.kind == kind && o.offsetFrom == tr.offsetFrom && o.offsetTo == tr.offsetTo && o.name == tr.name &&
+				o.last.Year() == local.Year()-1 && o.last.Format("150405") == local.Format("150405") {
+				if matching := intersect(o.rules, rules); len(matching) != 0 {
+					obs = o
+					obs.rules = matching
+					break
+				}
+			}
+		}
+		if obs == nil {
+			obs = &icalObservance{kind: kind, offsetFrom: tr.offsetFrom, offsetTo: tr.offsetTo, name: tr.name, start: local, rules: rules}
+			observances = append(observances, obs)
+		}
+		obs.last, obs.until = local, tr.at.UTC()
+	}
+
+	icalLine(w, "BEGIN:VTIMEZONE")
+	icalLine(w, "TZID:"+tzid(loc))
+
+	if len(observances) == 0 {
+		icalLine(w, "BEGIN:STANDARD")
+		icalLine(w, "DTSTART:19700101T000000")
+		icalLine(w, "TZOFFSETFROM:"+icalOffset(offset))
+		icalLine(w, "TZOFFSETTO:"+icalOffset(offset))
+		icalLine(w, "TZNAME:"+icalText(name))
+		icalLine(w, "END:STANDARD")
+	}
+
+	for _, o := range observances {
+		icalLine(w, "BEGIN:"+o.kind)
+		icalLine(w, "DTSTART:"+o.start.Format(icalLocal))
+		switch {
+		case o.last.Year() == to.Year():
+			// still in effect, assume the rule doesn't change.
+			icalLine(w, "RRULE:FREQ=YEARLY;"+o.rules[0])
+		case !o.last.Equal(o.start):
+			icalLine(w, "RRULE:FREQ=YEARLY;"+o.rules[0]+";UNTIL="+o.until.Format(icalUTC))
+		}
+		icalLine(w, "TZOFFSETFROM:"+icalOffset(o.offsetFrom))
+		icalLine(w, "TZOFFSETTO:"+icalOffset(o.offsetTo))
+		icalLine(w, "TZNAME:"+icalText(o.name))
+		icalLine(w, "END:"+o.kind)
+	}
+
+	icalLine(w, "END:VTIMEZONE")
+}
+
+// icalObservance is a STANDARD or DAYLIGHT observance of a VTIMEZONE, a transition
+// recurring yearly from start to last (in local time before the transition).
+type icalObservance struct {
+	kind                 string
+	offsetFrom, offsetTo int
+	name                 string
+	start, last          time.Time
+	until                time.Time // last in UTC
+
+	// rules holds the RRULE parts matching all occurrences, the preferred one first.
+	rules []string
+}
+
+// yearlyRules returns the RRULE parts of yearly recurrences that include local:
+// the last or nth weekday of the month, or the day of the month.
+func yearlyRules(local time.Time) []string {
+	month := fmt.Sprintf("BYMONTH=%d;", local.Month())
+	day := strings.ToUpper(local.Weekday().String()[:2])
+
+	var rules []string
+	if local.AddDate(0, 0, 7).Month() != local.Month() {
+		rules = append(rules, month+"BYDAY=-1"+day)
+	}
+	rules = append(rules, fmt.Sprintf("%sBYDAY=%d%s", month, (local.Day()-1)/7+1, day))
+	return append(rules, fmt.Sprintf("%sBYMONTHDAY=%d", month, local.Day()))
+}
+
+// intersect returns the elements of a that are in b as well.
+func intersect(a, b []string) []string {
+	var both []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				both = append(both, x)
+				break
+			}
+		}
+	}
+	return both
+}
+
+// icalOffset formats a UTC offset in seconds as +hhmm.
+func icalOffset(offset int) string {
+	sign := "+"
+	if offset < 0 {
+		sign = "-"
+		offset = -offset
+	}
+	return fmt.Sprintf("%s%02d%02d", sign, offset/3600, offset%3600/60)
+}
+
+// AddCalendar adds cal as text/calendar part to the mail, as required for
+// invitations (iMIP, RFC 6047): the calendar and the body parts (PlainTextBody,
+// HTMLBody) added so far are combined into a multipart/alternative part, so
+// clients can offer to accept or decline the invitation. Add the body parts
+// before calling AddCalendar. If the mail has no body yet, a plain text
+// description of the events is added.
+func (m *Mail) AddCalendar(cal *Calendar) error {
+	if cal.Method == "" {
+		return fmt.Errorf("calendar without method")
+	}
+
+	calPart := NewMIMEPart()
+	calPart.Set(content_type, fmt.Sprintf("%s; charset=%s; method=%s", mime_calendar, mime_utf8, cal.Method))
+	calPart.Write(cal.Bytes())
+
+	var (
+		plain, html []*MIMEPart
+		rest        = make([]*MIMEPart, 0, len(m.parts))
+		at          = -1
+	)
+	for _, p := range m.parts {
+		mt, _ := p.MediaType()
+		if p.Get(content_disposition) == "" && (mt == mime_text || mt == mime_html) {
+			if at < 0 {
+				at = len(rest)
+			}
+			if mt == mime_text {
+				plain = append(plain, p)
+			} else {
+				html = append(html, p)
+			}
+			continue
+		}
+		rest = append(rest, p)
+	}
+
+	if len(plain)+len(html) == 0 {
+		text := NewPlainText()
+		for _, e := range cal.Events {
+			text.WriteString(e.describe())
+		}
+		plain = append(plain, text)
+		at = 0
+	}
+
+	// the preferred alternative comes last.
+	alternatives := append(append(plain, html...), calPart)
+	alt := NewMultipart("alternative", alternatives...)
+
+	m.parts = append(rest[:at], append([]*MIMEPart{alt}, rest[at:]...)...)
+	return nil
+}
+
+// describe returns a plain text description of the event.
+func (e *Event) describe() string {
+	var b strings.Builder
+	if e.Status == StatusCancelled {
+		b.WriteString("Cancelled: ")
+	}
+	b.WriteString(e.Summary + "\r\n")
+	if e.AllDay {
+		fmt.Fprintf(&b, "When: %s\r\n", e.Start.Format("Mon, 02 Jan 2006"))
+	} else {
+		fmt.Fprintf(&b, "When: %s\r\n", e.Start.Format("Mon, 02 Jan 2006 15:04 MST"))
+	}
+	if e.Location != "" {
+		fmt.Fprintf(&b, "Where: %s\r\n", e.Location)
+	}
+	if e.Description != "" {
+		fmt.Fprintf(&b, "\r\n%s\r\n", e.Description)
+	}
+	return b.String()
+}
+
+// ParseCalendar parses the iCalendar object read from r.
+func ParseCalendar(r io.Reader) (*Calendar, error) {
+	lines, err := icalUnfold(r)
+	if err != nil {
+		return nil, err
+	}
+
+	var (
+		cal   *Calendar
+		event *Event
+		stack []string
+	)
+	for _, line := range lines {
+		prop, err := parseICalProperty(line)
+		if err != nil {
+			return nil, err
+		}
+
+		switch prop.name {
+		case "BEGIN":
+			comp := strings.ToUpper(prop.value)
+			stack = append(stack, comp)
+			switch comp {
+			case "VCALENDAR":
+				if cal == nil {
+					cal = &Calendar{}
+				}
+			case "VEVENT":
+				event = &Event{}
+			}
+			continue
+		case "END":
+			if len(stack) == 0 || stack[len(stack)-1] != strings.ToUpper(prop.value) {
+				return nil, fmt.Errorf("ical: unexpected END:%s", prop.value)
+			}
+			stack = stack[:len(stack)-1]
+			if strings.ToUpper(prop.value) == "VEVENT" && cal != nil {
+				cal.Events = append(cal.Events, event)
+				event = nil
+			}
+			continue
+		}
+
+		if cal == nil || len(stack) == 0 {
+			return nil, fmt.Errorf("ical: property %s outside of VCALENDAR", prop.name)
+		}
+
+		switch stack[len(stack)-1] {
+		case "VCALENDAR":
+			switch prop.name {
+			case "METHOD":
+				cal.Method = strings.ToUpper(prop.value)
+			case "PRODID":
+				cal.ProdID = prop.value
+			}
+		case "VEVENT":
+			if err := event.set(prop); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	if cal == nil || len(stack) != 0 {
+		return nil, fmt.Errorf("ical: incomplete VCALENDAR")
+	}
+	return cal, nil
+}
+
+// ParseCalendarMail parses the first text/calendar part of the raw message read
+// from r, e.g. to process the REPLY of an attendee.
+func ParseCalendarMail(r io.Reader) (*Calendar, error) {
+	msg, err := ReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+
+	part := msg.find(mime_calendar, "application/ics")
+	if part == nil {
+		return nil, fmt.Errorf("message has no %s part", mime_calendar)
+	}
+
+	content, err := part.Content()
+	if err != nil {
+		return nil, err
+	}
+
+	cal, err := ParseCalendar(bytes.NewReader(content))
+	if err != nil {
+		return nil, err
+	}
+	if _, params := part.MediaType(); cal.Method == "" {
+		cal.Method = strings.ToUpper(params["method"])
+	}
+	return cal, nil
+}
+
+// Attendee returns the attendee of the event with the given address, e.g. to
+// obtain the participation status from a REPLY.
+func (e *Event) Attendee(address string) (Attendee, bool) {
+	for _, a := range e.Attendees {
+		if strings.EqualFold(a.Address, address) {
+			return a, true
+		}
+	}
+	return Attendee{}, false
+}
+
+func (e *Event) set(prop icalProperty) error {
+	var err error
+	switch prop.name {
+	case "UID":
+		e.UID = icalUnescape(prop.value)
+	case "SEQUENCE":
+		e.Sequence, err = strconv.Atoi(prop.value)
+	case "DTSTAMP":
+		e.Stamp, err = prop.time()
+	case "DTSTART":
+		e.Start, err = prop.time()
+		e.AllDay = strings.EqualFold(prop.params["VALUE"], "DATE")
+	case "DTEND":
+		e.End, err = prop.time()
+	case "SUMMARY":
+		e.Summary = icalUnescape(prop.value)
+	case "DESCRIPTION":
+		e.Description = icalUnescape(prop.value)
+	case "LOCATION":
+		e.Location = icalUnescape(prop.value)
+	case "STATUS":
+		e.Status = strings.ToUpper(prop.value)
+	case "RRULE":
+		e.RRule = prop.value
+	case "ORGANIZER":
+		e.Organizer = prop.attendee()
+	case "ATTENDEE":
+		e.Attendees = append(e.Attendees, prop.attendee())
+	}
+	if err != nil {
+		return fmt.Errorf("ical: %s: %s", prop.name, err)
+	}
+	return nil
+}
+
+type icalProperty struct {
+	name   string
+	params map[string]string
+	value  string
+}
+
+func (p icalProperty) time() (time.Time, error) {
+	if strings.EqualFold(p.params["VALUE"], "DATE") {
+		return time.ParseInLocation(icalDate, p.value, time.UTC)
+	}
+	if strings.HasSuffix(p.value, "Z") {
+		return time.Parse(icalUTC, p.value)
+	}
+
+	loc := time.UTC
+	if id := p.params["TZID"]; id != "" {
+		if l, err := time.LoadLocation(id); err == nil {
+			loc = l
+		}
+	}
+	return time.ParseInLocation(icalLocal, p.value, loc)
+}
+
+func (p icalProperty) attendee() Attendee {
+	addr := p.value
+	if len(addr) > len("mailto:") && strings.EqualFold(addr[:len("mailto:")], "mailto:") {
+		addr = addr[len("mailto:"):]
+	}
+	return Attendee{
+		Name:     p.params["CN"],
+		Address:  addr,
+		Role:     strings.ToUpper(p.params["ROLE"]),
+		PartStat: strings.ToUpper(p.params["PARTSTAT"]),
+		RSVP:     strings.EqualFold(p.params["RSVP"], "TRUE"),
+	}
+}
+
+// icalUnfold reads the content lines from r, joining folded lines.
+func icalUnfold(r io.Reader) ([]string, error) {
+	var lines []string
+	sc := bufio.NewScanner(r)
+	sc.Buffer(make([]byte, 0, 4096), 1<<20)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if line == "" {
+			continue
+		}
+		if (line[0] == ' ' || line[0] == '\t') && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, sc.Err()
+}
+
+// parseICalProperty parses a content line "NAME;PARAM=value;PARAM="quoted":value".
+func parseICalProperty(line string) (icalProperty, error) {
+	prop := icalProperty{params: make(map[string]string)}
+
+	i := strings.IndexAny(line, ";:")
+	if i <= 0 {
+		return prop, fmt.Errorf("ical: invalid content line %q", line)
+	}
+	prop.name = strings.ToUpper(line[:i])
+	line = line[i:]
+
+	for len(line) > 0 && line[0] == ';' {
+		line = line[1:]
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return prop, fmt.Errorf("ical: invalid parameter in %s", prop.name)
+		}
+		key := strings.ToUpper(line[:eq])
+		line = line[eq+1:]
+
+		var value string
+		if strings.HasPrefix(line, `"`) {
+			end := strings.Index(line[1:], `"`)
+			if end < 0 {
+				return prop, fmt.Errorf("ical: unterminated quoted parameter in %s", prop.name)
+			}
+			value = line[1 : end+1]
+			line = line[end+2:]
+		} else {
+			end := strings.IndexAny(line, ";:")
+			if end < 0 {
+				return prop, fmt.Errorf("ical: invalid content line for %s", prop.name)
+			}
+			value = line[:end]
+			line = line[end:]
+		}
+		// multiple values are separated by commas, they are kept as they are.
+		prop.params[key] = value
+	}
+
+	if !strings.HasPrefix(line, ":") {
+		return prop, fmt.Errorf("ical: invalid content line for %s", prop.name)
+	}
+	prop.value = line[1:]
+	return prop, nil
+}
+
+// icalUnescape reverses icalText.
+func icalUnescape(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] == '\\' && i+1 < len(s) {
+			i++
+			switch s[i] {
+			case 'n', 'N':
+				b.WriteString("\n")
+			default:
+				b.WriteByte(s[i])
+			}
+			continue
+		}
+		b.WriteByte(s[i])
+	}
+	return b.String()
+}
@@ -0,0 +1,196 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testEvent(t *testing.T) *Event {
+	loc, err := time.LoadLocation("Europe/Berlin")
+	if err != nil {
+		t.Skip("no time zone database: ", err)
+	}
+
+	return &Event{
+		UID:         "meeting-42@example.com",
+		Start:       time.Date(2026, 10, 20, 10, 0, 0, 0, loc),
+		End:         time.Date(2026, 10, 20, 11, 0, 0, 0, loc),
+		Summary:     "Contract review; all hands, with a rather long summary that needs folding ÄÖÜ",
+		Description: "Agenda:\n1. contracts",
+		Location:    "Room 1",
+		RRule:       "FREQ=WEEKLY;COUNT=4",
+		Status:      StatusConfirmed,
+		Organizer:   Attendee{Name: "Mr. Sender", Address: "sender@example.com"},
+		Attendees: []Attendee{
+			{Name: "Receiver, Mr.", Address: "receiver@example.com", RSVP: true},
+			{Address: "optional@example.com", Role: RoleOptional},
+		},
+	}
+}
+
+func TestCalendarRoundTrip(t *testing.T) {
+	ev := testEvent(t)
+	b := NewCalendar(MethodRequest, ev).Bytes()
+
+	for _, line := range strings.Split(string(b), "\r\n") {
+		if len(line) > icalMaxOctet {
+			t.Errorf("line not folded: %q", line)
+		}
+	}
+	unfolded := []byte(strings.Replace(string(b), "\r\n ", "", -1))
+	for _, exp := range []string{
+		"METHOD:REQUEST\r\n",
+		"BEGIN:VTIMEZONE\r\nTZID:Europe/Berlin\r\n",
+		"BEGIN:STANDARD\r\nDTSTART:20251026T030000\r\nRRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU\r\nTZOFFSETFROM:+0200\r\nTZOFFSETTO:+0100\r\n",
+		"BEGIN:DAYLIGHT\r\nDTSTART:20250330T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=-1SU\r\nTZOFFSETFROM:+0100\r\nTZOFFSETTO:+0200\r\n",
+		"DTSTART;TZID=Europe/Berlin:20261020T100000\r\n",
+		"RRULE:FREQ=WEEKLY;COUNT=4\r\n",
+		"ATTENDEE;CN=\"Receiver, Mr.\";ROLE=REQ-PARTICIPANT;PARTSTAT=NEEDS-ACTION;RSVP=TRUE:mailto:receiver@example.com\r\n",
+	} {
+		if !bytes.Contains(unfolded, []byte(exp)) {
+			t.Errorf("missing %q in\n%s", exp, unfolded)
+		}
+	}
+
+	cal, err := ParseCalendar(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cal.Method != MethodRequest || len(cal.Events) != 1 {
+		t.Fatalf("unexpected calendar: %+v", cal)
+	}
+
+	got := cal.Events[0]
+	if got.UID != ev.UID || got.Summary != ev.Summary || got.Description != ev.Description || got.RRule != ev.RRule {
+		t.Errorf("expected\n%+v\ngot\n%+v", ev, got)
+	}
+	if !got.Start.Equal(ev.Start) || !got.End.Equal(ev.End) {
+		t.Errorf("expected %s - %s, got %s - %s", ev.Start, ev.End, got.Start, got.End)
+	}
+	if got.Organizer.Address != "sender@example.com" || len(got.Attendees) != 2 {
+		t.Errorf("unexpected participants: %+v %+v", got.Organizer, got.Attendees)
+	}
+	if a, ok := got.Attendee("RECEIVER@example.com"); !ok || a.Name != "Receiver, Mr." || !a.RSVP {
+		t.Errorf("unexpected attendee: %+v", a)
+	}
+}
+
+func TestWriteTimezone(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skip("no time zone database: ", err)
+	}
+
+	// the rules changed in 2007, the old ones end then.
+	var b bytes.Buffer
+	writeTimezone(&b, loc, time.Date(2006, 1, 10, 9, 0, 0, 0, loc), time.Date(2007, 1, 10, 9, 0, 0, 0, loc))
+	for _, exp := range []string{
+		"BEGIN:DAYLIGHT\r\nDTSTART:20050403T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=4;BYDAY=1SU;UNTIL=20060402T070000Z\r\n",
+		"BEGIN:STANDARD\r\nDTSTART:20051030T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=10;BYDAY=-1SU;UNTIL=20061029T060000Z\r\n",
+		"BEGIN:DAYLIGHT\r\nDTSTART:20070311T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=3;BYDAY=2SU\r\n",
+		"BEGIN:STANDARD\r\nDTSTART:20071104T020000\r\nRRULE:FREQ=YEARLY;BYMONTH=11;BYDAY=1SU\r\n",
+	} {
+		if !bytes.Contains(b.Bytes(), []byte(exp)) {
+			t.Errorf("missing %q in\n%s", exp, b.Bytes())
+		}
+	}
+}
+
+func TestCalendarCancel(t *testing.T) {
+	ev := testEvent(t)
+	ev.Sequence = 1
+
+	cal := ev.Cancel()
+	if cal.Method != MethodCancel || cal.Events[0].Sequence != 2 || cal.Events[0].Status != StatusCancelled {
+		t.Errorf("unexpected cancellation: %+v", cal.Events[0])
+	}
+	if ev.Status != StatusConfirmed || ev.Sequence != 1 {
+		t.Error("Cancel modified the original event")
+	}
+}
+
+func TestMailAddCalendar(t *testing.T) {
+	m := NewMail()
+	m.From("Mr. Sender", "sender@example.com")
+	m.To("Mr. Receiver", "receiver@example.com")
+	m.Subject = "Invitation"
+	if err := m.AddReader("agenda.txt", strings.NewReader("agenda")); err != nil {
+		t.Fatal(err)
+	}
+	body := m.PlainTextBody()
+	if err := m.AddCalendar(NewCalendar(MethodRequest, testEvent(t))); err != nil {
+		t.Fatal(err)
+	}
+	// body parts are encoded lazily, so they may be rendered after adding the calendar.
+	body.Write([]byte("You are invited"))
+
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ReadPart(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Parts()) != 2 {
+		t.Fatalf("expected attachment and alternative, got %d parts", len(msg.Parts()))
+	}
+
+	alt := msg.Parts()[1]
+	if mt, _ := alt.MediaType(); mt != "multipart/alternative" || len(alt.Parts()) != 2 {
+		t.Fatalf("expected multipart/alternative with 2 parts, got %s with %d", mt, len(alt.Parts()))
+	}
+	if alt.Parts()[0].String() != "You are invited" {
+		t.Errorf("unexpected body %q", alt.Parts()[0].String())
+	}
+	mt, params := alt.Parts()[1].MediaType()
+	if mt != mime_calendar || params["method"] != MethodRequest {
+		t.Errorf("unexpected calendar part: %s %v", mt, params)
+	}
+
+	cal, err := ParseCalendarMail(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cal.Events[0].UID != "meeting-42@example.com" {
+		t.Errorf("unexpected UID %q", cal.Events[0].UID)
+	}
+}
+
+const icalReply = "BEGIN:VCALENDAR\r\n" +
+	"PRODID:-//Google Inc//Google Calendar 70.9054//EN\r\n" +
+	"VERSION:2.0\r\n" +
+	"METHOD:REPLY\r\n" +
+	"BEGIN:VEVENT\r\n" +
+	"DTSTART:20261020T080000Z\r\n" +
+	"DTEND:20261020T090000Z\r\n" +
+	"DTSTAMP:20261019T120000Z\r\n" +
+	"ORGANIZER;CN=Mr. Sender:mailto:sender@example.com\r\n" +
+	"UID:meeting-42@example.com\r\n" +
+	"ATTENDEE;CUTYPE=INDIVIDUAL;ROLE=REQ-PARTICIPANT;PARTSTAT=DECLINED;CN=Mr. Rec\r\n" +
+	" eiver;X-NUM-GUESTS=0:mailto:receiver@example.com\r\n" +
+	"SEQUENCE:0\r\n" +
+	"SUMMARY:Declined: Contract review\r\n" +
+	"END:VEVENT\r\n" +
+	"END:VCALENDAR\r\n"
+
+func TestParseCalendarReply(t *testing.T) {
+	cal, err := ParseCalendar(strings.NewReader(icalReply))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cal.Method != MethodReply || len(cal.Events) != 1 {
+		t.Fatalf("unexpected calendar %+v", cal)
+	}
+
+	a, ok := cal.Events[0].Attendee("receiver@example.com")
+	if !ok {
+		t.Fatal("attendee missing")
+	}
+	if a.PartStat != PartStatDeclined || a.Name != "Mr. Receiver" {
+		t.Errorf("unexpected attendee %+v", a)
+	}
+}
@@ -0,0 +1,278 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha1"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"math"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+	"golang.org/x/crypto/openpgp/s2k"
+)
+
+const mime_pgpkeys = "application/pgp-keys"
+
+// KeyAlgorithm selects the public key algorithm of keys created by GenerateKey.
+type KeyAlgorithm int
+
+// Valid KeyAlgorithm values
+const (
+	// RSA3072 creates RSA keys with 3072 bits (the default).
+	RSA3072 KeyAlgorithm = iota
+
+	// RSA4096 creates RSA keys with 4096 bits.
+	RSA4096
+
+	// Ed25519 creates an Ed25519 signing key and a Curve25519 encryption subkey.
+	// It isn't supported by the openpgp package yet, so GenerateKey returns an UnsupportedAlgorithm error.
+	Ed25519
+)
+
+func (a KeyAlgorithm) String() string {
+	switch a {
+	case RSA3072:
+		return "RSA-3072"
+	case RSA4096:
+		return "RSA-4096"
+	case Ed25519:
+		return "Ed25519"
+	default:
+		return fmt.Sprintf("KeyAlgorithm(%d)", int(a))
+	}
+}
+
+// KeyOptions holds the options for GenerateKey.
+type KeyOptions struct {
+	Algorithm KeyAlgorithm
+
+	// Lifetime is the time after which the keys expire, they never expire if it is 0.
+	// It may be at most about 136 years (2^32-1 seconds).
+	Lifetime time.Duration
+
+	// Passphrase is used to encrypt the secret keys, they aren't encrypted if it is empty.
+	Passphrase string
+
+	// Config holds pgp config values (e.g. the preferred hash and cipher).
+	// If it is nil, SHA-256 and AES-256 are used.
+	*packet.Config
+}
+
+// GenerateKey creates a new key for a, with a's Name and Address as user ID, consisting of a primary
+// signing key and an encryption subkey. It returns the PGP config holding the ASCII armored secret
+// key, so it can be used as a's Key. The passphrase isn't stored with the key, set the Pass or
+// Passphrase field of the returned PGP config to use an encrypted key.
+func GenerateKey(a *Account, opts ...*KeyOptions) (*PGP, error) {
+	opt := &KeyOptions{}
+	if len(opts) != 0 && opts[0] != nil {
+		opt = opts[0]
+	}
+
+	config := &packet.Config{DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256}
+	if opt.Config != nil {
+		c := *opt.Config
+		config = &c
+	}
+	switch opt.Algorithm {
+	case RSA3072:
+		config.RSABits = 3072
+	case RSA4096:
+		config.RSABits = 4096
+	default:
+		return nil, UnsupportedAlgorithm(opt.Algorithm.String())
+	}
+
+	var lifetime *uint32
+	if opt.Lifetime > 0 {
+		if opt.Lifetime/time.Second > math.MaxUint32 {
+			return nil, fmt.Errorf("key lifetime %s exceeds the maximum of %d seconds", opt.Lifetime, uint32(math.MaxUint32))
+		}
+		secs := uint32(opt.Lifetime / time.Second)
+		lifetime = &secs
+	}
+
+	e, err := openpgp.NewEntity(a.Name, "", a.Address, config)
+	if err != nil {
+		return nil, err
+	}
+	for _, id := range e.Identities {
+		id.SelfSignature.KeyLifetimeSecs = lifetime
+		if err := id.SelfSignature.SignUserId(id.UserId.Id, e.PrimaryKey, e.PrivateKey, config); err != nil {
+			return nil, err
+		}
+	}
+	for _, sub := range e.Subkeys {
+		sub.Sig.KeyLifetimeSecs = lifetime
+		if err := sub.Sig.SignKey(sub.PublicKey, e.PrivateKey, config); err != nil {
+			return nil, err
+		}
+	}
+
+	var key bytes.Buffer
+	if err := writeSecretKey(&key, e, []byte(opt.Passphrase), config); err != nil {
+		return nil, err
+	}
+	return &PGP{Key: key.String(), Config: config}, nil
+}
+
+// ExportPublicKey writes the ASCII armored public key of a to w.
+func ExportPublicKey(w io.Writer, a *Account) error {
+	e, err := CreateEntity(a)
+	if err != nil {
+		return err
+	}
+
+	arm, err := armor.Encode(w, openpgp.PublicKeyType, nil)
+	if err != nil {
+		return err
+	}
+	if err := e.Serialize(arm); err != nil {
+		return err
+	}
+	return arm.Close()
+}
+
+// ExportSecretKey writes the ASCII armored secret key of a to w, encrypted with passphrase
+// unless it is empty. If a's key is encrypted, it's decrypted as for signing first.
+func ExportSecretKey(w io.Writer, a *Account, passphrase string) error {
+	e, err := CreateSigningEntity(a)
+	if err != nil {
+		return err
+	}
+	return writeSecretKey(w, e, []byte(passphrase), a.Key.Config)
+}
+
+// AttachPublicKey attaches the public key of a to the mail as application/pgp-keys,
+// so recipients can use it to reply encrypted.
+func (m *Mail) AttachPublicKey(a *Account) error {
+	e, err := CreateEntity(a)
+	if err != nil {
+		return err
+	}
+
+	p := NewMIMEPart()
+	name := fmt.Sprintf("OpenPGP_0x%016X.asc", e.PrimaryKey.KeyId)
+	p.Set(content_type, fmt.Sprintf("%s; name=%q", mime_pgpkeys, name))
+	p.Set("Content-Description", "OpenPGP public key")
+	p.Set(content_disposition, fmt.Sprintf("%s; filename=%q", mime_attachment, name))
+
+	var key bytes.Buffer
+	if err := ExportPublicKey(&key, a); err != nil {
+		return err
+	}
+	p.Write(toCRLF(key.Bytes()))
+
+	m.parts = append(m.parts, p)
+	return nil
+}
+
+// writeSecretKey writes the ASCII armored secret key e to w, encrypting the key packets with passphrase
+// unless it is empty. The signatures are written as they are, so they must have been signed before.
+func writeSecretKey(w io.Writer, e *openpgp.Entity, passphrase []byte, config *packet.Config) error {
+	arm, err := armor.Encode(w, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		return err
+	}
+
+	writeKey := func(pk *packet.PrivateKey) error {
+		if len(passphrase) == 0 {
+			return pk.Serialize(arm)
+		}
+		enc, err := encryptPrivateKey(pk, passphrase, config)
+		if err != nil {
+			return err
+		}
+		_, err = arm.Write(enc)
+		return err
+	}
+
+	if err := writeKey(e.PrivateKey); err != nil {
+		return err
+	}
+	for _, id := range e.Identities {
+		if err := id.UserId.Serialize(arm); err != nil {
+			return err
+		}
+		if err := id.SelfSignature.Serialize(arm); err != nil {
+			return err
+		}
+	}
+	for _, sub := range e.Subkeys {
+		if sub.PrivateKey == nil {
+			continue
+		}
+		if err := writeKey(sub.PrivateKey); err != nil {
+			return err
+		}
+		if err := sub.Sig.Serialize(arm); err != nil {
+			return err
+		}
+	}
+	return arm.Close()
+}
+
+// encryptPrivateKey returns the secret key packet of pk encrypted with passphrase, which the openpgp
+// package can't serialize. It has the standard layout read by GnuPG (RFC 4880 5.5.3): the public key,
+// s2k usage 254 (SHA-1 checksum), the cipher AES-256, an iterated and salted SHA-256 S2K specifier
+// (RFC 4880 3.7.1.3) with the maximum count, the IV, and the key material followed by it's SHA-1
+// hash, encrypted with AES-256 in CFB mode.
+func encryptPrivateKey(pk *packet.PrivateKey, passphrase []byte, config *packet.Config) ([]byte, error) {
+	var pub, priv bytes.Buffer
+	if err := pk.PublicKey.Serialize(&pub); err != nil {
+		return nil, err
+	}
+	if err := pk.Serialize(&priv); err != nil {
+		return nil, err
+	}
+	pubBody, privBody := packetBody(pub.Bytes()), packetBody(priv.Bytes())
+	// the unencrypted body is followed by the s2k usage (0), the key material and it's checksum.
+	material := privBody[len(pubBody)+1 : len(privBody)-2]
+
+	body := bytes.NewBuffer(append([]byte{}, pubBody...))
+	body.Write([]byte{254, byte(packet.CipherAES256)})
+	key := make([]byte, 32)
+	if err := s2k.Serialize(body, key, config.Random(), passphrase, &s2k.Config{Hash: crypto.SHA256, S2KCount: 65011712}); err != nil {
+		return nil, err
+	}
+	iv := make([]byte, aes.BlockSize)
+	if _, err := io.ReadFull(config.Random(), iv); err != nil {
+		return nil, err
+	}
+	body.Write(iv)
+
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	checksum := sha1.Sum(material)
+	enc := append(append([]byte{}, material...), checksum[:]...)
+	cipher.NewCFBEncrypter(block, iv).XORKeyStream(enc, enc)
+	body.Write(enc)
+
+	tag := byte(5)
+	if pk.IsSubkey {
+		tag = 7
+	}
+	header := []byte{0xc0 | tag, 0xff, 0, 0, 0, 0}
+	binary.BigEndian.PutUint32(header[2:], uint32(body.Len()))
+	return append(header, body.Bytes()...), nil
+}
+
+// packetBody returns the body of the new format packet p.
+func packetBody(p []byte) []byte {
+	switch l := p[1]; {
+	case l < 192:
+		return p[2:]
+	case l < 224:
+		return p[3:]
+	default:
+		return p[6:]
+	}
+}
@@ -0,0 +1,174 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"os/exec"
+	"strings"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+func TestGenerateKey(t *testing.T) {
+	acc := &Account{Name: "Service", Address: "service@example.com"}
+	if _, err := GenerateKey(acc, &KeyOptions{Algorithm: Ed25519}); err != UnsupportedAlgorithm("Ed25519") {
+		t.Errorf("expected UnsupportedAlgorithm, got %v", err)
+	}
+
+	if _, err := GenerateKey(acc, &KeyOptions{Lifetime: 200 * 365 * 24 * time.Hour}); err == nil {
+		t.Error("accepted a lifetime exceeding 32 bits")
+	}
+
+	key, err := GenerateKey(acc, &KeyOptions{Lifetime: 24 * time.Hour, Passphrase: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key.Pass != "" {
+		t.Error("passphrase returned with the key")
+	}
+	key.Pass = "secret"
+	acc.Key = key
+
+	keys, err := ReadKeyRing(strings.NewReader(key.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := keys[0]
+	if !e.PrivateKey.Encrypted || len(e.Subkeys) != 1 || !e.Subkeys[0].PrivateKey.Encrypted {
+		t.Error("expected encrypted secret keys")
+	}
+	if bits, _ := e.PrimaryKey.BitLength(); bits != 3072 {
+		t.Errorf("expected a 3072 bit key, got %d", bits)
+	}
+	id, ok := e.Identities["Service <service@example.com>"]
+	if !ok {
+		t.Fatalf("unexpected identities: %v", e.Identities)
+	}
+	if lifetime := id.SelfSignature.KeyLifetimeSecs; lifetime == nil || *lifetime != 86400 {
+		t.Errorf("unexpected key lifetime: %v", lifetime)
+	}
+	if lifetime := e.Subkeys[0].Sig.KeyLifetimeSecs; lifetime == nil || *lifetime != 86400 {
+		t.Errorf("unexpected subkey lifetime: %v", lifetime)
+	}
+
+	var pub bytes.Buffer
+	if err := ExportPublicKey(&pub, acc); err != nil {
+		t.Fatal(err)
+	}
+	armored := pub.String()
+	if strings.Contains(armored, "PRIVATE") {
+		t.Fatalf("public key export contains the secret key:\n%s", armored)
+	}
+	pubKeys, err := ReadKeyRing(&pub)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello"))
+	enc, err := m.Encrypt(&Account{Address: acc.Address, Key: &PGP{Key: armored}}, acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadPGP(bytes.NewReader(enc), acc, pubKeys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Signature == nil || msg.Signature.Err != nil {
+		t.Errorf("expected a valid signature: %+v", msg.Signature)
+	}
+
+	var secret bytes.Buffer
+	if err := ExportSecretKey(&secret, acc, ""); err != nil {
+		t.Fatal(err)
+	}
+	if keys, err = ReadKeyRing(&secret); err != nil {
+		t.Fatal(err)
+	}
+	if keys[0].PrivateKey == nil || keys[0].PrivateKey.Encrypted || keys[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+		t.Error("expected the unencrypted secret key")
+	}
+}
+
+// TestGenerateKeyGnuPG checks that GnuPG can use the encrypted secret keys written by GenerateKey.
+func TestGenerateKeyGnuPG(t *testing.T) {
+	gpg, err := exec.LookPath("gpg")
+	if err != nil {
+		t.Skip("gpg not found")
+	}
+	home := tempDir(t)
+	defer exec.Command("gpgconf", "--homedir", home, "--kill", "gpg-agent").Run()
+	run := func(stdin []byte, args ...string) []byte {
+		t.Helper()
+		cmd := exec.Command(gpg, append([]string{"--homedir", home, "--batch", "--pinentry-mode", "loopback", "--passphrase", "secret"}, args...)...)
+		cmd.Stdin = bytes.NewReader(stdin)
+		var stderr bytes.Buffer
+		cmd.Stderr = &stderr
+		out, err := cmd.Output()
+		if err != nil {
+			t.Fatalf("gpg %s: %v\n%s", strings.Join(args, " "), err, stderr.Bytes())
+		}
+		return out
+	}
+
+	key, err := GenerateKey(&Account{Name: "Service", Address: "service@example.com"}, &KeyOptions{Passphrase: "secret"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ReadKeyRing(strings.NewReader(key.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	run([]byte(key.Key), "--import")
+
+	// the primary key signs.
+	sig := run([]byte("hello"), "--local-user", "service@example.com", "--detach-sign")
+	if _, err := openpgp.CheckDetachedSignature(keys, strings.NewReader("hello"), bytes.NewReader(sig)); err != nil {
+		t.Errorf("invalid signature by gpg: %v", err)
+	}
+
+	// the subkey decrypts.
+	var enc bytes.Buffer
+	plain, err := openpgp.Encrypt(&enc, keys, nil, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain.Write([]byte("hello"))
+	plain.Close()
+	if dec := run(enc.Bytes(), "--decrypt"); string(dec) != "hello" {
+		t.Errorf("gpg decrypted %q", dec)
+	}
+}
+
+func TestAttachPublicKey(t *testing.T) {
+	key, _ := testPGP(t, "foobar@example.com")
+	acc := &Account{Address: "foobar@example.com", Key: key}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello"))
+	if err := m.AttachPublicKey(acc); err != nil {
+		t.Fatal(err)
+	}
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadPart(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyPart := p.find(mime_pgpkeys)
+	if keyPart == nil {
+		t.Fatalf("no %s part:\n%s", mime_pgpkeys, b)
+	}
+	keys, err := ReadKeyRing(bytes.NewReader(keyPart.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, _ := CreateEntity(acc)
+	if len(keys) != 1 || keys[0].PrimaryKey.KeyId != e.PrimaryKey.KeyId || keys[0].PrivateKey != nil {
+		t.Errorf("unexpected keys attached: %v", keys)
+	}
+}
@@ -0,0 +1,231 @@
+package MIMEMail
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// KeyPolicyMode selects how KeyPolicy handles recipient keys.
+type KeyPolicyMode int
+
+// Valid KeyPolicyMode values
+const (
+	// KeyReject rejects invalid keys (the default).
+	KeyReject KeyPolicyMode = iota
+
+	// KeyWarn passes invalid keys to KeyPolicy.Warn, which decides whether they are used.
+	KeyWarn
+
+	// KeyTOFU rejects invalid keys and pins the fingerprint of the first key used for
+	// every address (trust on first use). If the key changes, KeyPolicy.Warn decides
+	// whether the new key is used (and pinned).
+	KeyTOFU
+)
+
+// KeyPolicy decides whether recipient keys are used for encrypting mail signed by an Account.
+// All keys are checked for expiry, revocation and a user ID binding them to the recipient's
+// address, the Mode selects what happens with keys failing the checks. Bare key packets
+// (see UnpackKey) have no user ID, they are only checked for being able to encrypt.
+type KeyPolicy struct {
+	Mode KeyPolicyMode
+
+	// Warn is called with an InvalidKey (KeyWarn mode) or KeyChanged (KeyTOFU mode) error.
+	// If it returns nil, the key is used anyway, else encrypting fails with the returned error.
+	// If it is nil, such keys are rejected.
+	Warn func(err error) error
+
+	// Pins holds the pinned fingerprints in KeyTOFU mode, it must not be nil in that mode.
+	Pins PinStore
+}
+
+// PinStore stores the fingerprints of the keys pinned for addresses (see KeyTOFU).
+// MemoryPinStore implements it, provide your own implementation for persistent storage.
+type PinStore interface {
+	// Pin returns the (hex encoded) fingerprint pinned for address, "" if there is none.
+	Pin(address string) (string, error)
+
+	// SetPin pins fingerprint for address.
+	SetPin(address, fingerprint string) error
+}
+
+// MemoryPinStore is a PinStore which keeps the pins in memory.
+type MemoryPinStore struct {
+	mu   sync.Mutex
+	pins map[string]string
+}
+
+// Pin implements PinStore.
+func (s *MemoryPinStore) Pin(address string) (string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.pins[strings.ToLower(address)], nil
+}
+
+// SetPin implements PinStore.
+func (s *MemoryPinStore) SetPin(address, fingerprint string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.pins == nil {
+		s.pins = make(map[string]string)
+	}
+	s.pins[strings.ToLower(address)] = fingerprint
+	return nil
+}
+
+// check checks e as recipient key for address according to the policy, returning the entity
+// to encrypt to. A nil policy rejects invalid keys.
+func (p *KeyPolicy) check(e *openpgp.Entity, address string, now time.Time) (*openpgp.Entity, error) {
+	valid, err := checkKey(e, address, now)
+	if err != nil {
+		if p == nil || p.Mode != KeyWarn || p.Warn == nil {
+			return nil, err
+		}
+		if err := p.Warn(err); err != nil {
+			return nil, err
+		}
+		return e, nil
+	}
+
+	if p == nil || p.Mode != KeyTOFU {
+		return valid, nil
+	}
+	fpr := Fingerprint(e)
+	pinned, err := p.Pins.Pin(address)
+	if err != nil {
+		return nil, err
+	}
+	if pinned != "" && pinned != fpr {
+		changed := KeyChanged{Address: address, Pinned: pinned, Fingerprint: fpr}
+		if p.Warn == nil {
+			return nil, changed
+		}
+		if err := p.Warn(changed); err != nil {
+			return nil, err
+		}
+	}
+	if pinned != fpr {
+		if err := p.Pins.SetPin(address, fpr); err != nil {
+			return nil, err
+		}
+	}
+	return valid, nil
+}
+
+// Fingerprint returns the hex encoded fingerprint of e's primary key.
+func Fingerprint(e *openpgp.Entity) string {
+	return fmt.Sprintf("%X", e.PrimaryKey.Fingerprint[:])
+}
+
+// checkKey checks that e has a valid user ID for address and an encryption key that hasn't
+// expired or been revoked at now. It returns e without its revoked subkeys, so they won't be used.
+func checkKey(e *openpgp.Entity, address string, now time.Time) (*openpgp.Entity, error) {
+	invalid := func(reason string) error {
+		return InvalidKey{Address: address, Fingerprint: Fingerprint(e), Reason: reason}
+	}
+
+	for _, sig := range e.Revocations {
+		if e.PrimaryKey.VerifyRevocationSignature(sig) == nil {
+			return nil, invalid("the key has been revoked")
+		}
+	}
+
+	if bareKey(e) {
+		// there is no user ID, the key has been given for the address explicitly.
+		if !e.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+			return nil, invalid("the key can't be used for encryption")
+		}
+		return e, nil
+	}
+
+	var id *openpgp.Identity
+	for _, i := range e.Identities {
+		if i.UserId != nil && i.SelfSignature != nil && strings.EqualFold(i.UserId.Email, address) && !userIDRevoked(e, i) {
+			id = i
+			break
+		}
+	}
+	if id == nil {
+		return nil, invalid("the key has no valid user ID for the address")
+	}
+	if id.SelfSignature.KeyExpired(now) {
+		return nil, invalid("the key has expired")
+	}
+	if sigExpired(id.SelfSignature, now) {
+		return nil, invalid("the user ID has expired")
+	}
+
+	valid := *e
+	valid.Subkeys = nil
+	for _, sub := range e.Subkeys {
+		if !subkeyRevoked(e, sub) {
+			valid.Subkeys = append(valid.Subkeys, sub)
+		}
+	}
+
+	for _, sub := range valid.Subkeys {
+		if sub.Sig.FlagsValid && sub.Sig.FlagEncryptCommunications && sub.PublicKey.PubKeyAlgo.CanEncrypt() && !sub.Sig.KeyExpired(now) {
+			return &valid, nil
+		}
+	}
+	sig := id.SelfSignature
+	if (!sig.FlagsValid || sig.FlagEncryptCommunications) && e.PrimaryKey.PubKeyAlgo.CanEncrypt() {
+		return &valid, nil
+	}
+	return nil, invalid("the key has no valid encryption key (they have expired or been revoked)")
+}
+
+// bareKey reports whether e has been created from a bare key packet, without self-signatures (see bareEntity).
+func bareKey(e *openpgp.Entity) bool {
+	if len(e.Subkeys) != 0 {
+		return false
+	}
+	for _, id := range e.Identities {
+		if id.SelfSignature != nil && !id.SelfSignature.CreationTime.IsZero() {
+			return false
+		}
+	}
+	return true
+}
+
+// sigTypeCertRevocation is the type of user ID revocation signatures, which is missing in package packet.
+const sigTypeCertRevocation packet.SignatureType = 0x30
+
+// userIDRevoked reports whether the user ID id of e has been revoked after it's last self-signature.
+func userIDRevoked(e *openpgp.Entity, id *openpgp.Identity) bool {
+	for _, sig := range id.Signatures {
+		if sig.SigType == sigTypeCertRevocation && sig.IssuerKeyId != nil && *sig.IssuerKeyId == e.PrimaryKey.KeyId &&
+			!sig.CreationTime.Before(id.SelfSignature.CreationTime) && e.PrimaryKey.VerifyUserIdSignature(id.Name, e.PrimaryKey, sig) == nil {
+			return true
+		}
+	}
+	return false
+}
+
+// sigExpired reports whether sig has expired at now.
+func sigExpired(sig *packet.Signature, now time.Time) bool {
+	if sig.SigLifetimeSecs == nil || *sig.SigLifetimeSecs == 0 {
+		return false
+	}
+	return now.After(sig.CreationTime.Add(time.Duration(*sig.SigLifetimeSecs) * time.Second))
+}
+
+// subkeyRevoked reports whether sub has been revoked. The revocation signature may follow the
+// binding signature, then it's read as a signature of the last user ID.
+func subkeyRevoked(e *openpgp.Entity, sub openpgp.Subkey) bool {
+	if sub.Sig.SigType == packet.SigTypeSubkeyRevocation {
+		return true
+	}
+	for _, id := range e.Identities {
+		for _, sig := range id.Signatures {
+			if sig.SigType == packet.SigTypeSubkeyRevocation && e.PrimaryKey.VerifyKeySignature(sub.PublicKey, sig) == nil {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,172 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// revokedEntity returns a copy of e read back with sig appended, so it's verified and sorted in by ReadEntity.
+func revokedEntity(t *testing.T, e *openpgp.Entity, sig *packet.Signature) *openpgp.Entity {
+	t.Helper()
+	armorEntity(t, e)
+	var ring bytes.Buffer
+	if err := e.Serialize(&ring); err != nil {
+		t.Fatal(err)
+	}
+	if err := sig.Serialize(&ring); err != nil {
+		t.Fatal(err)
+	}
+	keys, err := ReadKeyRing(&ring)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return keys[0]
+}
+
+func revocation(e *openpgp.Entity, sigType packet.SignatureType) *packet.Signature {
+	return &packet.Signature{
+		SigType:      sigType,
+		PubKeyAlgo:   e.PrimaryKey.PubKeyAlgo,
+		Hash:         crypto.SHA256,
+		CreationTime: time.Now(),
+		IssuerKeyId:  &e.PrimaryKey.KeyId,
+	}
+}
+
+// keyRevocation returns a revocation signature for e's primary key made by priv.
+func keyRevocation(t *testing.T, e *openpgp.Entity, priv *packet.PrivateKey) *packet.Signature {
+	t.Helper()
+	sig := revocation(e, packet.SigTypeKeyRevocation)
+	h := sig.Hash.New()
+	e.PrimaryKey.SerializeSignaturePrefix(h)
+	var pub bytes.Buffer
+	e.PrimaryKey.Serialize(&pub)
+	h.Write(packetBody(pub.Bytes()))
+	if err := sig.Sign(h, priv, nil); err != nil {
+		t.Fatal(err)
+	}
+	return sig
+}
+
+func TestCheckKey(t *testing.T) {
+	now := time.Now()
+	e := testPGPEntity(t, "bob@example.com")
+	if _, err := checkKey(e, "Bob@example.com", now); err != nil {
+		t.Errorf("valid key rejected: %v", err)
+	}
+	if _, err := checkKey(e, "mallory@example.com", now); err == nil {
+		t.Error("accepted a key without user ID for the address")
+	}
+
+	expired := testPGPEntity(t, "bob@example.com")
+	expired.Subkeys = nil
+	addTestSubkey(t, expired, now.Add(-2*time.Hour), time.Hour, false)
+	if _, err := checkKey(expired, "bob@example.com", now); err == nil {
+		t.Error("accepted a key with an expired encryption subkey")
+	}
+
+	e = testPGPEntity(t, "bob@example.com")
+	sig := keyRevocation(t, e, e.PrivateKey)
+	if _, err := checkKey(revokedEntity(t, e, sig), "bob@example.com", now); err == nil {
+		t.Error("accepted a revoked key")
+	}
+
+	// a revocation signature made by another key is ignored (ReadEntity rejects it, but key stores may hold such entities).
+	e = testPGPEntity(t, "bob@example.com")
+	e.Revocations = append(e.Revocations, keyRevocation(t, e, testPGPEntity(t, "mallory@example.com").PrivateKey))
+	if _, err := checkKey(e, "bob@example.com", now); err != nil {
+		t.Errorf("key with a forged revocation rejected: %v", err)
+	}
+
+	e = testPGPEntity(t, "bob@example.com")
+	sig = revocation(e, packet.SigTypeSubkeyRevocation)
+	if err := sig.SignKey(e.Subkeys[0].PublicKey, e.PrivateKey, nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := checkKey(revokedEntity(t, e, sig), "bob@example.com", now); err == nil {
+		t.Error("accepted a key with a revoked encryption subkey")
+	}
+
+	e = testPGPEntity(t, "bob@example.com")
+	sig = revocation(e, sigTypeCertRevocation)
+	for _, id := range e.Identities {
+		if err := sig.SignUserId(id.Name, e.PrimaryKey, e.PrivateKey, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := checkKey(revokedEntity(t, e, sig), "bob@example.com", now); err == nil {
+		t.Error("accepted a key with a revoked user ID")
+	}
+}
+
+func TestKeyPolicy(t *testing.T) {
+	key, _ := testPGP(t, "sender@example.com")
+	sender := &Account{Address: "sender@example.com", Key: key}
+	bob := testPGPEntity(t, "bob@example.com")
+	to := &Account{Address: "bob@example.com", Key: &PGP{Store: NewMemoryKeyStore(bob)}}
+	mallory := &Account{Address: "mallory@example.com", Key: &PGP{Store: to.Key.Store, Fingerprint: Fingerprint(bob)}}
+	m := MessageFactory()
+
+	if _, err := m.Encrypt(mallory, sender); err == nil {
+		t.Fatal("encrypted to a key not bound to the address")
+	} else if _, ok := err.(InvalidKey); !ok {
+		t.Fatalf("expected InvalidKey, got %T: %v", err, err)
+	}
+
+	// a bare key packet has no user ID, it's used for the address it's given for.
+	var bare bytes.Buffer
+	w, err := armor.Encode(&bare, openpgp.PublicKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := bob.PrimaryKey.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+	if _, err := m.Encrypt(&Account{Address: "bob@example.com", Key: &PGP{Key: bare.String()}}, sender); err != nil {
+		t.Errorf("bare key rejected: %v", err)
+	}
+
+	var warned error
+	sender.KeyPolicy = &KeyPolicy{Mode: KeyWarn, Warn: func(err error) error { warned = err; return nil }}
+	if _, err := m.Encrypt(mallory, sender); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := warned.(InvalidKey); !ok {
+		t.Errorf("expected an InvalidKey warning, got %v", warned)
+	}
+
+	pins := new(MemoryPinStore)
+	sender.KeyPolicy = &KeyPolicy{Mode: KeyTOFU, Pins: pins}
+	if _, err := m.Encrypt(to, sender); err != nil {
+		t.Fatal(err)
+	}
+	if pin, _ := pins.Pin("Bob@example.com"); pin != Fingerprint(bob) {
+		t.Errorf("expected %s to be pinned, got %q", Fingerprint(bob), pin)
+	}
+
+	newBob := testPGPEntity(t, "bob@example.com")
+	changed := &Account{Address: "bob@example.com", Key: &PGP{Store: NewMemoryKeyStore(newBob)}}
+	_, err = m.Encrypt(changed, sender)
+	if err != (KeyChanged{Address: "bob@example.com", Pinned: Fingerprint(bob), Fingerprint: Fingerprint(newBob)}) {
+		t.Fatalf("expected KeyChanged, got %v", err)
+	}
+
+	warned = nil
+	sender.KeyPolicy.Warn = func(err error) error { warned = err; return nil }
+	if _, err := m.Encrypt(changed, sender); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := warned.(KeyChanged); !ok {
+		t.Errorf("expected a KeyChanged warning, got %v", warned)
+	}
+	if pin, _ := pins.Pin("bob@example.com"); pin != Fingerprint(newBob) {
+		t.Errorf("expected the new key to be pinned, got %q", pin)
+	}
+}
@@ -0,0 +1,289 @@
+package MIMEMail
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// KeyStore looks up OpenPGP keys (see PGP.Store).
+// DirKeyStore, KeyRingFile and MemoryKeyStore implement it.
+type KeyStore interface {
+	// ByEmail returns the keys with a user ID for address.
+	// If there is none, a KeyNotFound error is returned.
+	ByEmail(address string) (openpgp.EntityList, error)
+
+	// ByFingerprint returns the key with the given (hex encoded) fingerprint.
+	// If there is none, a KeyNotFound error is returned.
+	ByFingerprint(fingerprint string) (*openpgp.Entity, error)
+}
+
+// DirKeyStore is a KeyStore reading the keys from all files in the directory (armored or binary).
+// Files that don't hold OpenPGP keys are ignored.
+type DirKeyStore string
+
+// ByEmail implements KeyStore.
+func (d DirKeyStore) ByEmail(address string) (openpgp.EntityList, error) {
+	keys, err := d.keys()
+	if err != nil {
+		return nil, err
+	}
+	return byEmail(keys, address)
+}
+
+// ByFingerprint implements KeyStore.
+func (d DirKeyStore) ByFingerprint(fingerprint string) (*openpgp.Entity, error) {
+	keys, err := d.keys()
+	if err != nil {
+		return nil, err
+	}
+	return byFingerprint(keys, fingerprint)
+}
+
+func (d DirKeyStore) keys() (openpgp.EntityList, error) {
+	files, err := ioutil.ReadDir(string(d))
+	if err != nil {
+		return nil, err
+	}
+
+	var keys openpgp.EntityList
+	for _, fi := range files {
+		if !fi.Mode().IsRegular() {
+			continue
+		}
+		k, err := loadKeyFile(filepath.Join(string(d), fi.Name()))
+		if err != nil {
+			if os.IsNotExist(err) || os.IsPermission(err) {
+				return nil, err
+			}
+			continue
+		}
+		keys = append(keys, k...)
+	}
+	return keys, nil
+}
+
+// KeyRingFile is a KeyStore reading the keys from a GnuPG keybox (pubring.kbx) or
+// keyring file (pubring.gpg, armored or binary).
+type KeyRingFile string
+
+// ByEmail implements KeyStore.
+func (f KeyRingFile) ByEmail(address string) (openpgp.EntityList, error) {
+	keys, err := loadKeyFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return byEmail(keys, address)
+}
+
+// ByFingerprint implements KeyStore.
+func (f KeyRingFile) ByFingerprint(fingerprint string) (*openpgp.Entity, error) {
+	keys, err := loadKeyFile(string(f))
+	if err != nil {
+		return nil, err
+	}
+	return byFingerprint(keys, fingerprint)
+}
+
+// MemoryKeyStore is a KeyStore holding the keys in memory, mostly for usage in tests.
+type MemoryKeyStore struct {
+	mu   sync.Mutex
+	keys openpgp.EntityList
+}
+
+// NewMemoryKeyStore returns a MemoryKeyStore holding keys.
+func NewMemoryKeyStore(keys ...*openpgp.Entity) *MemoryKeyStore {
+	return &MemoryKeyStore{keys: keys}
+}
+
+// Add reads the keys from r (see ReadKeyRing) and adds them to the store.
+func (s *MemoryKeyStore) Add(r io.Reader) error {
+	keys, err := ReadKeyRing(r)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.keys = append(s.keys, keys...)
+	return nil
+}
+
+// ByEmail implements KeyStore.
+func (s *MemoryKeyStore) ByEmail(address string) (openpgp.EntityList, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return byEmail(s.keys, address)
+}
+
+// ByFingerprint implements KeyStore.
+func (s *MemoryKeyStore) ByFingerprint(fingerprint string) (*openpgp.Entity, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return byFingerprint(s.keys, fingerprint)
+}
+
+// byEmail returns the keys with a user ID for address.
+func byEmail(keys openpgp.EntityList, address string) (openpgp.EntityList, error) {
+	var found openpgp.EntityList
+	for _, e := range keys {
+		if hasUserID(openpgp.EntityList{e}, address) {
+			found = append(found, e)
+		}
+	}
+	if len(found) == 0 {
+		return nil, KeyNotFound(address)
+	}
+	return found, nil
+}
+
+// byFingerprint returns the key with the hex encoded fingerprint (spaces are ignored).
+func byFingerprint(keys openpgp.EntityList, fingerprint string) (*openpgp.Entity, error) {
+	fpr, err := hex.DecodeString(strings.Replace(fingerprint, " ", "", -1))
+	if err != nil {
+		return nil, fmt.Errorf("invalid fingerprint %q: %v", fingerprint, err)
+	}
+	for _, e := range keys {
+		if bytes.Equal(e.PrimaryKey.Fingerprint[:], fpr) {
+			return e, nil
+		}
+	}
+	return nil, KeyNotFound(fingerprint)
+}
+
+// maxCachedKeyRings limits the number of keyrings in keyCache, the oldest ones are evicted first.
+const maxCachedKeyRings = 64
+
+// keyCache holds the parsed keyrings by source, so they aren't parsed again for every mail.
+// The private keys are kept as read, i.e. encrypted if they are (see privateKeyRing).
+var keyCache = struct {
+	sync.Mutex
+	keys  map[string]cachedKeys
+	order []string
+}{keys: make(map[string]cachedKeys)}
+
+type cachedKeys struct {
+	modTime time.Time
+	keys    openpgp.EntityList
+}
+
+// cachedKeyRing returns the keyring cached for source, if it's not older than modTime.
+// Otherwise it's parsed from the data returned by load.
+func cachedKeyRing(source string, modTime time.Time, load func() ([]byte, error)) (openpgp.EntityList, error) {
+	keyCache.Lock()
+	defer keyCache.Unlock()
+	c, ok := keyCache.keys[source]
+	if ok && c.modTime.Equal(modTime) {
+		return c.keys, nil
+	}
+
+	data, err := load()
+	if err != nil {
+		return nil, err
+	}
+	keys, err := parseKeyRing(data)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		keyCache.order = append(keyCache.order, source)
+		if len(keyCache.order) > maxCachedKeyRings {
+			delete(keyCache.keys, keyCache.order[0])
+			keyCache.order = keyCache.order[1:]
+		}
+	}
+	keyCache.keys[source] = cachedKeys{modTime: modTime, keys: keys}
+	return keys, nil
+}
+
+// loadKeyFile returns the (cached) keys from file.
+func loadKeyFile(file string) (openpgp.EntityList, error) {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	return cachedKeyRing("file:"+file, fi.ModTime(), func() ([]byte, error) {
+		return ioutil.ReadFile(file)
+	})
+}
+
+// loadKeyString returns the (cached) keys from the armored or binary key.
+func loadKeyString(key string) (openpgp.EntityList, error) {
+	sum := sha256.Sum256([]byte(key))
+	return cachedKeyRing("key:"+hex.EncodeToString(sum[:]), time.Time{}, func() ([]byte, error) {
+		return []byte(key), nil
+	})
+}
+
+// parseKeyRing parses a keyring (see ReadKeyRing) or a bare public or private key packet.
+func parseKeyRing(data []byte) (openpgp.EntityList, error) {
+	keys, err := ReadKeyRing(bytes.NewReader(data))
+	if err == nil {
+		return keys, nil
+	}
+
+	// a bare key packet, without user ID or subkeys.
+	if pubKey, bareErr := UnpackKey(bytes.NewReader(data)); bareErr == nil {
+		return openpgp.EntityList{bareEntity(pubKey, nil)}, nil
+	}
+	if privKey, bareErr := UnPackPrivateKey(bytes.NewReader(data)); bareErr == nil {
+		return openpgp.EntityList{bareEntity(&privKey.PublicKey, privKey)}, nil
+	}
+	return nil, err
+}
+
+// keybox blob types and the magic of the header blob.
+const (
+	kbxHeaderBlob  = 1
+	kbxOpenPGPBlob = 2
+	kbxMagic       = "KBXf"
+)
+
+// isKeybox reports whether the data read by br is a GnuPG keybox.
+func isKeybox(br *bufio.Reader) bool {
+	head, err := br.Peek(12)
+	return err == nil && head[4] == kbxHeaderBlob && string(head[8:12]) == kbxMagic
+}
+
+// readKeybox reads the OpenPGP keyblocks from the GnuPG keybox read from r
+// and returns them as binary keyring.
+func readKeybox(r io.Reader) ([]byte, error) {
+	var keyring bytes.Buffer
+	for {
+		var length uint32
+		if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+			if err == io.EOF {
+				return keyring.Bytes(), nil
+			}
+			return nil, err
+		}
+		if length < 16 || length > 1<<24 {
+			return nil, fmt.Errorf("keybox: invalid blob length %d", length)
+		}
+		blob := make([]byte, length)
+		binary.BigEndian.PutUint32(blob, length)
+		if _, err := io.ReadFull(r, blob[4:]); err != nil {
+			return nil, err
+		}
+		if blob[4] != kbxOpenPGPBlob {
+			continue
+		}
+
+		offset, size := binary.BigEndian.Uint32(blob[8:]), binary.BigEndian.Uint32(blob[12:])
+		if uint64(offset)+uint64(size) > uint64(length) {
+			return nil, fmt.Errorf("keybox: invalid keyblock")
+		}
+		keyring.Write(blob[offset : offset+size])
+	}
+}
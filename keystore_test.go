@@ -0,0 +1,200 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+)
+
+// dearmor returns the binary data of the armored block.
+func dearmor(t *testing.T, armored string) []byte {
+	block, err := armor.Decode(strings.NewReader(armored))
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadAll(block.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// testKeybox returns a GnuPG keybox holding the binary keys.
+func testKeybox(keys ...[]byte) []byte {
+	var kbx bytes.Buffer
+	header := make([]byte, 32)
+	binary.BigEndian.PutUint32(header, 32)
+	header[4], header[5] = kbxHeaderBlob, 1
+	copy(header[8:], kbxMagic)
+	kbx.Write(header)
+
+	for _, key := range keys {
+		blob := make([]byte, 20, 20+len(key))
+		binary.BigEndian.PutUint32(blob, uint32(20+len(key)))
+		blob[4], blob[5] = kbxOpenPGPBlob, 1
+		binary.BigEndian.PutUint32(blob[8:], 20)
+		binary.BigEndian.PutUint32(blob[12:], uint32(len(key)))
+		kbx.Write(append(blob, key...))
+	}
+	return kbx.Bytes()
+}
+
+func TestKeyStores(t *testing.T) {
+	alice := testPGPEntity(t, "alice@example.com")
+	_, alicePub := armorEntity(t, alice)
+	bob := testPGPEntity(t, "bob@example.com")
+	_, bobPub := armorEntity(t, bob)
+
+	dir := tempDir(t)
+	ioutil.WriteFile(filepath.Join(dir, "alice.asc"), []byte(alicePub), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "bob.asc"), []byte(bobPub), 0600)
+	ioutil.WriteFile(filepath.Join(dir, "README"), []byte("not a key"), 0600)
+
+	pubring := filepath.Join(tempDir(t), "pubring.gpg")
+	ioutil.WriteFile(pubring, append(dearmor(t, alicePub), dearmor(t, bobPub)...), 0600)
+	keybox := filepath.Join(tempDir(t), "pubring.kbx")
+	ioutil.WriteFile(keybox, testKeybox(dearmor(t, alicePub), dearmor(t, bobPub)), 0600)
+
+	mem := NewMemoryKeyStore(alice)
+	if err := mem.Add(strings.NewReader(bobPub)); err != nil {
+		t.Fatal(err)
+	}
+
+	bobFpr := fmt.Sprintf("% X", bob.PrimaryKey.Fingerprint[:])
+	for _, store := range []KeyStore{DirKeyStore(dir), KeyRingFile(pubring), KeyRingFile(keybox), mem} {
+		keys, err := store.ByEmail("Alice@example.com")
+		if err != nil {
+			t.Fatalf("%T: %v", store, err)
+		}
+		if len(keys) != 1 || keys[0].PrimaryKey.KeyId != alice.PrimaryKey.KeyId {
+			t.Errorf("%T: unexpected keys for alice: %v", store, keys)
+		}
+
+		e, err := store.ByFingerprint(bobFpr)
+		if err != nil || e.PrimaryKey.KeyId != bob.PrimaryKey.KeyId {
+			t.Errorf("%T: bob not found by fingerprint: %v", store, err)
+		}
+
+		if _, err := store.ByEmail("carol@example.com"); err != KeyNotFound("carol@example.com") {
+			t.Errorf("%T: expected KeyNotFound, got %v", store, err)
+		}
+
+		// keys are looked up in the store when encrypting.
+		m := MessageFactory()
+		to := &Account{Address: "bob@example.com", Key: &PGP{Store: store}}
+		if _, err := m.Encrypt(to, nil); err != nil {
+			t.Errorf("%T: %v", store, err)
+		}
+		to = &Account{Address: "bob@example.com", Key: &PGP{Store: store, Fingerprint: bobFpr}}
+		if _, err := m.Encrypt(to, nil); err != nil {
+			t.Errorf("%T: %v", store, err)
+		}
+	}
+}
+
+// emptyKeyStore is a KeyStore returning no keys, without error.
+type emptyKeyStore struct{}
+
+func (emptyKeyStore) ByEmail(address string) (openpgp.EntityList, error)        { return nil, nil }
+func (emptyKeyStore) ByFingerprint(fingerprint string) (*openpgp.Entity, error) { return nil, nil }
+
+func TestEmptyKeyStore(t *testing.T) {
+	m := MessageFactory()
+	for _, key := range []*PGP{{Store: emptyKeyStore{}}, {Store: emptyKeyStore{}, Fingerprint: "00"}} {
+		to := &Account{Address: "bob@example.com", Key: key}
+		if _, err := m.Encrypt(to, nil); err != KeyNotFound("bob@example.com") {
+			t.Errorf("expected KeyNotFound, got %v", err)
+		}
+	}
+}
+
+func TestKeyCache(t *testing.T) {
+	_, pub := testPGP(t, "alice@example.com")
+	file := filepath.Join(tempDir(t), "alice.asc")
+	ioutil.WriteFile(file, []byte(pub), 0600)
+
+	acc := &Account{Address: "alice@example.com", Key: &PGP{File: file}}
+	e1, err := CreateEntity(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e2, err := CreateEntity(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e1 != e2 {
+		t.Error("key parsed again")
+	}
+
+	// inline keys, e.g. of Autocrypt peers, don't stay cached forever.
+	for i := 0; i < maxCachedKeyRings; i++ {
+		if _, err := CreateEntity(&Account{Address: "alice@example.com", Key: &PGP{Key: pub + strings.Repeat("\n", i+1)}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(keyCache.keys) > maxCachedKeyRings {
+		t.Errorf("%d keyrings cached", len(keyCache.keys))
+	}
+	if e3, _ := CreateEntity(acc); e3 == e1 {
+		t.Error("oldest keyring not evicted")
+	}
+}
+
+func TestPGPPassphrase(t *testing.T) {
+	e := testPGPEntity(t, "sender@example.com")
+	_, pub := armorEntity(t, e)
+
+	// the primary key encrypted, with the (signed) user ID.
+	encryptedKey := func() string {
+		var ring bytes.Buffer
+		key, err := encryptPrivateKey(e.PrivateKey, []byte("secret"), nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ring.Write(key)
+		for _, id := range e.Identities {
+			id.UserId.Serialize(&ring)
+			id.SelfSignature.Serialize(&ring)
+		}
+		return ring.String()
+	}
+
+	var asked int
+	armored := encryptedKey()
+	key := &PGP{Key: armored, Passphrase: func(key *openpgp.Entity) ([]byte, error) {
+		asked++
+		if key.PrimaryKey.KeyId != e.PrimaryKey.KeyId {
+			t.Errorf("unexpected key %X", key.PrimaryKey.KeyId)
+		}
+		return []byte("secret"), nil
+	}}
+	sender := &Account{Address: "sender@example.com", Key: key}
+
+	m := MessageFactory()
+	for i := 0; i < 2; i++ {
+		signed, err := m.Sign(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkPGPSigned(t, signed, pub)
+	}
+	if asked != 2 {
+		t.Errorf("expected to be asked for the passphrase for every mail, got %d", asked)
+	}
+
+	// the cached key stays encrypted after it was used with the right passphrase.
+	for _, pass := range []string{"wrong", ""} {
+		_, err := m.Sign(&Account{Address: "sender@example.com", Key: &PGP{Key: armored, Pass: pass}})
+		if _, ok := err.(pgperrors.StructuralError); !ok {
+			t.Errorf("expected an error for the passphrase %q, got %v", pass, err)
+		}
+	}
+}
@@ -0,0 +1,175 @@
+package MIMEMail
+
+import (
+	"fmt"
+	"io"
+	"net/mail"
+	"os"
+	"strings"
+)
+
+// Disposition types (RFC 8098 3.2.6.2)
+const (
+	DispositionDisplayed  = "displayed"
+	DispositionDeleted    = "deleted"
+	DispositionDispatched = "dispatched"
+	DispositionProcessed  = "processed"
+)
+
+// Disposition modes (RFC 8098 3.2.6.1)
+const (
+	ModeManual    = "manual-action/MDN-sent-manually"
+	ModeAutomatic = "automatic-action/MDN-sent-automatically"
+)
+
+const mime_dispositionNotification = "message/disposition-notification"
+
+// MDN holds the fields of a Message Disposition Notification (read receipt, RFC 8098).
+type MDN struct {
+	// ReportingUA names the user agent that generated the report. If empty
+	// when generating a report, the hostname and "MIMEMail" are used.
+	ReportingUA string
+
+	// OriginalRecipient is the recipient address as given by the sender
+	// (from the Original-Recipient header field of the original message).
+	OriginalRecipient string
+
+	// FinalRecipient is the address of the recipient that read the message,
+	// it is required when generating a report.
+	FinalRecipient string
+
+	// OriginalMessageID is the Message-ID of the message the report is about.
+	OriginalMessageID string
+
+	// Mode is the disposition mode, one of the Mode... constants. When
+	// generating a report it defaults to ModeManual.
+	Mode string
+
+	// Disposition is the disposition type, one of the Disposition... constants.
+	// When generating a report it defaults to DispositionDisplayed.
+	Disposition string
+}
+
+// NewMDN creates a read receipt for the original message read from r and
+// addresses it to the address(es) in the original's Disposition-Notification-To
+// field. If that is missing, a NoReceiptRequested error is returned.
+// The report references the original Message-ID and mdn.FinalRecipient, which
+// is required, the receipt's From still needs to be set before sending it.
+func NewMDN(r io.Reader, mdn MDN) (*Mail, error) {
+	if strings.TrimSpace(mdn.FinalRecipient) == "" {
+		return nil, fmt.Errorf("MDN: FinalRecipient must be set")
+	}
+
+	orig, err := ReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+
+	dnt, err := mail.ParseAddressList(orig.Get(string(AddrDispositionNotificationTo)))
+	if err != nil || len(dnt) == 0 {
+		return nil, new(NoReceiptRequested)
+	}
+
+	if mdn.OriginalMessageID == "" {
+		mdn.OriginalMessageID = strings.TrimSpace(orig.Get("Message-Id"))
+	}
+	if mdn.OriginalRecipient == "" {
+		mdn.OriginalRecipient = typedValue(orig.Get("Original-Recipient"))
+	}
+	if mdn.ReportingUA == "" {
+		host, _ := os.Hostname()
+		mdn.ReportingUA = host + "; MIMEMail"
+	}
+	if mdn.Mode == "" {
+		mdn.Mode = ModeManual
+	}
+	if mdn.Disposition == "" {
+		mdn.Disposition = DispositionDisplayed
+	}
+
+	m := NewMail()
+	m.contentType = fmt.Sprintf("%s; report-type=disposition-notification", mime_report)
+	for _, addr := range dnt {
+		m.ToAddr(*addr)
+	}
+
+	m.Subject = "Read: " + orig.Get("Subject")
+	if mdn.OriginalMessageID != "" {
+		m.Header.Set("In-Reply-To", mdn.OriginalMessageID)
+		m.Header.Set("References", mdn.OriginalMessageID)
+	}
+
+	text := NewPlainText()
+	fmt.Fprintf(text, "This is a receipt for the mail you sent to %s.\r\n\r\n", mdn.FinalRecipient)
+	fmt.Fprintf(text, "The message has been %s.\r\n", mdn.Disposition)
+	fmt.Fprintf(text, "Note: This receipt only acknowledges that the message was %s.\r\n", mdn.Disposition)
+	fmt.Fprintf(text, "There is no guarantee that the content has been read or understood.\r\n")
+
+	report := NewMIMEPart()
+	report.Set(content_type, mime_dispositionNotification)
+	fmt.Fprintf(report, "Reporting-UA: %s\r\n", mdn.ReportingUA)
+	if mdn.OriginalRecipient != "" {
+		fmt.Fprintf(report, "Original-Recipient: rfc822;%s\r\n", mdn.OriginalRecipient)
+	}
+	fmt.Fprintf(report, "Final-Recipient: rfc822;%s\r\n", mdn.FinalRecipient)
+	if mdn.OriginalMessageID != "" {
+		fmt.Fprintf(report, "Original-Message-ID: %s\r\n", mdn.OriginalMessageID)
+	}
+	fmt.Fprintf(report, "Disposition: %s; %s\r\n", mdn.Mode, mdn.Disposition)
+
+	headers := NewMIMEPart()
+	headers.Set(content_type, "text/rfc822-headers")
+	head, _ := splitHeader(orig.raw)
+	headers.Write(head)
+
+	m.parts = append(m.parts, text, report, headers)
+	return m, nil
+}
+
+// ParseMDN parses the raw message read from r as a multipart/report;
+// report-type=disposition-notification message (RFC 8098).
+// If it is not such a report, a NotAReport error is returned.
+func ParseMDN(r io.Reader) (*MDN, error) {
+	msg, err := ReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+
+	report := findReport(msg, "disposition-notification")
+	if report == nil {
+		return nil, NotAReport("disposition-notification")
+	}
+	part := report.find(mime_dispositionNotification, "message/global-disposition-notification")
+	if part == nil {
+		return nil, NotAReport("disposition-notification")
+	}
+
+	groups, err := readFieldGroups(part)
+	if err != nil {
+		return nil, err
+	}
+	if len(groups) == 0 {
+		return nil, NotAReport("disposition-notification")
+	}
+	fields := groups[0]
+
+	mdn := &MDN{
+		ReportingUA:       strings.TrimSpace(fields.Get("Reporting-Ua")),
+		OriginalRecipient: typedValue(fields.Get("Original-Recipient")),
+		FinalRecipient:    typedValue(fields.Get("Final-Recipient")),
+		OriginalMessageID: strings.TrimSpace(fields.Get("Original-Message-Id")),
+	}
+	if mdn.OriginalMessageID == "" {
+		mdn.OriginalMessageID = originalMessageID(report)
+	}
+
+	disposition := fields.Get("Disposition")
+	if i := strings.Index(disposition, ";"); i >= 0 {
+		mdn.Mode = strings.TrimSpace(disposition[:i])
+		mdn.Disposition = strings.TrimSpace(disposition[i+1:])
+	} else {
+		mdn.Disposition = strings.TrimSpace(disposition)
+	}
+
+	return mdn, nil
+}
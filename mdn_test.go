@@ -0,0 +1,100 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestDispositionNotificationTo(t *testing.T) {
+	m := MessageFactory()
+	if err := m.DispositionNotificationTo("Legal", "legal@example.com"); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("\r\nDisposition-Notification-To: \"Legal\" <legal@example.com>\r\n")) {
+		t.Fatalf("missing Disposition-Notification-To:\n%s", b)
+	}
+}
+
+func TestMDNRoundTrip(t *testing.T) {
+	orig := NewMail()
+	orig.From("Legal", "legal@example.com")
+	orig.To("Customer", "customer@example.com")
+	orig.DispositionNotificationTo("Legal", "receipts@example.com")
+	orig.Subject = "Contract"
+	orig.Header.Set("Message-ID", "<contract-42@example.com>")
+	orig.PlainTextBody().Write([]byte("please sign\r\n"))
+
+	raw, err := orig.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	receipt, err := NewMDN(bytes.NewReader(raw), MDN{FinalRecipient: "customer@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	receipt.From("Customer", "customer@example.com")
+
+	if rcpt := receipt.Recipients(); len(rcpt) != 1 || rcpt[0] != "receipts@example.com" {
+		t.Errorf("receipt not addressed to Disposition-Notification-To: %v", rcpt)
+	}
+
+	b, err := receipt.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(b, []byte("Content-Type: multipart/report; report-type=disposition-notification; boundary=")) {
+		t.Fatalf("not a disposition-notification report:\n%s", b)
+	}
+	if !bytes.Contains(b, []byte("In-Reply-To: <contract-42@example.com>\r\n")) {
+		t.Errorf("receipt doesn't reference the original:\n%s", b)
+	}
+
+	mdn, err := ParseMDN(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mdn.OriginalMessageID != "<contract-42@example.com>" {
+		t.Errorf("unexpected Original-Message-ID: %q", mdn.OriginalMessageID)
+	}
+	if mdn.FinalRecipient != "customer@example.com" {
+		t.Errorf("unexpected Final-Recipient: %q", mdn.FinalRecipient)
+	}
+	if mdn.Mode != ModeManual || mdn.Disposition != DispositionDisplayed {
+		t.Errorf("unexpected disposition: %q; %q", mdn.Mode, mdn.Disposition)
+	}
+}
+
+func TestNewMDNNotRequested(t *testing.T) {
+	msg := "From: friend@example.com\r\nSubject: lunch?\r\n\r\nsee you at noon\r\n"
+	if _, err := NewMDN(strings.NewReader(msg), MDN{FinalRecipient: "me@example.com"}); err == nil {
+		t.Fatal("expected error")
+	} else if _, ok := err.(*NoReceiptRequested); !ok {
+		t.Fatalf("expected NoReceiptRequested, got %T", err)
+	}
+}
+
+func TestNewMDNNoFinalRecipient(t *testing.T) {
+	msg := "From: legal@example.com\r\nDisposition-Notification-To: receipts@example.com\r\n\r\nplease sign\r\n"
+	if _, err := NewMDN(strings.NewReader(msg), MDN{}); err == nil {
+		t.Fatal("expected an error without FinalRecipient")
+	}
+	if _, err := NewMDN(strings.NewReader(msg), MDN{FinalRecipient: "customer@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseMDNNoReport(t *testing.T) {
+	if _, err := ParseDSN(strings.NewReader(postfixDSN)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ParseMDN(strings.NewReader(postfixDSN)); err == nil {
+		t.Fatal("a DSN is not a MDN")
+	}
+}
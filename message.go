@@ -7,6 +7,8 @@ import (
 	"mime/multipart"
 	"net/smtp"
 	"net/textproto"
+	"sort"
+	"strings"
 
 	"github.com/tike/MIMEMail/templated"
 )
@@ -22,8 +24,28 @@ type Mail struct {
 	// The subject Line
 	Subject string
 
+	// Header holds additional header fields (e.g. Message-ID or In-Reply-To),
+	// they are written after the address fields and Subject.
+	// Values must be properly encoded already.
+	Header textproto.MIMEHeader
+
 	parts []*MIMEPart
 
+	// HideCc removes the Cc field from the unencrypted header of PGP/MIME encrypted mails,
+	// so it's only visible in the protected headers (see WriteEncrypted).
+	HideCc bool
+
+	// PGPMode selects the format of signed and encrypted mail (see Sign and Encrypt),
+	// defaults to PGP/MIME.
+	PGPMode PGPMode
+
+	// SignMode selects how PGP/MIME encrypted mail is signed (see WriteEncrypted),
+	// defaults to SignCombined.
+	SignMode SignMode
+
+	// multipart type of the body, defaults to multipart/mixed.
+	contentType string
+
 	// for testing purposes only
 	boundary string
 }
@@ -32,6 +54,7 @@ type Mail struct {
 func NewMail() *Mail {
 	return &Mail{
 		Addresses: NewAddresses(),
+		Header:    make(textproto.MIMEHeader),
 		parts:     make([]*MIMEPart, 0, 1),
 	}
 }
@@ -61,18 +84,21 @@ func NewTemplated(cnf *templated.Config, name string, data interface{}) (*Mail,
 // is used (with the same restrictions). If both are nil,
 // a NoSender error is returned.
 // These values are then passed on to smtp.SendMail, returning any errors it throws.
-func (m *Mail) SendMail(adr string, auth smtp.Auth) error {
+//
+// If you pass an Envelope, it's used for MAIL FROM / RCPT TO instead of the
+// addresses derived from the header fields.
+func (m *Mail) SendMail(adr string, auth smtp.Auth, env ...*Envelope) error {
 	msg, err := m.Bytes()
 	if err != nil {
 		return err
 	}
 
-	from, err := m.EffectiveSender()
+	e, err := m.envelope(env)
 	if err != nil {
 		return err
 	}
 
-	return smtp.SendMail(adr, auth, from, m.Recipients(), msg)
+	return sendMail(adr, auth, e, msg)
 }
 
 // AddFile adds the file given by filename as an attachment to the mail.
@@ -132,10 +158,14 @@ func (m *Mail) Bytes() ([]byte, error) {
 	return msg.Bytes(), nil
 }
 
-var headerOrder = []string{"Sender", "From", "To", "Cc", "Bcc", "ReplyTo", "FollowupTo", "Subject", "MIME-Version"}
+var headerOrder = []string{"Sender", "From", "To", "Cc", "Bcc", "ReplyTo", "FollowupTo", "Disposition-Notification-To", "Subject", "MIME-Version"}
 
 func (m *Mail) writeHeader(w io.Writer) error {
-	header := m.getHeader()
+	return m.writeFields(w, m.getHeader())
+}
+
+// writeFields writes the fields from header in headerOrder, followed by the additional fields in m.Header.
+func (m *Mail) writeFields(w io.Writer, header textproto.MIMEHeader) error {
 	for _, field := range headerOrder {
 		for _, value := range header.Values(field) {
 			if _, err := w.Write([]byte(fmt.Sprintf("%s: %s\r\n", field, value))); err != nil {
@@ -144,14 +174,51 @@ func (m *Mail) writeHeader(w io.Writer) error {
 		}
 	}
 
+	fields := make([]string, 0, len(m.Header))
+	for field := range m.Header {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, value := range m.Header[field] {
+			if _, err := w.Write([]byte(fmt.Sprintf("%s: %s\r\n", field, value))); err != nil {
+				return err
+			}
+		}
+	}
+
 	return nil
 }
 
+// multipartType returns the multipart type of the mail body.
+func (m *Mail) multipartType() string {
+	if m.contentType == "" {
+		return mime_multipart
+	}
+	return m.contentType
+}
+
 func (m *Mail) writeBody(w io.Writer) error {
+	return m.writeEntity(w, false)
+}
+
+// writeEntity writes the body of the mail as MIME entity. If protected is true, the header fields
+// are included in it's header, as protected headers (see WriteEncrypted).
+func (m *Mail) writeEntity(w io.Writer, protected bool) error {
 	mpw := multipart.NewWriter(w)
 	m.boundary = mpw.Boundary()
 
-	w.Write([]byte(fmt.Sprintf("%s: %s; boundary=%s\r\n\r\n", content_type, mime_multipart, mpw.Boundary())))
+	contentType := fmt.Sprintf("%s; boundary=%s", m.multipartType(), mpw.Boundary())
+	if protected {
+		header := m.getHeader()
+		header.Del("Bcc")
+		header.Del("MIME-Version")
+		if err := m.writeFields(w, header); err != nil {
+			return err
+		}
+		contentType += `; protected-headers="v1"`
+	}
+	w.Write([]byte(fmt.Sprintf("%s: %s\r\n\r\n", content_type, contentType)))
 
 	for _, part := range m.parts {
 		pw, err := mpw.CreatePart(part.MIMEHeader)
@@ -159,7 +226,7 @@ func (m *Mail) writeBody(w io.Writer) error {
 			return err
 		}
 
-		if _, err := pw.Write(part.Bytes()); err != nil {
+		if err := part.writeBody(pw); err != nil {
 			return err
 		}
 	}
@@ -186,7 +253,7 @@ func (m *Mail) WriteTo(w io.Writer) error {
 }
 
 // Encrypt encrypts the mail with PGP/MIME using CreateEntity to obtain recpient and CreateSigningEntity to obtain the signing entity.
-// If signer is nil, the mail will simply not be signed. The Key Fields of both to and signer must be non-nil.
+// If signer is nil, the mail will simply not be signed. If to's Key is nil, it's looked up using signer's WKD.
 func (m *Mail) Encrypt(to *Account, signer *Account) ([]byte, error) {
 	var b bytes.Buffer
 	if err := m.WriteEncrypted(&b, to, signer); err != nil {
@@ -196,15 +263,128 @@ func (m *Mail) Encrypt(to *Account, signer *Account) ([]byte, error) {
 }
 
 // WriteEncrypted encrypts the mail with PGP/MIME using CreateEntity to obtain the recpient and CreateSigningEntity to obtain the signing entity.
-// If signer is nil, the mail will simply not be signed. The Key Fields of both to and signer must be non-nil.
+// If signer is nil, the mail will simply not be signed. If to's Key is nil, it's looked up using signer's WKD.
+//
+// The header fields are protected (protected-headers="v1"): they are included in the encrypted part and the
+// Subject of the unencrypted header is replaced with "..." and Bcc is removed. Set HideCc to also remove the Cc field from it.
+// If PGPMode is PGPInline, inline PGP is used instead (and the header isn't protected).
+//
+// The signature is included in the encrypted OpenPGP message, unless SignMode is SignNested:
+// then the mail is signed with PGP/MIME first and the multipart/signed entity is encrypted.
 func (m *Mail) WriteEncrypted(w io.Writer, to *Account, signer *Account) error {
-	if err := m.writeHeader(w); err != nil {
+	if to != nil && to.Key == nil {
+		var err error
+		if to, err = discoverKey(signer, to.Address); err != nil {
+			return err
+		}
+	}
+	return m.writeEncrypted(w, []*Account{to}, signer)
+}
+
+// EncryptToAll encrypts the mail with PGP/MIME for all of it's recipients (see Recipients), see WriteEncryptedToAll.
+func (m *Mail) EncryptToAll(keys []*Account, signer *Account) ([]byte, error) {
+	var b bytes.Buffer
+	if err := m.WriteEncryptedToAll(&b, keys, signer); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteEncryptedToAll encrypts the mail with PGP/MIME for all of it's recipients (see Recipients) and writes it to w.
+// The recipient's keys are taken from the Key field of the account in keys with the matching Address.
+// If there is none for some of them, they are looked up using signer's WKD and a MissingKeys error is returned
+// for those that can't be found. If signer is not nil the mail is signed and if signer's Key has EncryptToSelf
+// set, it's also encrypted for signer.
+func (m *Mail) WriteEncryptedToAll(w io.Writer, keys []*Account, signer *Account) error {
+	to, err := m.recipientKeys(keys, signer)
+	if err != nil {
+		return err
+	}
+	return m.writeEncrypted(w, to, signer)
+}
+
+// recipientKeys returns the account from keys for each of the mail's recipients, or one with the key
+// looked up by signer's WKD.
+func (m *Mail) recipientKeys(keys []*Account, signer *Account) ([]*Account, error) {
+	byAddress := make(map[string]*Account, len(keys))
+	for _, a := range keys {
+		if a != nil && a.Key != nil {
+			byAddress[strings.ToLower(a.Address)] = a
+		}
+	}
+
+	var (
+		to      []*Account
+		missing MissingKeys
+		seen    = make(map[string]bool)
+	)
+	for _, address := range m.Recipients() {
+		key := strings.ToLower(address)
+		if seen[key] {
+			continue
+		}
+		seen[key] = true
+
+		a, ok := byAddress[key]
+		if !ok {
+			var err error
+			if a, err = discoverKey(signer, address); err != nil {
+				if _, notFound := err.(KeyNotFound); !notFound {
+					return nil, err
+				}
+				missing = append(missing, address)
+				continue
+			}
+		}
+		to = append(to, a)
+	}
+	if len(missing) != 0 {
+		return nil, missing
+	}
+	if len(to) == 0 {
+		return nil, new(NoRecipients)
+	}
+	return to, nil
+}
+
+// writeEncrypted writes the mail as PGP/MIME encrypted for all the accounts in to.
+func (m *Mail) writeEncrypted(w io.Writer, to []*Account, signer *Account) error {
+	if m.PGPMode == PGPInline {
+		return m.writeInlineEncrypted(w, to, signer)
+	}
+
+	keys, err := encryptionKeys(to, signer)
+	if err != nil {
+		return err
+	}
+
+	var (
+		content []byte
+		sig     *MIMEPart
+		nested  = keys.signer != nil && m.SignMode == SignNested
+	)
+	if nested {
+		if content, sig, err = m.signedEntity(keys.signer, keys.config, true); err != nil {
+			return err
+		}
+		// the signature is already in the signed entity.
+		keys.signer = nil
+	}
+
+	// the real header fields are protected in the encrypted part.
+	header := m.getHeader()
+	header.Set("Subject", "...")
+	header.Del("Bcc")
+	if m.HideCc {
+		header.Del("Cc")
+	}
+	if err := m.writeFields(w, header); err != nil {
 		return err
 	}
 
 	mpw := multipart.NewWriter(w)
 	pgpMIMEheader := fmt.Sprintf("%s: %s; protocol=%q; boundary=%q\r\n\r\n",
-		content_type, "multipart/encrypted", "application/pgp-encrypted", mpw.Boundary())
+		content_type, "multipart/encrypted", mime_pgpencrypted, mpw.Boundary())
 	if _, err := w.Write([]byte(pgpMIMEheader)); err != nil {
 		return err
 	}
@@ -224,12 +404,17 @@ func (m *Mail) WriteEncrypted(w io.Writer, to *Account, signer *Account) error {
 		return err
 	}
 
-	plainTextWriter, err := Encrypt(pgpBodyPart, to, signer)
+	plainTextWriter, err := keys.encrypt(pgpBodyPart, true)
 	if err != nil {
 		return err
 	}
 
-	if err := m.writeBody(plainTextWriter); err != nil {
+	if nested {
+		err = writeMultipartSigned(plainTextWriter, content, mime_pgpsignature, pgpMicalg(keys.config.Hash()), sig)
+	} else {
+		err = m.writeEntity(plainTextWriter, true)
+	}
+	if err != nil {
 		return err
 	}
 
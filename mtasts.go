@@ -0,0 +1,290 @@
+package MIMEMail
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// maxMTASTSPolicySize limits the size of fetched MTA-STS policies (RFC 8461 3.3).
+const maxMTASTSPolicySize = 64 << 10
+
+// maxMTASTSMaxAge is the maximum max_age of MTA-STS policies (RFC 8461 3.2).
+const maxMTASTSMaxAge = 31557600 * time.Second
+
+// HTTPGetter fetches URLs, *http.Client implements it.
+// Provide your own implementation to use a different HTTP client or for testing.
+type HTTPGetter interface {
+	Get(url string) (*http.Response, error)
+}
+
+// MTASTSMode is the mode of a MTA-STS policy.
+type MTASTSMode string
+
+// Valid MTASTSMode values
+const (
+	// MTASTSEnforce requires delivery to a MX host matching the policy, using TLS with a valid certificate.
+	MTASTSEnforce MTASTSMode = "enforce"
+
+	// MTASTSTesting only asks for failures to be reported, delivery continues as usual.
+	MTASTSTesting MTASTSMode = "testing"
+
+	// MTASTSNone means the domain has no (longer an) active policy.
+	MTASTSNone MTASTSMode = "none"
+)
+
+// MTASTSPolicy is the MTA-STS policy of a domain (RFC 8461).
+type MTASTSPolicy struct {
+	// ID is the id of the _mta-sts TXT record the policy was fetched for.
+	ID string
+
+	Mode MTASTSMode
+
+	// MX holds the allowed MX host patterns, they may start with a "*." wildcard label.
+	MX []string
+
+	MaxAge time.Duration
+
+	// Expires is the time until which the policy may be cached.
+	Expires time.Time
+}
+
+// Match reports whether the MX host matches one of the policy's MX patterns (RFC 8461 4.1).
+func (p *MTASTSPolicy) Match(host string) bool {
+	host = strings.ToLower(strings.TrimSuffix(host, "."))
+	for _, pattern := range p.MX {
+		pattern = strings.ToLower(strings.TrimSuffix(pattern, "."))
+		if strings.HasPrefix(pattern, "*.") {
+			// the wildcard matches only the left-most label.
+			if i := strings.Index(host, "."); i > 0 && host[i:] == pattern[1:] {
+				return true
+			}
+		} else if host == pattern {
+			return true
+		}
+	}
+	return false
+}
+
+// MTASTS looks up and caches the MTA-STS policies (RFC 8461) of recipient domains, for delivering
+// mail to their MX hosts directly (see Enforce).
+type MTASTS struct {
+	// Resolver is used to look up the _mta-sts TXT records, net.DefaultResolver is used if it is nil.
+	Resolver TXTResolver
+
+	// Client is used to fetch the policies, http.DefaultClient is used if it is nil.
+	Client HTTPGetter
+
+	mu       sync.Mutex
+	policies map[string]*MTASTSPolicy
+}
+
+// Policy returns the MTA-STS policy of domain, nil if it has none. Policies are cached until they
+// expire and only fetched again if the id of the TXT record changes. If the TXT record can't be
+// found or the new policy can't be fetched, the cached policy is used as long as it is valid.
+// Else the error is returned, mail should be delivered as if there was no policy then (RFC 8461 5).
+func (s *MTASTS) Policy(ctx context.Context, domain string) (*MTASTSPolicy, error) {
+	domain = strings.ToLower(strings.TrimSuffix(domain, "."))
+	now := time.Now()
+	cached := s.cached(domain, now)
+
+	id, err := s.lookupID(ctx, domain)
+	if err != nil || id == "" {
+		if cached != nil {
+			return cached, nil
+		}
+		if dnsErr, ok := err.(*net.DNSError); ok && dnsErr.IsNotFound {
+			return nil, nil
+		}
+		return nil, err
+	}
+	if cached != nil && cached.ID == id {
+		return cached, nil
+	}
+
+	policy, err := s.fetch(domain, now)
+	if err != nil {
+		if cached != nil {
+			return cached, nil
+		}
+		return nil, err
+	}
+	policy.ID = id
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.policies == nil {
+		s.policies = make(map[string]*MTASTSPolicy)
+	}
+	s.policies[domain] = policy
+	return policy, nil
+}
+
+// Enforce applies the MTA-STS policy of domain to server, a MX host of domain: if the policy's
+// mode is MTASTSEnforce, a MTASTSViolation error is returned if server's Host doesn't match
+// the policy, else STARTTLS is required with TLS 1.2 or higher and a valid certificate for Host
+// (see TLSPolicy).
+// It returns the policy, which is nil if domain has none or it couldn't be determined.
+func (s *MTASTS) Enforce(ctx context.Context, domain string, server *Server) (*MTASTSPolicy, error) {
+	policy, _ := s.Policy(ctx, domain)
+	if policy == nil || policy.Mode != MTASTSEnforce {
+		return policy, nil
+	}
+
+	if !policy.Match(server.Host) {
+		return policy, MTASTSViolation{Domain: domain, MX: server.Host}
+	}
+	server.TLSPolicy = TLSRequired
+	if server.MinTLSVersion < tls.VersionTLS12 {
+		server.MinTLSVersion = tls.VersionTLS12
+	}
+	if server.Config != nil && (server.Config.InsecureSkipVerify || server.Config.ServerName != "") {
+		config := server.Config.Clone()
+		config.InsecureSkipVerify = false
+		config.ServerName = ""
+		server.Config = config
+	}
+	return policy, nil
+}
+
+// cached returns the cached policy of domain, if it hasn't expired at now.
+func (s *MTASTS) cached(domain string, now time.Time) *MTASTSPolicy {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if p, ok := s.policies[domain]; ok && now.Before(p.Expires) {
+		return p
+	}
+	return nil
+}
+
+// lookupID returns the id of domain's _mta-sts TXT record, "" if there is no valid one.
+func (s *MTASTS) lookupID(ctx context.Context, domain string) (string, error) {
+	resolver := s.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+	txts, err := resolver.LookupTXT(ctx, "_mta-sts."+domain)
+	if err != nil {
+		return "", err
+	}
+
+	var records []string
+	for _, txt := range txts {
+		if strings.HasPrefix(txt, "v=STSv1") {
+			records = append(records, txt)
+		}
+	}
+	// multiple records are treated as if there was none (RFC 8461 3.1).
+	if len(records) != 1 {
+		return "", nil
+	}
+	for _, field := range strings.Split(records[0], ";") {
+		field = strings.TrimSpace(field)
+		if strings.HasPrefix(field, "id=") {
+			return field[len("id="):], nil
+		}
+	}
+	return "", nil
+}
+
+// fetch fetches the policy of domain from the policy host (RFC 8461 3.3).
+func (s *MTASTS) fetch(domain string, now time.Time) (*MTASTSPolicy, error) {
+	client := s.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	if c, ok := client.(*http.Client); ok {
+		// redirects must not be followed.
+		noRedirect := *c
+		noRedirect.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+		client = &noRedirect
+	}
+
+	url := "https://mta-sts." + domain + "/.well-known/mta-sts.txt"
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("fetching %s: %s", url, resp.Status)
+	}
+	if resp.Request != nil && resp.Request.URL.String() != url {
+		return nil, fmt.Errorf("fetching %s: redirected to %s", url, resp.Request.URL)
+	}
+	if mediatype, _, _ := mime.ParseMediaType(resp.Header.Get(content_type)); mediatype != mime_text {
+		return nil, fmt.Errorf("fetching %s: unexpected Content-Type %q", url, resp.Header.Get(content_type))
+	}
+
+	policy, err := parseMTASTSPolicy(io.LimitReader(resp.Body, maxMTASTSPolicySize))
+	if err != nil {
+		return nil, err
+	}
+	policy.Expires = now.Add(policy.MaxAge)
+	return policy, nil
+}
+
+// parseMTASTSPolicy parses a policy file (RFC 8461 3.2).
+func parseMTASTSPolicy(r io.Reader) (*MTASTSPolicy, error) {
+	policy := new(MTASTSPolicy)
+	var version string
+	maxAge := -1
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		i := strings.Index(line, ":")
+		if i < 0 {
+			continue
+		}
+		key, value := strings.TrimSpace(line[:i]), strings.TrimSpace(line[i+1:])
+		switch key {
+		case "version":
+			version = value
+		case "mode":
+			policy.Mode = MTASTSMode(value)
+		case "max_age":
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 0 {
+				return nil, fmt.Errorf("invalid MTA-STS max_age: %q", value)
+			}
+			maxAge = n
+		case "mx":
+			policy.MX = append(policy.MX, value)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	if version != "STSv1" {
+		return nil, fmt.Errorf("invalid MTA-STS policy version: %q", version)
+	}
+	switch policy.Mode {
+	case MTASTSEnforce, MTASTSTesting:
+		if len(policy.MX) == 0 {
+			return nil, fmt.Errorf("MTA-STS policy without mx in mode %s", policy.Mode)
+		}
+	case MTASTSNone:
+	default:
+		return nil, fmt.Errorf("invalid MTA-STS mode: %q", policy.Mode)
+	}
+	if maxAge < 0 {
+		return nil, fmt.Errorf("MTA-STS policy without max_age")
+	}
+	policy.MaxAge = time.Duration(maxAge) * time.Second
+	if policy.MaxAge > maxMTASTSMaxAge {
+		policy.MaxAge = maxMTASTSMaxAge
+	}
+	return policy, nil
+}
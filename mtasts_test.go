@@ -0,0 +1,136 @@
+package MIMEMail
+
+import (
+	"context"
+	"crypto/tls"
+	"strings"
+	"testing"
+)
+
+const testMTASTSPolicy = "version: STSv1\r\nmode: enforce\r\nmx: mail.example.com\r\nmx: *.mx.example.com\r\nmax_age: 86400\r\n"
+
+// setMTASTSPolicy serves policy as the MTA-STS policy of example.com, removing it if it's empty.
+func (w *fakeWKD) setMTASTSPolicy(policy string) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	const url = "mta-sts.example.com/.well-known/mta-sts.txt"
+	if policy == "" {
+		delete(w.keys, url)
+		return
+	}
+	w.keys[url] = []byte(policy)
+}
+
+func TestMTASTSPolicy(t *testing.T) {
+	srv := newFakeWKD(t)
+	defer srv.Close()
+	srv.setMTASTSPolicy(testMTASTSPolicy)
+
+	resolver := testResolver{records: map[string][]string{
+		"_mta-sts.example.com":  {"v=STSv1; id=20260101T000000;"},
+		"_mta-sts.multiple.com": {"v=STSv1; id=1", "v=STSv1; id=2"},
+	}}
+	sts := &MTASTS{Resolver: resolver, Client: srv.client()}
+	ctx := context.Background()
+
+	policy, err := sts.Policy(ctx, "Example.com.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if policy.ID != "20260101T000000" || policy.Mode != MTASTSEnforce || len(policy.MX) != 2 || policy.MaxAge.Hours() != 24 {
+		t.Errorf("unexpected policy: %+v", policy)
+	}
+	for host, match := range map[string]bool{
+		"mail.example.com":      true,
+		"MAIL.example.com.":     true,
+		"a.mx.example.com":      true,
+		"b.a.mx.example.com":    false,
+		"mx.example.com":        false,
+		"mail.example.com.evil": false,
+	} {
+		if policy.Match(host) != match {
+			t.Errorf("%s: expected match %t", host, match)
+		}
+	}
+
+	// the policy is cached while the id stays the same.
+	requests := srv.count()
+	if cached, err := sts.Policy(ctx, "example.com"); err != nil || cached != policy || srv.count() != requests {
+		t.Errorf("policy not cached: %v", err)
+	}
+	// a changed id causes a new fetch, the cached policy is used if that fails.
+	srv.setMTASTSPolicy("")
+	resolver.records["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	if cached, err := sts.Policy(ctx, "example.com"); err != nil || cached != policy || srv.count() != requests+1 {
+		t.Errorf("expected the cached policy: %v", err)
+	}
+
+	for _, domain := range []string{"none.com", "multiple.com"} {
+		if p, err := sts.Policy(ctx, domain); p != nil || err != nil {
+			t.Errorf("%s: expected no policy, got %+v, %v", domain, p, err)
+		}
+	}
+
+	resolver.records["_mta-sts.invalid.com"] = []string{"v=STSv1; id=1"}
+	if _, err := sts.Policy(ctx, "invalid.com"); err == nil {
+		t.Error("expected an error for a missing policy file")
+	}
+	for _, invalid := range []string{
+		"version: STSv1\nmode: enforce\nmax_age: 60\n",
+		"version: STSv2\nmode: enforce\nmx: mail.example.com\nmax_age: 60\n",
+		"version: STSv1\nmode: strict\nmx: mail.example.com\nmax_age: 60\n",
+		"version: STSv1\nmode: testing\nmx: mail.example.com\n",
+	} {
+		if _, err := parseMTASTSPolicy(strings.NewReader(invalid)); err == nil {
+			t.Errorf("accepted invalid policy %q", invalid)
+		}
+	}
+}
+
+func TestMTASTSEnforce(t *testing.T) {
+	srv := newFakeWKD(t)
+	defer srv.Close()
+	srv.setMTASTSPolicy(testMTASTSPolicy)
+	resolver := testResolver{records: map[string][]string{"_mta-sts.example.com": {"v=STSv1; id=1"}}}
+	sts := &MTASTS{Resolver: resolver, Client: srv.client()}
+	ctx := context.Background()
+
+	server := &Server{Host: "evil.example.net", Port: SMTP}
+	if _, err := sts.Enforce(ctx, "example.com", server); err != (MTASTSViolation{Domain: "example.com", MX: "evil.example.net"}) {
+		t.Errorf("expected MTASTSViolation, got %v", err)
+	}
+
+	server = &Server{Host: "a.mx.example.com", Port: SMTP, Config: &tls.Config{InsecureSkipVerify: true}}
+	if _, err := sts.Enforce(ctx, "example.com", server); err != nil {
+		t.Fatal(err)
+	}
+	if server.TLSPolicy != TLSRequired || server.MinTLSVersion != tls.VersionTLS12 || server.TLSConfig().InsecureSkipVerify {
+		t.Errorf("TLS not required: %+v", server)
+	}
+
+	// in testing mode nothing is enforced.
+	srv.setMTASTSPolicy(strings.Replace(testMTASTSPolicy, "enforce", "testing", 1))
+	resolver.records["_mta-sts.example.com"] = []string{"v=STSv1; id=2"}
+	server = &Server{Host: "evil.example.net", Port: SMTP}
+	if policy, err := sts.Enforce(ctx, "example.com", server); err != nil || policy.Mode != MTASTSTesting || server.TLSPolicy != TLSOpportunistic {
+		t.Errorf("expected the testing policy to be ignored: %+v, %v", policy, err)
+	}
+
+	// delivery to a MX host without STARTTLS fails with an enforced policy.
+	srv.setMTASTSPolicy("version: STSv1\nmode: enforce\nmx: 127.0.0.1\nmax_age: 60\n")
+	resolver.records["_mta-sts.example.com"] = []string{"v=STSv1; id=3"}
+	smtpSrv := newFakeSMTP(t)
+	defer smtpSrv.Close()
+	acc := smtpSrv.account()
+	if _, err := sts.Enforce(ctx, "example.com", acc.Server); err != nil {
+		t.Fatal(err)
+	}
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if err := c.Send(MessageFactory(), NewEnvelope(acc.Address, "receiver@example.com")); err != (StartTLSFailed{Host: "127.0.0.1"}) {
+		t.Errorf("expected StartTLSFailed, got %v", err)
+	}
+}
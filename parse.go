@@ -0,0 +1,187 @@
+package MIMEMail
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net/textproto"
+	"strings"
+)
+
+// ReadPart parses the MIME entity read from r (e.g. a complete raw message) into a tree
+// of MIMEParts. The body of every leaf part is kept as is, use Content to obtain
+// it with the Content-Transfer-Encoding removed. The sub parts of multipart
+// entities can be obtained with Parts.
+func ReadPart(r io.Reader) (*MIMEPart, error) {
+	raw, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	return parsePart(raw)
+}
+
+// parsePart parses raw (header and body) into a MIMEPart.
+func parsePart(raw []byte) (*MIMEPart, error) {
+	head, body := splitHeader(raw)
+
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(head), strings.NewReader("\r\n"))))
+	header, err := tp.ReadMIMEHeader()
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	if header == nil {
+		header = make(textproto.MIMEHeader)
+	}
+
+	p := &MIMEPart{MIMEHeader: header, Buffer: bytes.NewBuffer(body), raw: raw}
+
+	mediatype, params := p.MediaType()
+	if !strings.HasPrefix(mediatype, "multipart/") {
+		return p, nil
+	}
+	if params["boundary"] == "" {
+		return nil, fmt.Errorf("%s part without boundary", mediatype)
+	}
+
+	for _, rawPart := range splitMultipart(body, params["boundary"]) {
+		sub, err := parsePart(rawPart)
+		if err != nil {
+			return nil, err
+		}
+		p.parts = append(p.parts, sub)
+	}
+	return p, nil
+}
+
+// splitHeader splits raw at the first empty line into header and body.
+func splitHeader(raw []byte) (header, body []byte) {
+	for i := 0; i < len(raw); {
+		end := bytes.IndexByte(raw[i:], '\n')
+		if end < 0 {
+			return raw, nil
+		}
+		line := raw[i : i+end]
+		next := i + end + 1
+		if len(bytes.TrimRight(line, "\r")) == 0 {
+			return raw[:i], raw[next:]
+		}
+		i = next
+	}
+	return raw, nil
+}
+
+// splitMultipart returns the raw sub parts of a multipart body delimited by boundary.
+// The line break preceding a delimiter line belongs to the delimiter (RFC 2046 5.1.1)
+// and is therefore not part of the returned parts.
+func splitMultipart(body []byte, boundary string) [][]byte {
+	delim := []byte("--" + boundary)
+
+	var (
+		parts [][]byte
+		start = -1
+	)
+	for i := 0; i < len(body); {
+		end := bytes.IndexByte(body[i:], '\n')
+		next := len(body)
+		if end >= 0 {
+			next = i + end + 1
+		}
+		line := bytes.TrimRight(body[i:next], " \t\r\n")
+
+		if bytes.HasPrefix(line, delim) {
+			rest := line[len(delim):]
+			closing := bytes.Equal(rest, []byte("--"))
+			if closing || len(rest) == 0 {
+				if start >= 0 {
+					parts = append(parts, trimLineBreak(body[start:i]))
+				}
+				if closing {
+					return parts
+				}
+				start = next
+			}
+		}
+		i = next
+	}
+
+	// missing closing delimiter, be lenient.
+	if start >= 0 && start < len(body) {
+		parts = append(parts, body[start:])
+	}
+	return parts
+}
+
+// trimLineBreak removes a single trailing line break from b.
+func trimLineBreak(b []byte) []byte {
+	b = bytes.TrimSuffix(b, []byte("\n"))
+	return bytes.TrimSuffix(b, []byte("\r"))
+}
+
+// MediaType returns the lower case media type and parameters of the part's
+// Content-Type, defaulting to text/plain.
+func (p *MIMEPart) MediaType() (string, map[string]string) {
+	ct := p.Get(content_type)
+	if ct == "" {
+		return mime_text, map[string]string{}
+	}
+
+	mediatype, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		// be lenient with broken parameters, the media type is what matters most.
+		mediatype = strings.ToLower(strings.TrimSpace(strings.SplitN(ct, ";", 2)[0]))
+		return mediatype, map[string]string{}
+	}
+	return mediatype, params
+}
+
+// Parts returns the sub parts of a multipart part, it returns nil for non multipart parts.
+func (p *MIMEPart) Parts() []*MIMEPart {
+	return p.parts
+}
+
+// Content returns the body of the part with the Content-Transfer-Encoding
+// (base64 or quoted-printable) removed.
+func (p *MIMEPart) Content() ([]byte, error) {
+	var r io.Reader = bytes.NewReader(p.Bytes())
+	switch strings.ToLower(strings.TrimSpace(p.Get(content_transfer_encoding))) {
+	case mime_base64:
+		r = base64.NewDecoder(base64.StdEncoding, r)
+	case "quoted-printable":
+		r = quotedprintable.NewReader(r)
+	}
+	return ioutil.ReadAll(r)
+}
+
+// walk calls fn for p and all of it's descendants (depth first) until fn returns false.
+func (p *MIMEPart) walk(fn func(*MIMEPart) bool) bool {
+	if !fn(p) {
+		return false
+	}
+	for _, sub := range p.parts {
+		if !sub.walk(fn) {
+			return false
+		}
+	}
+	return true
+}
+
+// find returns the first part (depth first) with the given media type or nil.
+func (p *MIMEPart) find(mediatypes ...string) *MIMEPart {
+	var found *MIMEPart
+	p.walk(func(part *MIMEPart) bool {
+		mt, _ := part.MediaType()
+		for _, mediatype := range mediatypes {
+			if mt == mediatype {
+				found = part
+				return false
+			}
+		}
+		return true
+	})
+	return found
+}
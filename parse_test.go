@@ -0,0 +1,46 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestReadPart(t *testing.T) {
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello\r\n"))
+	if err := m.AddReader("short_attachment.txt", bytes.NewBufferString(shortAttachment)); err != nil {
+		t.Fatal(err)
+	}
+
+	b, err := m.Bytes()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadPart(bytes.NewReader(b))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if mt, _ := p.MediaType(); mt != mime_multipart {
+		t.Fatalf("expected %s, got %s", mime_multipart, mt)
+	}
+	if p.Get("Mime-Version") != "1.0" {
+		t.Errorf("header not parsed: %v", p.MIMEHeader)
+	}
+	if len(p.Parts()) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(p.Parts()))
+	}
+
+	if body := p.Parts()[0].String(); body != "hello\r\n" {
+		t.Errorf("unexpected body: %q", body)
+	}
+
+	att, err := p.Parts()[1].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(att) != shortAttachment {
+		t.Errorf("unexpected attachment content: %q", att)
+	}
+}
@@ -5,9 +5,12 @@ import (
 	"encoding/base64"
 	"fmt"
 	"io"
+	"mime/multipart"
+	"mime/quotedprintable"
 	"net/textproto"
 	"os"
 	"path/filepath"
+	"strings"
 )
 
 const (
@@ -21,6 +24,7 @@ const (
 	mime_octetstream          = "application/octet-stream"
 	content_transfer_encoding = "Content-Transfer-Encoding"
 	mime_base64               = "base64"
+	mime_quotedprintable      = "quoted-printable"
 
 	content_disposition = "Content-Disposition"
 	mime_attachment     = "attachment"
@@ -31,13 +35,19 @@ const (
 type MIMEPart struct {
 	textproto.MIMEHeader
 	*bytes.Buffer
+
+	// sub parts of multipart parts
+	parts []*MIMEPart
+
+	// the unmodified part (header and body) as read by ReadPart
+	raw []byte
 }
 
 // NewMIMEPart creates a new blank MIMEPart.
 func NewMIMEPart() *MIMEPart {
 	return &MIMEPart{
-		make(textproto.MIMEHeader),
-		bytes.NewBuffer(nil),
+		MIMEHeader: make(textproto.MIMEHeader),
+		Buffer:     bytes.NewBuffer(nil),
 	}
 }
 
@@ -58,11 +68,104 @@ func NewPlainText() *MIMEPart {
 	return NewPart(mime_text, mime_utf8)
 }
 
+// NewMultipart creates a new multipart MIMEPart of the given subtype (e.g. "alternative")
+// containing parts. The sub parts are encoded when the part is written, so they
+// can still be written to after creating the multipart part.
+func NewMultipart(subtype string, parts ...*MIMEPart) *MIMEPart {
+	p := NewMIMEPart()
+	p.Set(content_type, fmt.Sprintf("multipart/%s; boundary=%s", subtype, multipart.NewWriter(nil).Boundary()))
+	p.parts = parts
+	return p
+}
+
+// writeBody writes the body of the part to w, encoding the sub parts of multipart parts.
+func (p *MIMEPart) writeBody(w io.Writer) error {
+	if len(p.parts) == 0 {
+		_, err := w.Write(p.Bytes())
+		return err
+	}
+
+	_, params := p.MediaType()
+	mpw := multipart.NewWriter(w)
+	if err := mpw.SetBoundary(params["boundary"]); err != nil {
+		return err
+	}
+
+	for _, part := range p.parts {
+		pw, err := mpw.CreatePart(part.MIMEHeader)
+		if err != nil {
+			return err
+		}
+		if err := part.writeBody(pw); err != nil {
+			return err
+		}
+	}
+
+	return mpw.Close()
+}
+
+// sevenBit returns p, or a copy of it with the body encoded with quoted-printable (text)
+// or base64 (anything else) if it isn't 7bit data. Signed content must be 7bit (RFC 3156 3),
+// otherwise relays may encode it and break the signature.
+func (p *MIMEPart) sevenBit() *MIMEPart {
+	if len(p.parts) != 0 {
+		c := *p
+		c.parts = make([]*MIMEPart, len(p.parts))
+		for i, sub := range p.parts {
+			c.parts[i] = sub.sevenBit()
+		}
+		return &c
+	}
+
+	switch strings.ToLower(strings.TrimSpace(p.Get(content_transfer_encoding))) {
+	case "", "7bit", "8bit", "binary":
+	default:
+		// already encoded.
+		return p
+	}
+	if is7bit(p.Bytes()) {
+		return p
+	}
+
+	c := NewMIMEPart()
+	for field, values := range p.MIMEHeader {
+		c.MIMEHeader[field] = append([]string(nil), values...)
+	}
+	if mediatype, _ := p.MediaType(); strings.HasPrefix(mediatype, "text/") {
+		c.Set(content_transfer_encoding, mime_quotedprintable)
+		qp := quotedprintable.NewWriter(c.Buffer)
+		qp.Write(p.Bytes())
+		qp.Close()
+	} else {
+		c.Set(content_transfer_encoding, mime_base64)
+		c.Write(base64Lines(p.Bytes()))
+	}
+	return c
+}
+
+// is7bit reports whether data is 7bit data (RFC 2045 2.7): ASCII without NUL
+// and lines of at most 998 characters.
+func is7bit(data []byte) bool {
+	line := 0
+	for _, b := range data {
+		switch {
+		case b == 0 || b >= 0x80:
+			return false
+		case b == '\n':
+			line = 0
+		case line == 998:
+			return false
+		default:
+			line++
+		}
+	}
+	return true
+}
 
 // NewPGPVersion creates a new PGP/MIME Version header.
 func NewPGPVersion() *MIMEPart {
 	p := NewMIMEPart()
-	p.Set(content_type, "application/pgp-encrypted")
+	p.Set(content_type, mime_pgpencrypted)
 	p.Set(content_disposition, "PGP/MIME version identification")
 	p.WriteString("Version: 1\r\n")
 	return p
@@ -71,7 +174,7 @@ func NewPGPVersion() *MIMEPart {
 // NewPGPBody creates a PGP/MIME message body part.
 func NewPGPBody() *MIMEPart {
 	p := NewMIMEPart()
-	p.Set(content_type, "application/pgp-encrypted")
+	p.Set(content_type, mime_pgpencrypted)
 	p.Set(content_disposition, `inline; filename="encrypted.asc"`)
 	return p
 }
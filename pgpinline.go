@@ -0,0 +1,172 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"mime"
+	"sort"
+)
+
+// PGPMode selects the format of PGP signed and encrypted mail.
+type PGPMode int
+
+// Valid PGPMode values
+const (
+	// PGPMIME signs and encrypts mail with PGP/MIME (RFC 3156), the default.
+	PGPMIME PGPMode = iota
+
+	// PGPInline signs and encrypts mail with inline PGP for legacy clients: text/plain parts are
+	// cleartext signed or replaced with an ASCII armored PGP message, when encrypting all other
+	// parts are encrypted separately as ".pgp" attachments. Note that the header fields aren't
+	// protected in this mode.
+	PGPInline
+)
+
+// writeInlineSigned writes the mail with it's text/plain parts cleartext signed by signer (see PGPInline).
+func (m *Mail) writeInlineSigned(w io.Writer, signer *Account) error {
+	parts := m.leafParts()
+	for i, p := range parts {
+		if !isInlineText(p) {
+			continue
+		}
+
+		text, err := p.Content()
+		if err != nil {
+			return err
+		}
+		var signed bytes.Buffer
+		plain, err := ClearSign(&signed, signer)
+		if err != nil {
+			return err
+		}
+		if _, err := plain.Write(text); err != nil {
+			return err
+		}
+		if err := plain.Close(); err != nil {
+			return err
+		}
+		parts[i] = inlineText(p, signed.Bytes())
+	}
+	return m.writeInline(w, parts)
+}
+
+// writeInlineEncrypted writes the mail encrypted for the accounts in to with inline PGP (see PGPInline).
+func (m *Mail) writeInlineEncrypted(w io.Writer, to []*Account, signer *Account) error {
+	keys, err := encryptionKeys(to, signer)
+	if err != nil {
+		return err
+	}
+
+	parts := m.leafParts()
+	for i, p := range parts {
+		content, err := p.Content()
+		if err != nil {
+			return err
+		}
+
+		inline := isInlineText(p)
+		var enc bytes.Buffer
+		plain, err := keys.encrypt(&enc, inline)
+		if err != nil {
+			return err
+		}
+		if _, err := plain.Write(content); err != nil {
+			return err
+		}
+		if err := plain.Close(); err != nil {
+			return err
+		}
+
+		if inline {
+			parts[i] = inlineText(p, enc.Bytes())
+			continue
+		}
+		att := NewMIMEPart()
+		att.Set(content_type, mime_octetstream)
+		att.Set(content_transfer_encoding, mime_base64)
+		att.Set(content_disposition, fmt.Sprintf("%s; filename=%q", mime_attachment, partFilename(p, i)+".pgp"))
+		att.Write(base64Lines(enc.Bytes()))
+		parts[i] = att
+	}
+	return m.writeInline(w, parts)
+}
+
+// writeInline writes the mail with the given parts. A single part is written as the body
+// of the mail, as legacy clients may only look for PGP blocks there.
+func (m *Mail) writeInline(w io.Writer, parts []*MIMEPart) error {
+	if len(parts) != 1 {
+		inline := *m
+		inline.parts = parts
+		inline.contentType = ""
+		return inline.write(w)
+	}
+
+	if err := m.writeHeader(w); err != nil {
+		return err
+	}
+	fields := make([]string, 0, len(parts[0].MIMEHeader))
+	for field := range parts[0].MIMEHeader {
+		fields = append(fields, field)
+	}
+	sort.Strings(fields)
+	for _, field := range fields {
+		for _, value := range parts[0].MIMEHeader[field] {
+			if _, err := fmt.Fprintf(w, "%s: %s\r\n", field, value); err != nil {
+				return err
+			}
+		}
+	}
+	if _, err := w.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+	_, err := w.Write(parts[0].Bytes())
+	return err
+}
+
+// leafParts returns the non multipart parts of the mail, multipart parts are flattened.
+func (m *Mail) leafParts() []*MIMEPart {
+	var leaves []*MIMEPart
+	for _, part := range m.parts {
+		part.walk(func(p *MIMEPart) bool {
+			if len(p.parts) == 0 {
+				leaves = append(leaves, p)
+			}
+			return true
+		})
+	}
+	return leaves
+}
+
+// isInlineText reports whether p is a text/plain body part, which is signed or encrypted inline.
+func isInlineText(p *MIMEPart) bool {
+	mediatype, _ := p.MediaType()
+	disposition, _, _ := mime.ParseMediaType(p.Get(content_disposition))
+	return mediatype == mime_text && disposition != mime_attachment
+}
+
+// inlineText returns a copy of the text part p with the PGP block armored as body.
+func inlineText(p *MIMEPart, armored []byte) *MIMEPart {
+	text := NewMIMEPart()
+	for field, values := range p.MIMEHeader {
+		text.MIMEHeader[field] = values
+	}
+	text.Del(content_transfer_encoding)
+	text.Write(toCRLF(armored))
+	return text
+}
+
+// partFilename returns the filename of the i'th part p, or a generic one if it has none.
+func partFilename(p *MIMEPart, i int) string {
+	if _, params, err := mime.ParseMediaType(p.Get(content_disposition)); err == nil && params["filename"] != "" {
+		return params["filename"]
+	}
+	mediatype, params := p.MediaType()
+	if params["name"] != "" {
+		return params["name"]
+	}
+	if exts, _ := mime.ExtensionsByType(mediatype); len(exts) != 0 {
+		return fmt.Sprintf("part%d%s", i+1, exts[0])
+	}
+	return fmt.Sprintf("part%d", i+1)
+}
@@ -0,0 +1,129 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	"golang.org/x/crypto/openpgp/clearsign"
+)
+
+// readInline decrypts the (ASCII armored if armored is true) inline PGP message enc with keys,
+// checking the signature if it is signed.
+func readInline(t *testing.T, enc []byte, armored bool, keys openpgp.EntityList) []byte {
+	t.Helper()
+	var r io.Reader = bytes.NewReader(enc)
+	if armored {
+		block, err := armor.Decode(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		r = block.Body
+	}
+	md, err := openpgp.ReadMessage(r, keys, nil, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !md.IsSigned || md.SignedBy == nil || md.SignatureError != nil {
+		t.Errorf("expected a valid signature: %v", md.SignatureError)
+	}
+	return plain
+}
+
+func TestMailInlineSigned(t *testing.T) {
+	key, pub := testPGP(t, "foobar@example.com")
+	sender := &Account{Address: "foobar@example.com", Key: key}
+	keys, _ := openpgp.ReadArmoredKeyRing(strings.NewReader(pub))
+
+	m := MessageFactory()
+	m.PGPMode = PGPInline
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+	signed, err := m.Sign(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadPart(bytes.NewReader(signed))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediatype, _ := p.MediaType(); mediatype != mime_text {
+		t.Fatalf("expected a text/plain body, got %s", p.Get(content_type))
+	}
+	if !bytes.HasPrefix(p.Bytes(), []byte("-----BEGIN PGP SIGNED MESSAGE-----\r\n")) {
+		t.Fatalf("expected a cleartext signed body:\n%s", p.Bytes())
+	}
+	block, _ := clearsign.Decode(p.Bytes())
+	if block == nil {
+		t.Fatal("no cleartext signed message found")
+	}
+	if _, err := openpgp.CheckDetachedSignature(keys, bytes.NewReader(block.Bytes), block.ArmoredSignature.Body); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+	if string(block.Plaintext) != "hello\nworld\n" {
+		t.Errorf("unexpected text: %q", block.Plaintext)
+	}
+}
+
+func TestMailInlineEncrypted(t *testing.T) {
+	senderKey, senderPub := testPGP(t, "foobar@example.com")
+	sender := &Account{Address: "foobar@example.com", Key: senderKey}
+	receiverKey, receiverPub := testPGP(t, "receiver@example.com")
+
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(receiverKey.Key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	senderKeys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(senderPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	keys = append(keys, senderKeys...)
+
+	m := MessageFactory()
+	m.PGPMode = PGPInline
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+	m.AddReader("data.bin", strings.NewReader("abcdef"))
+	enc, err := m.Encrypt(&Account{Address: "receiver@example.com", Key: &PGP{Key: receiverPub}}, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	p, err := ReadPart(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Get("Subject") != m.Subject {
+		t.Errorf("unexpected Subject: %q", p.Get("Subject"))
+	}
+	parts := p.Parts()
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d:\n%s", len(parts), enc)
+	}
+
+	if mediatype, _ := parts[0].MediaType(); mediatype != mime_text || !bytes.HasPrefix(parts[0].Bytes(), []byte("-----BEGIN PGP MESSAGE-----\r\n")) {
+		t.Fatalf("expected an inline PGP message:\n%s", parts[0].raw)
+	}
+	if text := readInline(t, parts[0].Bytes(), true, keys); string(text) != "hello\nworld\n" {
+		t.Errorf("unexpected text: %q", text)
+	}
+
+	if filename := partFilename(parts[1], 1); filename != "data.bin.pgp" {
+		t.Errorf("unexpected attachment filename: %s", filename)
+	}
+	att, err := parts[1].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data := readInline(t, att, false, keys); string(data) != "abcdef" {
+		t.Errorf("unexpected attachment: %q", data)
+	}
+}
@@ -0,0 +1,368 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime/multipart"
+	"net/mail"
+	"net/textproto"
+	"sort"
+	"strings"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+const (
+	mime_pgpsignature = "application/pgp-signature"
+	mime_pgpencrypted = "application/pgp-encrypted"
+)
+
+// SignMode selects how PGP/MIME encrypted mail is signed.
+type SignMode int
+
+// Valid SignMode values
+const (
+	// SignCombined signs the mail inside the encrypted OpenPGP message (RFC 3156 6.2), the default.
+	SignCombined SignMode = iota
+
+	// SignNested signs the mail with PGP/MIME (multipart/signed) before encrypting it
+	// (RFC 3156 6.1), as some clients only show these signatures.
+	SignNested
+)
+
+// Sign signs the mail with PGP/MIME (multipart/signed) using signer's Key, see WriteSigned.
+func (m *Mail) Sign(signer *Account) ([]byte, error) {
+	var b bytes.Buffer
+	if err := m.WriteSigned(&b, signer); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteSigned signs the mail with PGP/MIME (multipart/signed, RFC 3156) using CreateSigningEntity
+// to obtain the signing entity and writes it to w. The body is left as is and a detached
+// signature is attached, so it can be read without support for PGP.
+// If PGPMode is PGPInline, the text/plain parts are cleartext signed instead.
+func (m *Mail) WriteSigned(w io.Writer, signer *Account) error {
+	if signer == nil || signer.Key == nil {
+		return fmt.Errorf("signer and it's Key field cannot be nil!")
+	}
+	if m.PGPMode == PGPInline {
+		return m.writeInlineSigned(w, signer)
+	}
+	entity, err := CreateSigningEntity(signer)
+	if err != nil {
+		return err
+	}
+
+	content, sig, err := m.signedEntity(entity, signer.Key.Config, false)
+	if err != nil {
+		return err
+	}
+
+	if err := m.writeHeader(w); err != nil {
+		return err
+	}
+	return writeMultipartSigned(w, content, mime_pgpsignature, pgpMicalg(signer.Key.Hash()), sig)
+}
+
+// signedEntity returns the canonical body of the mail (with the protected header fields if protected is true)
+// and the part holding it's detached signature by entity, for writing them with writeMultipartSigned.
+// Parts which aren't 7bit data are encoded, as required by RFC 3156 3.
+func (m *Mail) signedEntity(entity *openpgp.Entity, config *packet.Config, protected bool) ([]byte, *MIMEPart, error) {
+	signed := *m
+	signed.parts = make([]*MIMEPart, len(m.parts))
+	for i, p := range m.parts {
+		signed.parts[i] = p.sevenBit()
+	}
+
+	var body bytes.Buffer
+	if err := signed.writeEntity(&body, protected); err != nil {
+		return nil, nil, err
+	}
+
+	// the signature covers the canonical form, so it must be sent as such.
+	content := toCRLF(body.Bytes())
+	var sig bytes.Buffer
+	if err := detachSign(&sig, entity, bytes.NewReader(content), config); err != nil {
+		return nil, nil, err
+	}
+
+	sigPart := NewMIMEPart()
+	sigPart.Set(content_type, mime_pgpsignature+`; name="signature.asc"`)
+	sigPart.Set("Content-Description", "OpenPGP digital signature")
+	sigPart.Set(content_disposition, mime_attachment+`; filename="signature.asc"`)
+	sigPart.Write(toCRLF(sig.Bytes()))
+	return content, sigPart, nil
+}
+
+// pgpMicalg returns the micalg parameter for PGP/MIME signatures made with h (e.g. "pgp-sha256").
+func pgpMicalg(h crypto.Hash) string {
+	return "pgp-" + strings.ToLower(strings.Replace(h.String(), "-", "", -1))
+}
+
+// writeMultipartSigned writes the Content-Type header and the multipart/signed body (RFC 1847)
+// consisting of the canonical MIME entity content and the signature part sig.
+func writeMultipartSigned(w io.Writer, content []byte, protocol, micalg string, sig *MIMEPart) error {
+	mpw := multipart.NewWriter(w)
+	if _, err := fmt.Fprintf(w, "%s: multipart/signed; protocol=%q; micalg=%s; boundary=%q\r\n\r\n",
+		content_type, protocol, micalg, mpw.Boundary()); err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(w, "This is a cryptographically signed message in MIME format.\r\n\r\n--%s\r\n", mpw.Boundary()); err != nil {
+		return err
+	}
+	if _, err := w.Write(content); err != nil {
+		return err
+	}
+
+	// the line break before the boundary belongs to the boundary, it isn't part of
+	// the signed content. The multipart writer omits it for the first part it creates.
+	if _, err := w.Write([]byte("\r\n")); err != nil {
+		return err
+	}
+	pw, err := mpw.CreatePart(sig.MIMEHeader)
+	if err != nil {
+		return err
+	}
+	if _, err := pw.Write(sig.Bytes()); err != nil {
+		return err
+	}
+	return mpw.Close()
+}
+
+// VerifyDetached verifies the (ASCII armored) detached PGP signature sig of content with keys,
+// e.g. the parts of a multipart/signed message. Note that PGP/MIME signatures cover the
+// canonical form (with CRLF line endings) of the signed part. The result is reported in the
+// Err field of the returned signature.
+func VerifyDetached(content, sig io.Reader, keys openpgp.EntityList) *PGPSignature {
+	c, err := ioutil.ReadAll(content)
+	if err != nil {
+		return &PGPSignature{Err: err}
+	}
+	s, err := ioutil.ReadAll(sig)
+	if err != nil {
+		return &PGPSignature{Err: err}
+	}
+	return pgpVerifyDetached(keys, c, s, "")
+}
+
+// PGPSignature holds the results of verifying a PGP signature.
+type PGPSignature struct {
+	// KeyID is the ID of the key that made the signature.
+	KeyID uint64
+
+	// Signer is the signer's key, nil if it isn't in the keyring or the signature is invalid.
+	Signer *openpgp.Entity
+
+	// UserID is the user ID of Signer matching the From address of the message,
+	// or it's primary user ID if there is none.
+	UserID string
+
+	// FromMatches reports whether a user ID of Signer matches the From
+	// address of the message. It's only set if the signature is valid.
+	FromMatches bool
+
+	// Err is nil if the signature is valid.
+	Err error
+}
+
+// PGPMessage is a received PGP/MIME message.
+type PGPMessage struct {
+	// Header holds the header of the message, with the protected header
+	// fields of the Content, if there are any.
+	Header textproto.MIMEHeader
+
+	// Content is the decrypted and/or signed MIME entity, use it's Parts
+	// method to get the parts of multipart content.
+	Content *MIMEPart
+
+	// Encrypted reports whether the message was encrypted.
+	Encrypted bool
+
+	// Signature is nil if the message isn't signed.
+	Signature *PGPSignature
+}
+
+// ReadPGP reads a PGP/MIME message from r, decrypts it with the private keys in recipient's Key
+// and verifies it's signature with keys (the public keys of the senders). recipient may be nil
+// for messages which are only signed. Messages that are neither encrypted nor signed are returned
+// as they are. Failed signature verification is reported in the Signature of the returned message,
+// not as error.
+func ReadPGP(r io.Reader, recipient *Account, keys openpgp.EntityList) (*PGPMessage, error) {
+	msg, err := ReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+
+	from := msg.Get("From")
+	res := &PGPMessage{Header: msg.MIMEHeader}
+	part := msg
+	for {
+		mediatype, params := part.MediaType()
+		switch {
+		case mediatype == "multipart/encrypted" && params["protocol"] == mime_pgpencrypted:
+			if recipient == nil || recipient.Key == nil {
+				return nil, fmt.Errorf("recipient and it's Key field cannot be nil!")
+			}
+			parts := part.Parts()
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("PGP/MIME: multipart/encrypted needs 2 parts, got %d", len(parts))
+			}
+			enc, err := parts[1].Content()
+			if err != nil {
+				return nil, err
+			}
+			content, sig, err := pgpDecrypt(enc, recipient, keys, from)
+			if err != nil {
+				return nil, err
+			}
+			res.Encrypted = true
+			if sig != nil {
+				res.Signature = sig
+			}
+			if part, err = parsePart(content); err != nil {
+				return nil, err
+			}
+
+		case mediatype == "multipart/signed" && params["protocol"] == mime_pgpsignature:
+			parts := part.Parts()
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("PGP/MIME: multipart/signed needs 2 parts, got %d", len(parts))
+			}
+			sig, err := parts[1].Content()
+			if err != nil {
+				return nil, err
+			}
+			res.Signature = pgpVerifyDetached(keys, toCRLF(parts[0].raw), sig, from)
+			part = parts[0]
+
+		default:
+			if params["protected-headers"] == "v1" {
+				res.Header = protectedHeader(res.Header, part.MIMEHeader)
+			}
+			res.Content = part
+			return res, nil
+		}
+	}
+}
+
+// protectedHeader returns header with the fields replaced by the protected header fields
+// in the header of the content part.
+func protectedHeader(header, content textproto.MIMEHeader) textproto.MIMEHeader {
+	h := make(textproto.MIMEHeader, len(header))
+	for field, values := range header {
+		h[field] = values
+	}
+	for field, values := range content {
+		if !strings.HasPrefix(field, "Content-") {
+			h[field] = values
+		}
+	}
+	return h
+}
+
+// pgpDecrypt decrypts the armored PGP message enc with recipient's private keys. If it's signed
+// the signature is verified with keys.
+func pgpDecrypt(enc []byte, recipient *Account, keys openpgp.EntityList, from string) ([]byte, *PGPSignature, error) {
+	private, err := privateKeyRing(recipient)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	block, err := armor.Decode(bytes.NewReader(enc))
+	if err != nil {
+		return nil, nil, err
+	}
+	ring := append(append(openpgp.EntityList{}, private...), keys...)
+	md, err := openpgp.ReadMessage(block.Body, ring, nil, recipient.Key.Config)
+	if err != nil {
+		return nil, nil, err
+	}
+	content, err := ioutil.ReadAll(md.UnverifiedBody)
+	if err != nil {
+		return nil, nil, err
+	}
+	if !md.IsSigned {
+		return content, nil, nil
+	}
+
+	sig := &PGPSignature{KeyID: md.SignedByKeyId, Err: md.SignatureError}
+	if md.SignedBy == nil {
+		sig.Err = pgperrors.ErrUnknownIssuer
+	} else if sig.Err == nil {
+		sig.setSigner(md.SignedBy.Entity, from)
+	}
+	return content, sig, nil
+}
+
+// pgpVerifyDetached verifies the armored detached signature sig of content with keys.
+func pgpVerifyDetached(keys openpgp.EntityList, content, sig []byte, from string) *PGPSignature {
+	res := new(PGPSignature)
+	block, err := armor.Decode(bytes.NewReader(sig))
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	p, err := packet.Read(block.Body)
+	if err != nil {
+		res.Err = err
+		return res
+	}
+	switch s := p.(type) {
+	case *packet.Signature:
+		if s.IssuerKeyId != nil {
+			res.KeyID = *s.IssuerKeyId
+		}
+	case *packet.SignatureV3:
+		res.KeyID = s.IssuerKeyId
+	default:
+		res.Err = pgperrors.StructuralError("non signature packet found")
+		return res
+	}
+
+	signer, err := openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(content), bytes.NewReader(sig))
+	res.Err = err
+	if err == nil {
+		res.setSigner(signer, from)
+	}
+	return res
+}
+
+// setSigner sets the Signer and UserID of s and matches Signer's user IDs with from.
+// Without a primary user ID, the first one in sort order is used, so the result is stable.
+func (s *PGPSignature) setSigner(e *openpgp.Entity, from string) {
+	s.Signer = e
+	names := make([]string, 0, len(e.Identities))
+	for name := range e.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if sig := e.Identities[name].SelfSignature; sig != nil && sig.IsPrimaryId != nil && *sig.IsPrimaryId {
+			s.UserID = name
+			break
+		}
+	}
+	if s.UserID == "" && len(names) != 0 {
+		s.UserID = names[0]
+	}
+	addrs, _ := mail.ParseAddressList(from)
+	for _, name := range names {
+		id := e.Identities[name]
+		for _, addr := range addrs {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, addr.Address) {
+				s.UserID = name
+				s.FromMatches = true
+				return
+			}
+		}
+	}
+}
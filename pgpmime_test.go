@@ -0,0 +1,425 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"errors"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+	pgperrors "golang.org/x/crypto/openpgp/errors"
+	"golang.org/x/crypto/openpgp/packet"
+)
+
+// testPGP creates a new key for address, returning the PGP config holding the private
+// key and the armored public key.
+func testPGP(t *testing.T, address string) (*PGP, string) {
+	priv, pub := armorEntity(t, testPGPEntity(t, address))
+	return &PGP{Key: priv}, pub
+}
+
+// testPGPEntity creates a new key with an encryption subkey for address.
+func testPGPEntity(t *testing.T, address string) *openpgp.Entity {
+	e, err := openpgp.NewEntity("", "", address, &packet.Config{DefaultHash: crypto.SHA256, DefaultCipher: packet.CipherAES256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+// armorEntity returns the ASCII armored private and public keys of e.
+func armorEntity(t *testing.T, e *openpgp.Entity) (priv, pub string) {
+	var privBuf, pubBuf bytes.Buffer
+	w, err := armor.Encode(&privBuf, openpgp.PrivateKeyType, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.SerializePrivate(w, nil); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	if w, err = armor.Encode(&pubBuf, openpgp.PublicKeyType, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.Serialize(w); err != nil {
+		t.Fatal(err)
+	}
+	w.Close()
+
+	return privBuf.String(), pubBuf.String()
+}
+
+// checkPGPSigned checks that msg is a PGP/MIME signed message with a valid signature by the key pub.
+func checkPGPSigned(t *testing.T, msg []byte, pub string) *MIMEPart {
+	t.Helper()
+	p, err := ReadPart(bytes.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	mediatype, params := p.MediaType()
+	if mediatype != "multipart/signed" || params["protocol"] != mime_pgpsignature || params["micalg"] != "pgp-sha256" {
+		t.Fatalf("unexpected Content-Type: %s", p.Get(content_type))
+	}
+	parts := p.Parts()
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(parts))
+	}
+
+	keys, err := openpgp.ReadArmoredKeyRing(strings.NewReader(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sig, err := parts[1].Content()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(parts[0].raw), bytes.NewReader(sig)); err != nil {
+		t.Errorf("invalid signature: %v", err)
+	}
+	return parts[0]
+}
+
+func TestMailSign(t *testing.T) {
+	key, pub := testPGP(t, "sender@example.com")
+	sender := &Account{Address: "sender@example.com", Key: key}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+	signed, err := m.Sign(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(signed, []byte("Subject: ")) {
+		t.Errorf("header missing:\n%s", signed)
+	}
+
+	body := checkPGPSigned(t, signed, pub)
+	if !bytes.Contains(body.raw, []byte("hello\r\nworld\r\n")) {
+		t.Errorf("body not canonicalized:\n%q", body.raw)
+	}
+
+	_, other := testPGP(t, "other@example.com")
+	keys, _ := openpgp.ReadArmoredKeyRing(strings.NewReader(other))
+	p, _ := ReadPart(bytes.NewReader(signed))
+	sig, _ := p.Parts()[1].Content()
+	if _, err := openpgp.CheckArmoredDetachedSignature(keys, bytes.NewReader(body.raw), bytes.NewReader(sig)); err == nil {
+		t.Error("signature verified with the wrong key")
+	}
+
+	if _, err := m.Sign(&Account{}); err == nil {
+		t.Error("expected an error without a key")
+	}
+}
+
+func TestMailSign7bit(t *testing.T) {
+	key, pub := testPGP(t, "sender@example.com")
+	sender := &Account{Address: "sender@example.com", Key: key}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("Grüße\n"))
+	img := NewMIMEPart()
+	img.Set(content_type, "image/png")
+	img.Write([]byte{0x89, 'P', 'N', 'G', 0, '\r', '\n'})
+	m.parts = append(m.parts, img)
+
+	signed, err := m.Sign(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body := checkPGPSigned(t, signed, pub)
+	if !is7bit(body.raw) {
+		t.Errorf("signed content isn't 7bit:\n%q", body.raw)
+	}
+	parts := body.Parts()
+	if len(parts) != 2 {
+		t.Fatalf("expected 2 parts, got %d", len(parts))
+	}
+	for i, exp := range []struct{ encoding, content string }{
+		{mime_quotedprintable, "Grüße\r\n"},
+		{mime_base64, "\x89PNG\x00\r\n"},
+	} {
+		content, err := parts[i].Content()
+		if err != nil || parts[i].Get(content_transfer_encoding) != exp.encoding || string(content) != exp.content {
+			t.Errorf("part %d: unexpected %s content %q (%v)", i, parts[i].Get(content_transfer_encoding), content, err)
+		}
+	}
+
+	// the mail itself isn't changed.
+	if m.parts[0].Get(content_transfer_encoding) != "" || m.parts[0].String() != "Grüße\n" {
+		t.Errorf("mail part has been modified: %v %q", m.parts[0].MIMEHeader, m.parts[0].String())
+	}
+}
+
+// failingWriter fails the write exceeding the first n bytes, later writes succeed.
+type failingWriter struct {
+	n      int
+	failed bool
+}
+
+func (w *failingWriter) Write(p []byte) (int, error) {
+	if w.failed {
+		return len(p), nil
+	}
+	if len(p) > w.n {
+		w.failed = true
+		return w.n, errors.New("write failed")
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+func TestWriteMultipartSignedErrors(t *testing.T) {
+	sig := NewMIMEPart()
+	sig.Set(content_type, mime_pgpsignature)
+	sig.Write([]byte("signature"))
+	content := []byte("Content-Type: text/plain\r\n\r\nhello\r\n")
+
+	var full bytes.Buffer
+	if err := writeMultipartSigned(&full, content, mime_pgpsignature, "pgp-sha256", sig); err != nil {
+		t.Fatal(err)
+	}
+	for n := 0; n < full.Len(); n++ {
+		if err := writeMultipartSigned(&failingWriter{n: n}, content, mime_pgpsignature, "pgp-sha256", sig); err == nil {
+			t.Fatalf("write error after %d of %d bytes ignored", n, full.Len())
+		}
+	}
+}
+
+func TestClientSendSigned(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	acc := srv.account()
+	key, pub := testPGP(t, acc.Address)
+	acc.Key = key
+
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := MessageFactory()
+	if err := c.SendSigned(m, NewEnvelope(acc.Address, "receiver@example.com")); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(txs))
+	}
+	// the fake server reads the data with LF line endings.
+	checkPGPSigned(t, toCRLF([]byte(txs[0].data)), pub)
+}
+
+func TestReadPGP(t *testing.T) {
+	senderKey, senderPub := testPGP(t, "foobar@example.com")
+	sender := &Account{Address: "foobar@example.com", Key: senderKey}
+	receiverKey, receiverPub := testPGP(t, "receiver@example.com")
+	receiver := &Account{Address: "receiver@example.com", Key: receiverKey}
+	keys, err := ReadKeyRing(strings.NewReader(senderPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+
+	enc, err := m.Encrypt(&Account{Address: "receiver@example.com", Key: &PGP{Key: receiverPub}}, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	msg, err := ReadPGP(bytes.NewReader(enc), receiver, keys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !msg.Encrypted || msg.Signature == nil || msg.Signature.Err != nil {
+		t.Fatalf("expected a valid signature on an encrypted message: %+v %+v", msg, msg.Signature)
+	}
+	if msg.Signature.KeyID != keys[0].PrimaryKey.KeyId || msg.Signature.UserID != "<foobar@example.com>" || !msg.Signature.FromMatches {
+		t.Errorf("unexpected signature: %+v", msg.Signature)
+	}
+	if parts := msg.Content.Parts(); len(parts) != 1 || !strings.HasPrefix(parts[0].String(), "hello") {
+		t.Errorf("unexpected content: %q", msg.Content.raw)
+	}
+
+	if _, err := ReadPGP(bytes.NewReader(enc), sender, keys); err == nil {
+		t.Error("decrypted without the recipient's key")
+	}
+
+	signed, err := m.Sign(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg, err = ReadPGP(bytes.NewReader(signed), nil, keys); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Encrypted || msg.Signature == nil || msg.Signature.Err != nil || !msg.Signature.FromMatches {
+		t.Fatalf("expected a valid signature: %+v", msg.Signature)
+	}
+	if parts := msg.Content.Parts(); len(parts) != 1 || parts[0].String() != "hello\r\nworld\r\n" {
+		t.Errorf("unexpected content: %q", msg.Content.raw)
+	}
+
+	// mail stored with LF line breaks (e.g. in mbox or maildir) verifies as well.
+	stored := bytes.Replace(signed, []byte("\r\n"), []byte("\n"), -1)
+	if msg, err = ReadPGP(bytes.NewReader(stored), nil, keys); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Signature == nil || msg.Signature.Err != nil {
+		t.Errorf("LF line breaks: expected a valid signature: %+v", msg.Signature)
+	}
+
+	if msg, err = ReadPGP(bytes.NewReader(signed), nil, nil); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Signature.Err != pgperrors.ErrUnknownIssuer || msg.Signature.KeyID != keys[0].PrimaryKey.KeyId || msg.Signature.Signer != nil {
+		t.Errorf("expected unknown issuer %X: %+v", keys[0].PrimaryKey.KeyId, msg.Signature)
+	}
+
+	tampered := bytes.Replace(signed, []byte("world"), []byte("earth"), 1)
+	if msg, err = ReadPGP(bytes.NewReader(tampered), nil, keys); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Signature.Err == nil || msg.Signature.KeyID != keys[0].PrimaryKey.KeyId || msg.Signature.Signer != nil || msg.Signature.FromMatches {
+		t.Errorf("expected an invalid signature without signer: %+v", msg.Signature)
+	}
+
+	delete(m.Addresses, AddrFrom)
+	m.From("", "mallory@example.com")
+	signed, _ = m.Sign(sender)
+	if msg, err = ReadPGP(bytes.NewReader(signed), nil, keys); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Signature.Err != nil || msg.Signature.FromMatches {
+		t.Errorf("expected a valid signature not matching From: %+v", msg.Signature)
+	}
+}
+
+func TestPGPSignatureUserID(t *testing.T) {
+	e := testPGPEntity(t, "bob@example.com")
+	primary, other := true, false
+	for _, id := range e.Identities {
+		id.SelfSignature.IsPrimaryId = &other
+	}
+	uid := packet.NewUserId("", "", "alice@example.com")
+	e.Identities[uid.Id] = &openpgp.Identity{Name: uid.Id, UserId: uid, SelfSignature: &packet.Signature{IsPrimaryId: &other}}
+
+	// without primary user ID, the first one is used every time.
+	for i := 0; i < 10; i++ {
+		var sig PGPSignature
+		if sig.setSigner(e, "mallory@example.com"); sig.UserID != "<alice@example.com>" || sig.FromMatches {
+			t.Fatalf("unexpected user ID: %+v", sig)
+		}
+	}
+
+	e.Identities["<bob@example.com>"].SelfSignature.IsPrimaryId = &primary
+	var sig PGPSignature
+	if sig.setSigner(e, ""); sig.UserID != "<bob@example.com>" {
+		t.Errorf("expected the primary user ID, got %q", sig.UserID)
+	}
+	if sig.setSigner(e, "Alice <alice@example.com>"); sig.UserID != "<alice@example.com>" || !sig.FromMatches {
+		t.Errorf("expected the user ID matching From: %+v", sig)
+	}
+}
+
+func TestProtectedHeaders(t *testing.T) {
+	receiverKey, receiverPub := testPGP(t, "receiver@example.com")
+	receiver := &Account{Address: "receiver@example.com", Key: receiverKey}
+
+	m := MessageFactory()
+	m.Cc("", "cc@example.com")
+	m.Bcc("", "bcc@example.com")
+	m.PlainTextBody().Write([]byte("hello"))
+
+	for _, hideCc := range []bool{false, true} {
+		m.HideCc = hideCc
+		enc, err := m.Encrypt(&Account{Address: "receiver@example.com", Key: &PGP{Key: receiverPub}}, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		outer, err := ReadPart(bytes.NewReader(enc))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if outer.Get("Subject") != "..." || (outer.Get("Cc") == "") != hideCc || outer.Get("Bcc") != "" {
+			t.Errorf("unexpected outer header (HideCc %t): %v", hideCc, outer.MIMEHeader)
+		}
+
+		msg, err := ReadPGP(bytes.NewReader(enc), receiver, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, params := msg.Content.MediaType(); params["protected-headers"] != "v1" {
+			t.Errorf("unexpected Content-Type: %s", msg.Content.Get(content_type))
+		}
+		if msg.Content.Get("Subject") != m.Subject || msg.Content.Get("Cc") != "<cc@example.com>" {
+			t.Errorf("unexpected protected header: %v", msg.Content.MIMEHeader)
+		}
+		if msg.Header.Get("Subject") != m.Subject || msg.Header.Get("Cc") != "<cc@example.com>" {
+			t.Errorf("protected header not applied: %v", msg.Header)
+		}
+	}
+}
+
+func TestSignNested(t *testing.T) {
+	senderKey, senderPub := testPGP(t, "foobar@example.com")
+	sender := &Account{Address: "foobar@example.com", Key: senderKey}
+	receiverKey, receiverPub := testPGP(t, "receiver@example.com")
+	receiver := &Account{Address: "receiver@example.com", Key: receiverKey}
+	keys, err := ReadKeyRing(strings.NewReader(senderPub))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello\nworld\n"))
+	for _, mode := range []SignMode{SignCombined, SignNested} {
+		m.SignMode = mode
+		enc, err := m.Encrypt(&Account{Address: "receiver@example.com", Key: &PGP{Key: receiverPub}}, sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		plain, err := decryptPGPMIME(t, enc, receiverKey.Key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		p, err := ReadPart(bytes.NewReader(plain))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediatype, _ := p.MediaType()
+		if (mediatype == "multipart/signed") != (mode == SignNested) {
+			t.Fatalf("mode %d: unexpected encrypted content type %s", mode, mediatype)
+		}
+		if mode == SignNested {
+			parts := p.Parts()
+			sig, _ := parts[1].Content()
+			if res := VerifyDetached(bytes.NewReader(parts[0].raw), bytes.NewReader(sig), keys); res.Err != nil || res.Signer == nil {
+				t.Errorf("invalid nested signature: %+v", res)
+			}
+			if res := VerifyDetached(bytes.NewReader(append(parts[0].raw, '!')), bytes.NewReader(sig), keys); res.Err == nil {
+				t.Error("verified a signature of modified content")
+			}
+		}
+
+		msg, err := ReadPGP(bytes.NewReader(enc), receiver, keys)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !msg.Encrypted || msg.Signature == nil || msg.Signature.Err != nil || !msg.Signature.FromMatches {
+			t.Errorf("mode %d: expected a valid signature: %+v", mode, msg.Signature)
+		}
+		if msg.Header.Get("Subject") != m.Subject {
+			t.Errorf("mode %d: protected header not applied: %v", mode, msg.Header)
+		}
+		// only the nested signature requires the canonical form.
+		if parts := msg.Content.Parts(); len(parts) != 1 || strings.Replace(parts[0].String(), "\r\n", "\n", -1) != "hello\nworld\n" {
+			t.Errorf("mode %d: unexpected content: %q", mode, msg.Content.raw)
+		}
+	}
+}
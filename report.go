@@ -0,0 +1,83 @@
+package MIMEMail
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/textproto"
+	"strings"
+)
+
+const mime_report = "multipart/report"
+
+// findReport returns the multipart/report part with the given report-type in msg or nil.
+func findReport(msg *MIMEPart, reportType string) *MIMEPart {
+	var report *MIMEPart
+	msg.walk(func(p *MIMEPart) bool {
+		mt, params := p.MediaType()
+		if mt == mime_report && strings.EqualFold(params["report-type"], reportType) {
+			report = p
+			return false
+		}
+		return true
+	})
+	return report
+}
+
+// readFieldGroups parses the machine readable part of a report, i.e.
+// groups of header fields separated by blank lines.
+func readFieldGroups(p *MIMEPart) ([]textproto.MIMEHeader, error) {
+	content, err := p.Content()
+	if err != nil {
+		return nil, err
+	}
+
+	tp := textproto.NewReader(bufio.NewReader(bytes.NewReader(content)))
+
+	var groups []textproto.MIMEHeader
+	for {
+		group, err := tp.ReadMIMEHeader()
+		if len(group) > 0 {
+			groups = append(groups, group)
+		}
+		if err == io.EOF {
+			return groups, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+// typedValue strips the type prefix from report fields like
+// "Final-Recipient: rfc822; user@example.com".
+func typedValue(v string) string {
+	if i := strings.Index(v, ";"); i >= 0 {
+		v = v[i+1:]
+	}
+	return strings.TrimSpace(v)
+}
+
+// originalMessageID returns the Message-ID of the returned original message
+// (message/rfc822 or text/rfc822-headers part) in report.
+func originalMessageID(report *MIMEPart) string {
+	orig := report.find("message/rfc822", "text/rfc822-headers", "message/global", "message/global-headers")
+	if orig == nil {
+		return ""
+	}
+
+	content, err := orig.Content()
+	if err != nil {
+		return ""
+	}
+
+	return messageIDFromHeader(content)
+}
+
+// messageIDFromHeader returns the Message-ID field of the message (header) in raw.
+func messageIDFromHeader(raw []byte) string {
+	head, _ := splitHeader(raw)
+	tp := textproto.NewReader(bufio.NewReader(io.MultiReader(bytes.NewReader(head), strings.NewReader("\r\n"))))
+	header, _ := tp.ReadMIMEHeader()
+	return strings.TrimSpace(header.Get("Message-Id"))
+}
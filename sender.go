@@ -1,10 +1,12 @@
 package MIMEMail
 
 import (
+	"bytes"
 	"crypto/tls"
 	"fmt"
 	"io"
 	"net/smtp"
+	"strings"
 )
 
 // various smtp ports as a shorthand
@@ -21,18 +23,14 @@ type Client struct {
 	tls bool
 }
 
-// TLSClient establishes a TLSConnection to the Server described by config.
+// TLSClient establishes a TLSConnection to the Server described by config (see Server.TLSConfig).
 func TLSClient(cnf *Account) (*Client, error) {
-	var config *tls.Config
-	if cnf.Server.Config == nil {
-		config = &tls.Config{ServerName: cnf.Server.Host}
-	}
-	tlsCon, err := tls.Dial("tcp", cnf.Server.Addr(), config)
+	tlsCon, err := tls.Dial("tcp", cnf.Server.Addr(), cnf.Server.TLSConfig())
 	if err != nil {
 		return nil, err
 	}
 
-	c, err := smtp.NewClient(tlsCon, cnf.Server.Addr())
+	c, err := smtp.NewClient(tlsCon, cnf.Server.Host)
 	if err != nil {
 		return nil, err
 	}
@@ -42,7 +40,7 @@ func TLSClient(cnf *Account) (*Client, error) {
 
 // PlainClient uses the standard smtp.Dail, so an unencrypted connection will
 // be used. It will check wether STARTTLS is supported by the server
-// and use it, if available.
+// and use it, as selected by the TLSPolicy of the server.
 func PlainClient(cnf *Account) (*Client, error) {
 	c, err := smtp.Dial(cnf.Server.Addr())
 	if err != nil {
@@ -58,14 +56,17 @@ func (c Client) prolog() error {
 		return err
 	}
 
-	if !c.tls {
-		if ok, _ := c.Extension("STARTTLS"); ok {
-			var config *tls.Config
-			if c.cnf.Server.Config == nil {
-				config = &tls.Config{ServerName: c.cnf.Server.Host}
-			}
-			if err := c.StartTLS(config); err != nil {
-				return err
+	if !c.tls && c.cnf.Server.TLSPolicy != TLSNone {
+		ok, _ := c.Extension("STARTTLS")
+		if !ok && c.cnf.Server.TLSPolicy == TLSRequired {
+			c.Quit()
+			return StartTLSFailed{Host: c.cnf.Server.Host}
+		}
+		if ok {
+			if err := c.StartTLS(c.cnf.Server.TLSConfig()); err != nil {
+				// the connection is unusable after a failed handshake.
+				c.Close()
+				return StartTLSFailed{Host: c.cnf.Server.Host, Err: err}
 			}
 		}
 	}
@@ -86,22 +87,18 @@ func (c Client) prolog() error {
 
 // W is the equivalent of Writer, but returns a WriteCloser that you can write
 // your message to. Remember to close the writer when you are done writing to it.
-func (c Client) W(from string, to []string) (io.WriteCloser, error) {
-	if err := c.prolog(); err != nil {
-		return nil, err
+// If you pass an Envelope, it takes precedence over from and to.
+func (c Client) W(from string, to []string, env ...*Envelope) (io.WriteCloser, error) {
+	e := NewEnvelope(from, to...)
+	if len(env) != 0 && env[0] != nil {
+		e = env[0]
 	}
 
-	if err := c.Mail(from); err != nil {
+	if err := c.prolog(); err != nil {
 		return nil, err
 	}
 
-	for _, addr := range to {
-		if err := c.Rcpt(addr); err != nil {
-			return nil, err
-		}
-	}
-
-	return c.Data()
+	return e.open(c.Client)
 }
 
 // Write sends the message with the given from / to email addresses.
@@ -125,20 +122,86 @@ func (c Client) Write(from string, to []string, msg []byte) error {
 // is used (with the same restrictions). If both are nil,
 // a NoSender error is returned. To Send encrypted mails,
 // use the (Client.Write / Mail.Encrypt) or (Client.W / Mail.WriteEncrypted)
-// pairs.
-func (c Client) Send(m *Mail) error {
-	efSender, err := m.EffectiveSender()
+// pairs, or configure Autocrypt for the client's account to encrypt opportunistically.
+//
+// If you pass an Envelope, it's used for MAIL FROM / RCPT TO instead of the
+// addresses derived from the header fields.
+func (c Client) Send(m *Mail, env ...*Envelope) error {
+	e, err := m.envelope(env)
 	if err != nil {
 		return err
 	}
-	recp := m.Recipients()
 
-	b, err := m.Bytes()
+	b, err := c.bytes(m, e)
 	if err != nil {
 		return err
 	}
 
-	return c.Write(efSender, recp, b)
+	if err := c.prolog(); err != nil {
+		return err
+	}
+
+	return e.send(c.Client, b)
+}
+
+// SendVERP sends the given Mail in a separate transaction to each recipient, each
+// with it's own VERP envelope sender based on bounce (see VERP), so bounces can
+// be matched to the recipient using DecodeVERP. If bounce is empty, the
+// envelope sender is used as the base address.
+// The recipients are taken from env if given, else they are derived from the
+// header fields as in Send.
+func (c Client) SendVERP(m *Mail, bounce string, env ...*Envelope) error {
+	e, err := m.envelope(env)
+	if err != nil {
+		return err
+	}
+
+	envs, err := e.VERP(bounce)
+	if err != nil {
+		return err
+	}
+
+	b, err := c.bytes(m, e)
+	if err != nil {
+		return err
+	}
+
+	if err := c.prolog(); err != nil {
+		return err
+	}
+
+	for _, e := range envs {
+		if err := e.send(c.Client, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Forward sends the raw message msg (e.g. a received mail, modified or not) to the
+// recipients in env. If the client's account has ARC configured, msg is sealed first,
+// recording auth (see ARC.Seal). Then it's DKIM signed as in Send.
+func (c Client) Forward(msg []byte, env *Envelope, auth ...*AuthResults) error {
+	var err error
+	if c.cnf.ARC != nil {
+		if msg, err = c.cnf.ARC.Seal(msg, auth...); err != nil {
+			return err
+		}
+	}
+
+	if msg, err = c.sign(msg); err != nil {
+		return err
+	}
+
+	if err := env.validate(); err != nil {
+		return err
+	}
+
+	if err := c.prolog(); err != nil {
+		return err
+	}
+
+	return env.send(c.Client, msg)
 }
 
 // SendEncrypted sends the given mail to recipient, encrypting it with recipient's Key (which therefore cannot be nil)
@@ -149,5 +212,144 @@ func (c Client) SendEncrypted(m *Mail, recipient, sender *Account) error {
 		return err
 	}
 
+	if enc, err = c.sign(enc); err != nil {
+		return err
+	}
+
+	return c.Write(sender.Address, []string{recipient.Address}, enc)
+}
+
+// SendEncryptedToAll sends the given mail encrypted for all of it's recipients and signed with the Key of
+// the client's account (see Mail.WriteEncryptedToAll for how keys are used).
+// Recipients are derived as in Send, unless you pass an Envelope.
+func (c Client) SendEncryptedToAll(m *Mail, keys []*Account, env ...*Envelope) error {
+	e, err := m.envelope(env)
+	if err != nil {
+		return err
+	}
+
+	b, err := m.EncryptToAll(keys, c.cnf)
+	if err != nil {
+		return err
+	}
+
+	if b, err = c.sign(b); err != nil {
+		return err
+	}
+
+	if err := c.prolog(); err != nil {
+		return err
+	}
+
+	return e.send(c.Client, b)
+}
+
+// SendSigned sends the given Mail signed with PGP/MIME, using the Key field of the client's account
+// (see Mail.WriteSigned). Recipients are derived as in Send, unless you pass an Envelope.
+func (c Client) SendSigned(m *Mail, env ...*Envelope) error {
+	e, err := m.envelope(env)
+	if err != nil {
+		return err
+	}
+
+	b, err := m.Sign(c.cnf)
+	if err != nil {
+		return err
+	}
+
+	if b, err = c.sign(b); err != nil {
+		return err
+	}
+
+	if err := c.prolog(); err != nil {
+		return err
+	}
+
+	return e.send(c.Client, b)
+}
+
+// SendSMIMESigned sends the given Mail signed with S/MIME, using the SMIME field of the client's account.
+// Recipients are derived as in Send, unless you pass an Envelope.
+func (c Client) SendSMIMESigned(m *Mail, env ...*Envelope) error {
+	e, err := m.envelope(env)
+	if err != nil {
+		return err
+	}
+
+	b, err := m.SMIMESign(c.cnf)
+	if err != nil {
+		return err
+	}
+
+	if b, err = c.sign(b); err != nil {
+		return err
+	}
+
+	if err := c.prolog(); err != nil {
+		return err
+	}
+
+	return e.send(c.Client, b)
+}
+
+// SendSMIMEEncrypted sends the given mail to recipient, encrypting it with S/MIME for recipient's
+// SMIME certificate and signing it with sender's SMIME certificate and key (see Mail.SMIMEEncrypt).
+func (c Client) SendSMIMEEncrypted(m *Mail, recipient, sender *Account) error {
+	enc, err := m.SMIMEEncrypt(recipient, sender)
+	if err != nil {
+		return err
+	}
+
+	if enc, err = c.sign(enc); err != nil {
+		return err
+	}
+
 	return c.Write(sender.Address, []string{recipient.Address}, enc)
 }
+
+// bytes returns the formatted message, signed as configured for the client's account.
+// If the account has Autocrypt configured, the Autocrypt header is added and the message
+// is encrypted to exactly the recipients in the envelope e if Autocrypt recommends it for all of them.
+func (c Client) bytes(m *Mail, e *Envelope) ([]byte, error) {
+	if c.cnf.Autocrypt == nil {
+		b, err := m.Bytes()
+		if err != nil {
+			return nil, err
+		}
+		return c.sign(b)
+	}
+
+	keys, err := c.cnf.Autocrypt.Keys(e.Recipients())
+	if err != nil {
+		return nil, err
+	}
+	var b []byte
+	if keys != nil {
+		var buf bytes.Buffer
+		err = m.writeEncrypted(&buf, keys, c.cnf)
+		b = buf.Bytes()
+	} else {
+		b, err = m.Bytes()
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// the header is only valid if it matches the From address.
+	if from := m.Addresses[AddrFrom]; len(from) == 1 && strings.EqualFold(from[0].Address, c.cnf.Address) {
+		header, err := c.cnf.Autocrypt.Header(c.cnf)
+		if err != nil {
+			return nil, err
+		}
+		b = append([]byte("Autocrypt: "+header+"\r\n"), b...)
+	}
+	return c.sign(b)
+}
+
+// sign DKIM signs msg if the client's account has DKIM configured.
+func (c Client) sign(msg []byte) ([]byte, error) {
+	if c.cnf.DKIM == nil {
+		return msg, nil
+	}
+	return c.cnf.DKIM.Sign(msg)
+}
@@ -2,8 +2,24 @@ package MIMEMail
 
 import (
 	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/hex"
+	"errors"
 	"html/template"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 )
 
 func getTestMail(t *testing.T, cnf *testConf) *Mail {
@@ -54,3 +70,380 @@ func TestTLSClientSend(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+// fakeTransaction records a single mail transaction received by fakeSMTP.
+type fakeTransaction struct {
+	from string
+	rcpt []string
+	data string
+}
+
+// fakeSMTP is a minimal SMTP server for testing the Client without network access.
+type fakeSMTP struct {
+	net.Listener
+	extensions []string
+
+	// tls enables STARTTLS if it is not nil, state records the negotiated connection.
+	tls   *tls.Config
+	state *tls.ConnectionState
+
+	mu   sync.Mutex
+	txs  []*fakeTransaction
+	done chan struct{}
+}
+
+func newFakeSMTP(t *testing.T, extensions ...string) *fakeSMTP {
+	return newFakeSMTPTLS(t, nil, extensions...)
+}
+
+// newFakeSMTPTLS starts a fakeSMTP supporting STARTTLS with config, if it is not nil.
+func newFakeSMTPTLS(t *testing.T, config *tls.Config, extensions ...string) *fakeSMTP {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &fakeSMTP{Listener: l, extensions: append([]string{"AUTH PLAIN"}, extensions...), tls: config, done: make(chan struct{})}
+	go s.serve()
+	return s
+}
+
+// tlsState returns the state of the TLS connection, nil if STARTTLS wasn't used.
+func (s *fakeSMTP) tlsState() *tls.ConnectionState {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// account returns an Account pointing to the fake server.
+func (s *fakeSMTP) account() *Account {
+	host, port, _ := net.SplitHostPort(s.Addr().String())
+	return &Account{
+		Name:    "Mr. Sender",
+		Address: "sender@example.com",
+		Pass:    "secret",
+		Server:  &Server{Host: host, Port: port},
+	}
+}
+
+func (s *fakeSMTP) transactions() []*fakeTransaction {
+	<-s.done
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.txs
+}
+
+func (s *fakeSMTP) serve() {
+	defer close(s.done)
+	conn, err := s.Accept()
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 fake ESMTP")
+	secure := false
+
+	var tx *fakeTransaction
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"):
+			tp.PrintfLine("250-fake")
+			for _, ext := range s.extensions {
+				tp.PrintfLine("250-%s", ext)
+			}
+			if s.tls != nil && !secure {
+				tp.PrintfLine("250-STARTTLS")
+			}
+			tp.PrintfLine("250 8BITMIME")
+		case cmd == "STARTTLS" && s.tls != nil && !secure:
+			tp.PrintfLine("220 ready")
+			tlsConn := tls.Server(conn, s.tls)
+			if err := tlsConn.Handshake(); err != nil {
+				return
+			}
+			state := tlsConn.ConnectionState()
+			s.mu.Lock()
+			s.state = &state
+			s.mu.Unlock()
+			tp = textproto.NewConn(tlsConn)
+			secure = true
+		case strings.HasPrefix(cmd, "AUTH"):
+			tp.PrintfLine("235 ok")
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			tx = &fakeTransaction{from: line[len("MAIL FROM:"):]}
+			tp.PrintfLine("250 ok")
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			tx.rcpt = append(tx.rcpt, line[len("RCPT TO:"):])
+			tp.PrintfLine("250 ok")
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			tx.data = string(data)
+			s.mu.Lock()
+			s.txs = append(s.txs, tx)
+			s.mu.Unlock()
+			tp.PrintfLine("250 queued")
+		case cmd == "RSET":
+			tp.PrintfLine("250 ok")
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func TestClientSendEnvelope(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	m := NewMail()
+	m.From("Mr. Sender", "sender@example.com")
+	m.To("Mr. Receiver", "receiver@example.com")
+	m.Subject = "envelope test"
+
+	env := NewEnvelope("bounces@example.com")
+	env.Add("receiver@example.com", "NOTIFY=FAILURE")
+	env.Add("hidden@example.com")
+
+	c, err := PlainClient(srv.account())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(m, env); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(txs))
+	}
+	if txs[0].from != "<bounces@example.com> BODY=8BITMIME" {
+		t.Errorf("unexpected MAIL FROM: %q", txs[0].from)
+	}
+	exp := []string{"<receiver@example.com> NOTIFY=FAILURE", "<hidden@example.com>"}
+	if strings.Join(txs[0].rcpt, ",") != strings.Join(exp, ",") {
+		t.Errorf("expected RCPT TO %q, got %q", exp, txs[0].rcpt)
+	}
+	if strings.Contains(txs[0].data, "hidden@example.com") {
+		t.Error("envelope recipient leaked into the header")
+	}
+}
+
+func TestClientSendDerivedEnvelope(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	m := NewMail()
+	m.From("Mr. Sender", "sender@example.com")
+	m.To("Mr. Receiver", "receiver@example.com")
+	m.Cc("Mrs. Receiver", "cc@example.com")
+
+	c, err := PlainClient(srv.account())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Send(m); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(txs))
+	}
+	if !strings.HasPrefix(txs[0].from, "<sender@example.com>") {
+		t.Errorf("unexpected MAIL FROM: %q", txs[0].from)
+	}
+	if strings.Join(txs[0].rcpt, ",") != "<receiver@example.com>,<cc@example.com>" {
+		t.Errorf("unexpected RCPT TO: %q", txs[0].rcpt)
+	}
+}
+
+func TestMailSendMailEnvelope(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	m := NewMail()
+	m.From("Mr. Sender", "sender@example.com")
+	m.To("Mr. Receiver", "receiver@example.com")
+
+	env := NewEnvelope("", "other@example.com")
+	if err := m.SendMail(srv.Addr().String(), nil, env); err != nil {
+		t.Fatal(err)
+	}
+
+	txs := srv.transactions()
+	if len(txs) != 1 {
+		t.Fatalf("expected 1 transaction, got %d", len(txs))
+	}
+	if !strings.HasPrefix(txs[0].from, "<>") {
+		t.Errorf("expected null reverse path, got %q", txs[0].from)
+	}
+	if strings.Join(txs[0].rcpt, ",") != "<other@example.com>" {
+		t.Errorf("unexpected RCPT TO: %q", txs[0].rcpt)
+	}
+}
+
+// testTLSCert issues a certificate for 127.0.0.1 signed by ca, usable by servers and clients.
+func testTLSCert(t *testing.T, ca *x509.Certificate, caKey crypto.Signer) tls.Certificate {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(24 * time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// sendTLS sends a mail with PlainClient to a fakeSMTP using config for STARTTLS, after setting
+// the client's TLS options with server.
+func sendTLS(t *testing.T, config *tls.Config, server func(*Server)) (*fakeSMTP, error) {
+	srv := newFakeSMTPTLS(t, config)
+	defer srv.Close()
+	acc := srv.account()
+	server(acc.Server)
+
+	c, err := PlainClient(acc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	return srv, c.Send(MessageFactory(), NewEnvelope(acc.Address, "receiver@example.com"))
+}
+
+func TestServerTLSConfig(t *testing.T) {
+	ca, caKey := testSMIMECA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serverCert := testTLSCert(t, ca, caKey)
+	clientCert := testTLSCert(t, ca, caKey)
+	sum := sha256.Sum256(serverCert.Certificate[0])
+	fpr := hex.EncodeToString(sum[:])
+
+	// the supplied config is used (with the ServerName filled in) and the client certificate presented.
+	srv, err := sendTLS(t, &tls.Config{Certificates: []tls.Certificate{serverCert}, ClientAuth: tls.RequireAndVerifyClientCert, ClientCAs: roots},
+		func(s *Server) {
+			s.Config = &tls.Config{RootCAs: roots}
+			s.ClientCert = &clientCert
+			s.Fingerprints = []string{fpr}
+		})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if state := srv.tlsState(); state == nil || len(state.PeerCertificates) != 1 {
+		t.Errorf("expected a TLS connection with a client certificate: %+v", state)
+	}
+	if len(srv.transactions()) != 1 {
+		t.Error("mail not sent")
+	}
+
+	if _, err := sendTLS(t, &tls.Config{Certificates: []tls.Certificate{serverCert}}, func(s *Server) {}); err == nil {
+		t.Error("connected to a server with an unknown CA")
+	}
+
+	if _, err := sendTLS(t, &tls.Config{Certificates: []tls.Certificate{serverCert}, MaxVersion: tls.VersionTLS12}, func(s *Server) {
+		s.Config = &tls.Config{RootCAs: roots}
+		s.MinTLSVersion = tls.VersionTLS13
+	}); err == nil {
+		t.Error("connected with TLS 1.2 while requiring TLS 1.3")
+	}
+
+	other := testTLSCert(t, ca, caKey)
+	_, err = sendTLS(t, &tls.Config{Certificates: []tls.Certificate{other}}, func(s *Server) {
+		s.Config = &tls.Config{RootCAs: roots}
+		s.Fingerprints = []string{fpr}
+	})
+	var unpinned UnpinnedCertificate
+	if !errors.As(err, &unpinned) {
+		t.Errorf("expected UnpinnedCertificate, got %v", err)
+	}
+
+	// pinning a certificate without verifying the chain.
+	if _, err := sendTLS(t, &tls.Config{Certificates: []tls.Certificate{serverCert}}, func(s *Server) {
+		s.Config = &tls.Config{InsecureSkipVerify: true}
+		s.Fingerprints = []string{strings.ToUpper(fpr)}
+	}); err != nil {
+		t.Errorf("pinned certificate rejected: %v", err)
+	}
+}
+
+func TestTLSPolicy(t *testing.T) {
+	ca, caKey := testSMIMECA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+	serverTLS := &tls.Config{Certificates: []tls.Certificate{testTLSCert(t, ca, caKey)}}
+	trusted := func(policy TLSPolicy) func(*Server) {
+		return func(s *Server) {
+			s.TLSPolicy = policy
+			s.Config = &tls.Config{RootCAs: roots}
+		}
+	}
+
+	for _, test := range []struct {
+		name      string
+		server    *tls.Config
+		client    func(*Server)
+		encrypted bool
+		err       bool
+	}{
+		{name: "opportunistic with STARTTLS", server: serverTLS, client: trusted(TLSOpportunistic), encrypted: true},
+		{name: "opportunistic without STARTTLS", client: trusted(TLSOpportunistic)},
+		{name: "required with STARTTLS", server: serverTLS, client: trusted(TLSRequired), encrypted: true},
+		{name: "required without STARTTLS", client: trusted(TLSRequired), err: true},
+		{name: "required with failing handshake", server: serverTLS, client: func(s *Server) { s.TLSPolicy = TLSRequired }, err: true},
+		{name: "none", server: serverTLS, client: trusted(TLSNone)},
+	} {
+		srv, err := sendTLS(t, test.server, test.client)
+		if test.err {
+			if _, ok := err.(StartTLSFailed); !ok {
+				t.Errorf("%s: expected StartTLSFailed, got %v", test.name, err)
+			}
+			if len(srv.transactions()) != 0 {
+				t.Errorf("%s: mail sent", test.name)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		if encrypted := srv.tlsState() != nil; encrypted != test.encrypted {
+			t.Errorf("%s: expected encrypted %t, got %t", test.name, test.encrypted, encrypted)
+		}
+		if len(srv.transactions()) != 1 {
+			t.Errorf("%s: mail not sent", test.name)
+		}
+	}
+
+	// the handshake error is wrapped.
+	_, err := sendTLS(t, serverTLS, func(s *Server) { s.TLSPolicy = TLSRequired })
+	var unknownCA x509.UnknownAuthorityError
+	if !errors.As(err, &unknownCA) {
+		t.Errorf("expected an unknown authority error, got %v", err)
+	}
+}
@@ -0,0 +1,402 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/textproto"
+	"strings"
+)
+
+const (
+	mime_pkcs7signature = "application/pkcs7-signature"
+	mime_pkcs7mime      = "application/pkcs7-mime"
+)
+
+// SMIME holds the X.509 certificate and private key of an account for S/MIME (RFC 8551).
+// Recipients only need the certificate.
+type SMIME struct {
+	// CertFile holds the filesystem path from which the PEM encoded certificate
+	// should be read, optionally followed by the intermediate certificates of its chain.
+	// If Cert below is not empty it will take precedence.
+	CertFile string
+
+	// Cert holds the PEM encoded certificate(s), mostly for usage in tests.
+	Cert string
+
+	// KeyFile holds the filesystem path from which the PEM encoded private key
+	// (RSA or EC) should be read. If Key below is not empty it will take precedence.
+	KeyFile string
+
+	// Key holds the PEM encoded private key, mostly for usage in tests.
+	Key string
+}
+
+// Certificates loads the certificate and the intermediates following it.
+func (s SMIME) Certificates() ([]*x509.Certificate, error) {
+	data, err := readKey(s.CertFile, s.Cert)
+	if err != nil {
+		return nil, err
+	}
+
+	var certs []*x509.Certificate
+	for {
+		var block *pem.Block
+		if block, data = pem.Decode(data); block == nil {
+			break
+		}
+		if block.Type != "CERTIFICATE" {
+			continue
+		}
+		cert, err := x509.ParseCertificate(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		certs = append(certs, cert)
+	}
+	if len(certs) == 0 {
+		return nil, fmt.Errorf("no PEM encoded certificate found")
+	}
+	return certs, nil
+}
+
+// Signer loads the private key.
+func (s SMIME) Signer() (crypto.Signer, error) {
+	data, err := readKey(s.KeyFile, s.Key)
+	if err != nil {
+		return nil, err
+	}
+
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("no PEM encoded key found")
+	}
+
+	if key, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+	if key, err := x509.ParseECPrivateKey(block.Bytes); err == nil {
+		return key, nil
+	}
+
+	key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return nil, err
+	}
+	switch key := key.(type) {
+	case *rsa.PrivateKey:
+		return key, nil
+	case *ecdsa.PrivateKey:
+		return key, nil
+	default:
+		return nil, fmt.Errorf("unsupported key type %T (use RSA or EC)", key)
+	}
+}
+
+// readKey reads all of key or file (see openKey).
+func readKey(file, key string) ([]byte, error) {
+	r, err := openKey(file, key)
+	if err != nil {
+		return nil, err
+	}
+	if c, ok := r.(io.Closer); ok {
+		defer c.Close()
+	}
+	return ioutil.ReadAll(r)
+}
+
+// SMIMESign signs the mail with S/MIME (multipart/signed) using signer's SMIME certificate and key.
+func (m *Mail) SMIMESign(signer *Account) ([]byte, error) {
+	var b bytes.Buffer
+	if err := m.WriteSMIMESigned(&b, signer); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteSMIMESigned signs the mail with S/MIME (multipart/signed) using signer's SMIME
+// certificate and key and writes it to w.
+func (m *Mail) WriteSMIMESigned(w io.Writer, signer *Account) error {
+	if err := m.writeHeader(w); err != nil {
+		return err
+	}
+
+	var body bytes.Buffer
+	if err := m.writeBody(&body); err != nil {
+		return err
+	}
+
+	return writeSMIMESigned(w, body.Bytes(), signer)
+}
+
+// writeSMIMESigned writes the Content-Type header and the multipart/signed body
+// for the MIME entity content.
+func writeSMIMESigned(w io.Writer, content []byte, signer *Account) error {
+	if signer == nil || signer.SMIME == nil {
+		return fmt.Errorf("signer and it's SMIME field cannot be nil!")
+	}
+	certs, err := signer.SMIME.Certificates()
+	if err != nil {
+		return err
+	}
+	key, err := signer.SMIME.Signer()
+	if err != nil {
+		return err
+	}
+
+	// the signature covers the canonical form, so it must be sent as such.
+	content = toCRLF(content)
+	sig, err := cmsSign(content, key, certs)
+	if err != nil {
+		return err
+	}
+
+	sigPart := NewMIMEPart()
+	sigPart.Set(content_type, mime_pkcs7signature+"; name=smime.p7s")
+	sigPart.Set(content_transfer_encoding, mime_base64)
+	sigPart.Set(content_disposition, mime_attachment+"; filename=smime.p7s")
+	sigPart.Write(base64Lines(sig))
+
+	return writeMultipartSigned(w, content, mime_pkcs7signature, "sha-256", sigPart)
+}
+
+// SMIMEEncrypt encrypts the mail with S/MIME (application/pkcs7-mime) for the certificate in
+// to's SMIME field. If signer is not nil, the mail is signed with signer's SMIME certificate
+// and key before encrypting it, it's also encrypted for signer, so the sent mail can be read.
+func (m *Mail) SMIMEEncrypt(to *Account, signer *Account) ([]byte, error) {
+	var b bytes.Buffer
+	if err := m.WriteSMIMEEncrypted(&b, to, signer); err != nil {
+		return nil, err
+	}
+	return b.Bytes(), nil
+}
+
+// WriteSMIMEEncrypted encrypts the mail with S/MIME (application/pkcs7-mime) for the certificate
+// in to's SMIME field and writes it to w. If signer is not nil, the mail is signed with signer's
+// SMIME certificate and key before encrypting it, it's also encrypted for signer, so the sent mail can be read.
+func (m *Mail) WriteSMIMEEncrypted(w io.Writer, to *Account, signer *Account) error {
+	if to == nil || to.SMIME == nil {
+		return fmt.Errorf("recipient and it's SMIME field cannot be nil!")
+	}
+	certs, err := to.SMIME.Certificates()
+	if err != nil {
+		return err
+	}
+	recipients := []*x509.Certificate{certs[0]}
+
+	var content bytes.Buffer
+	if err := m.writeBody(&content); err != nil {
+		return err
+	}
+
+	if signer != nil {
+		var signed bytes.Buffer
+		if err := writeSMIMESigned(&signed, content.Bytes(), signer); err != nil {
+			return err
+		}
+		content = signed
+
+		certs, err := signer.SMIME.Certificates()
+		if err != nil {
+			return err
+		}
+		recipients = append(recipients, certs[0])
+	}
+
+	enc, err := cmsEncrypt(toCRLF(content.Bytes()), recipients)
+	if err != nil {
+		return err
+	}
+
+	if err := m.writeHeader(w); err != nil {
+		return err
+	}
+	fmt.Fprintf(w, "%s: %s; smime-type=enveloped-data; name=smime.p7m\r\n", content_type, mime_pkcs7mime)
+	fmt.Fprintf(w, "%s: %s\r\n", content_transfer_encoding, mime_base64)
+	fmt.Fprintf(w, "%s: %s; filename=smime.p7m\r\n\r\n", content_disposition, mime_attachment)
+	_, err = w.Write(base64Lines(enc))
+	return err
+}
+
+// base64Lines base64 encodes data in lines of 76 characters.
+func base64Lines(data []byte) []byte {
+	enc := base64.StdEncoding.EncodeToString(data)
+	var b bytes.Buffer
+	for len(enc) > 76 {
+		b.WriteString(enc[:76] + "\r\n")
+		enc = enc[76:]
+	}
+	b.WriteString(enc + "\r\n")
+	return b.Bytes()
+}
+
+// SMIMESignature holds the results of verifying a S/MIME signature.
+type SMIMESignature struct {
+	// Signer is the certificate of the signer (nil if it couldn't be determined).
+	Signer *x509.Certificate
+
+	// Chain is the validated certificate chain, from Signer up to a trusted root.
+	Chain []*x509.Certificate
+
+	// FromMatches reports whether an email address of Signer matches the From
+	// address of the message. It's only set if the signature is valid (Err is nil).
+	FromMatches bool
+
+	// Err is nil if the signature is valid and Signer chains up to a trusted root.
+	Err error
+}
+
+// SMIMEMessage is a received S/MIME message.
+type SMIMEMessage struct {
+	// Header holds the header of the message.
+	Header textproto.MIMEHeader
+
+	// Content is the decrypted and/or signed MIME entity, use it's Parts
+	// method to get the parts of multipart content.
+	Content *MIMEPart
+
+	// Encrypted reports whether the message was encrypted.
+	Encrypted bool
+
+	// Signature is nil if the message isn't signed.
+	Signature *SMIMESignature
+}
+
+// ReadSMIME reads a S/MIME message from r, decrypts it with recipient's SMIME certificate
+// and key and verifies it's signature against roots (the system roots are used if it is nil).
+// recipient may be nil for messages which are only signed. Messages that are neither
+// encrypted nor signed are returned as they are. Failed signature verification is
+// reported in the Signature of the returned message, not as error.
+func ReadSMIME(r io.Reader, recipient *Account, roots *x509.CertPool) (*SMIMEMessage, error) {
+	msg, err := ReadPart(r)
+	if err != nil {
+		return nil, err
+	}
+
+	res := &SMIMEMessage{Header: msg.MIMEHeader}
+	part := msg
+	for {
+		mediatype, params := part.MediaType()
+		switch {
+		case (mediatype == mime_pkcs7mime || mediatype == "application/x-pkcs7-mime") && params["smime-type"] == "signed-data":
+			der, err := part.Content()
+			if err != nil {
+				return nil, err
+			}
+			signer, certs, content, err := cmsVerify(der, nil)
+			res.Signature = verifySMIMEChain(signer, certs, err, roots, msg.Get("From"))
+			if content == nil {
+				return nil, err
+			}
+			if part, err = parsePart(content); err != nil {
+				return nil, err
+			}
+
+		case mediatype == mime_pkcs7mime || mediatype == "application/x-pkcs7-mime":
+			if recipient == nil || recipient.SMIME == nil {
+				return nil, fmt.Errorf("recipient and it's SMIME field cannot be nil!")
+			}
+			certs, err := recipient.SMIME.Certificates()
+			if err != nil {
+				return nil, err
+			}
+			key, err := recipient.SMIME.Signer()
+			if err != nil {
+				return nil, err
+			}
+
+			der, err := part.Content()
+			if err != nil {
+				return nil, err
+			}
+			content, err := cmsDecrypt(der, certs[0], key)
+			if err != nil {
+				return nil, err
+			}
+			res.Encrypted = true
+			if part, err = parsePart(content); err != nil {
+				return nil, err
+			}
+
+		case mediatype == "multipart/signed" && (params["protocol"] == mime_pkcs7signature || params["protocol"] == "application/x-pkcs7-signature"):
+			parts := part.Parts()
+			if len(parts) != 2 {
+				return nil, fmt.Errorf("S/MIME: multipart/signed needs 2 parts, got %d", len(parts))
+			}
+			der, err := parts[1].Content()
+			if err != nil {
+				return nil, err
+			}
+			signer, certs, _, err := cmsVerify(der, toCRLF(parts[0].raw))
+			res.Signature = verifySMIMEChain(signer, certs, err, roots, msg.Get("From"))
+			part = parts[0]
+
+		default:
+			res.Content = part
+			return res, nil
+		}
+	}
+}
+
+// verifySMIMEChain validates the certificate chain of signer (unless err is already set)
+// and, if it's valid, matches it's email addresses with from.
+func verifySMIMEChain(signer *x509.Certificate, certs []*x509.Certificate, err error, roots *x509.CertPool, from string) *SMIMESignature {
+	sig := &SMIMESignature{Signer: signer, Err: err}
+	if signer == nil {
+		return sig
+	}
+
+	if sig.Err != nil {
+		return sig
+	}
+
+	intermediates := x509.NewCertPool()
+	for _, c := range certs {
+		intermediates.AddCert(c)
+	}
+	chains, err := signer.Verify(x509.VerifyOptions{
+		Roots:         roots,
+		Intermediates: intermediates,
+		KeyUsages:     []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	})
+	if err != nil {
+		sig.Err = err
+		return sig
+	}
+	sig.Chain = chains[0]
+
+	if addrs, err := mail.ParseAddressList(from); err == nil {
+		for _, addr := range addrs {
+			for _, email := range certEmails(signer) {
+				if strings.EqualFold(email, addr.Address) {
+					sig.FromMatches = true
+				}
+			}
+		}
+	}
+	return sig
+}
+
+// oidEmailAddress is the (deprecated) emailAddress attribute of subject names.
+var oidEmailAddress = asn1.ObjectIdentifier{1, 2, 840, 113549, 1, 9, 1}
+
+// certEmails returns the email addresses of cert, from the subject alternative
+// names and the subject.
+func certEmails(cert *x509.Certificate) []string {
+	emails := append([]string{}, cert.EmailAddresses...)
+	for _, name := range cert.Subject.Names {
+		if email, ok := name.Value.(string); ok && name.Type.Equal(oidEmailAddress) {
+			emails = append(emails, email)
+		}
+	}
+	return emails
+}
@@ -0,0 +1,352 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testSMIMECA creates a CA certificate and key for issuing test certificates.
+func testSMIMECA(t *testing.T) (*x509.Certificate, crypto.Signer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "MIMEMail Test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(24 * time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, key.Public(), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return cert, key
+}
+
+// testSMIME issues a certificate for address signed by ca, with a RSA key
+// or a P-256 key if ec is true.
+func testSMIME(t *testing.T, ca *x509.Certificate, caKey crypto.Signer, address string, ec bool) *SMIME {
+	var key crypto.Signer
+	var err error
+	if ec {
+		key, err = ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	} else {
+		key, err = rsa.GenerateKey(rand.Reader, 2048)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	serial, _ := rand.Int(rand.Reader, big.NewInt(1<<62))
+	tmpl := &x509.Certificate{
+		SerialNumber:   serial,
+		Subject:        pkix.Name{CommonName: address},
+		EmailAddresses: []string{address},
+		NotBefore:      time.Now().Add(-time.Hour),
+		NotAfter:       time.Now().Add(24 * time.Hour),
+		KeyUsage:       x509.KeyUsageDigitalSignature | x509.KeyUsageKeyEncipherment | x509.KeyUsageKeyAgreement,
+		ExtKeyUsage:    []x509.ExtKeyUsage{x509.ExtKeyUsageEmailProtection},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, ca, key.Public(), caKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return &SMIME{
+		Cert: string(pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})),
+		Key:  string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER})),
+	}
+}
+
+func TestSMIMESign(t *testing.T) {
+	ca, caKey := testSMIMECA(t)
+
+	for _, ec := range []bool{false, true} {
+		sender := &Account{Address: "sender@example.com", SMIME: testSMIME(t, ca, caKey, "sender@example.com", ec)}
+
+		m := MessageFactory()
+		m.PlainTextBody().Write([]byte("hello\nworld\n"))
+		signed, err := m.SMIMESign(sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg, err := ReadPart(bytes.NewReader(signed))
+		if err != nil {
+			t.Fatal(err)
+		}
+		mediatype, params := msg.MediaType()
+		if mediatype != "multipart/signed" || params["protocol"] != mime_pkcs7signature || params["micalg"] != "sha-256" {
+			t.Fatalf("unexpected Content-Type: %s", msg.Get(content_type))
+		}
+		parts := msg.Parts()
+		if len(parts) != 2 {
+			t.Fatalf("expected 2 parts, got %d", len(parts))
+		}
+		sigDER, err := parts[1].Content()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		var ci contentInfo
+		if _, err := asn1.Unmarshal(sigDER, &ci); err != nil {
+			t.Fatal(err)
+		}
+		var sd signedData
+		if _, err := asn1.Unmarshal(ci.Content.Bytes, &sd); err != nil {
+			t.Fatal(err)
+		}
+		si := sd.SignerInfos[0]
+
+		// the message digest attribute must match the signed part.
+		digest := sha256.Sum256(parts[0].raw)
+		if !bytes.Contains(si.SignedAttrs.Bytes, digest[:]) {
+			t.Error("message digest doesn't match the signed content")
+		}
+
+		attrs := append([]byte{0x31}, si.SignedAttrs.FullBytes[1:]...)
+		attrsDigest := sha256.Sum256(attrs)
+		certs, _ := sender.SMIME.Certificates()
+		switch pub := certs[0].PublicKey.(type) {
+		case *rsa.PublicKey:
+			err = rsa.VerifyPKCS1v15(pub, crypto.SHA256, attrsDigest[:], si.Signature)
+		case *ecdsa.PublicKey:
+			err = certs[0].CheckSignature(x509.ECDSAWithSHA256, attrs, si.Signature)
+		}
+		if err != nil {
+			t.Error(err)
+		}
+	}
+}
+
+func TestSMIMEEncrypt(t *testing.T) {
+	ca, caKey := testSMIMECA(t)
+	to := &Account{Address: "receiver@example.com", SMIME: testSMIME(t, ca, caKey, "receiver@example.com", false)}
+	sender := &Account{Address: "sender@example.com", SMIME: testSMIME(t, ca, caKey, "sender@example.com", true)}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("secret\n"))
+	enc, err := m.SMIMEEncrypt(to, sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(enc, []byte("secret")) {
+		t.Fatal("mail is not encrypted")
+	}
+
+	msg, err := ReadPart(bytes.NewReader(enc))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if mediatype, params := msg.MediaType(); mediatype != mime_pkcs7mime || params["smime-type"] != "enveloped-data" {
+		t.Fatalf("unexpected Content-Type: %s", msg.Get(content_type))
+	}
+	der, err := base64.StdEncoding.DecodeString(strings.Join(strings.Fields(string(msg.Bytes())), ""))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var ci contentInfo
+	if _, err := asn1.Unmarshal(der, &ci); err != nil {
+		t.Fatal(err)
+	}
+	var ed envelopedData
+	if _, err := asn1.Unmarshal(ci.Content.Bytes, &ed); err != nil {
+		t.Fatal(err)
+	}
+	if len(ed.RecipientInfos) != 2 || ed.RecipientInfos[1].Tag != 1 {
+		t.Fatalf("expected a key transport and a key agreement recipient: %+v", ed.RecipientInfos)
+	}
+
+	// decrypt for the RSA recipient.
+	var ktri keyTransRecipientInfo
+	if _, err := asn1.Unmarshal(ed.RecipientInfos[0].FullBytes, &ktri); err != nil {
+		t.Fatal(err)
+	}
+	key, err := to.SMIME.Signer()
+	if err != nil {
+		t.Fatal(err)
+	}
+	cek, err := rsa.DecryptPKCS1v15(rand.Reader, key.(*rsa.PrivateKey), ktri.EncryptedKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var iv []byte
+	if _, err := asn1.Unmarshal(ed.EncryptedContentInfo.ContentEncryptionAlgorithm.Parameters.FullBytes, &iv); err != nil {
+		t.Fatal(err)
+	}
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		t.Fatal(err)
+	}
+	plain := ed.EncryptedContentInfo.EncryptedContent
+	cipher.NewCBCDecrypter(block, iv).CryptBlocks(plain, plain)
+
+	if !bytes.HasPrefix(plain, []byte("Content-Type: multipart/signed;")) || !bytes.Contains(plain, []byte("secret\r\n")) {
+		t.Errorf("unexpected content:\n%s", plain)
+	}
+}
+
+func TestAESKeyWrap(t *testing.T) {
+	// test vector from RFC 3394 4.6
+	kek := []byte{
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
+		0x10, 0x11, 0x12, 0x13, 0x14, 0x15, 0x16, 0x17, 0x18, 0x19, 0x1A, 0x1B, 0x1C, 0x1D, 0x1E, 0x1F,
+	}
+	key := []byte{
+		0x00, 0x11, 0x22, 0x33, 0x44, 0x55, 0x66, 0x77, 0x88, 0x99, 0xAA, 0xBB, 0xCC, 0xDD, 0xEE, 0xFF,
+		0x00, 0x01, 0x02, 0x03, 0x04, 0x05, 0x06, 0x07, 0x08, 0x09, 0x0A, 0x0B, 0x0C, 0x0D, 0x0E, 0x0F,
+	}
+	want := []byte{
+		0x28, 0xC9, 0xF4, 0x04, 0xC4, 0xB8, 0x10, 0xF4, 0xCB, 0xCC, 0xB3, 0x5C, 0xFB, 0x87, 0xF8, 0x26,
+		0x3F, 0x57, 0x86, 0xE2, 0xD8, 0x0E, 0xD3, 0x26, 0xCB, 0xC7, 0xF0, 0xE7, 0x1A, 0x99, 0xF4, 0x3B,
+		0xFB, 0x98, 0x8B, 0x9B, 0x7A, 0x02, 0xDD, 0x21,
+	}
+
+	wrapped, err := aesKeyWrap(kek, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(wrapped, want) {
+		t.Errorf("wrong result:\n%x\n%x", wrapped, want)
+	}
+
+	unwrapped, err := aesKeyUnwrap(kek, wrapped)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(unwrapped, key) {
+		t.Errorf("wrong key:\n%x\n%x", unwrapped, key)
+	}
+	wrapped[0] ^= 1
+	if _, err := aesKeyUnwrap(kek, wrapped); err == nil {
+		t.Error("modified key unwrapped")
+	}
+}
+
+func TestReadSMIME(t *testing.T) {
+	ca, caKey := testSMIMECA(t)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca)
+
+	for _, ec := range []bool{false, true} {
+		to := &Account{Address: "receiver@example.com", SMIME: testSMIME(t, ca, caKey, "receiver@example.com", ec)}
+		sender := &Account{Address: "sender@example.com", SMIME: testSMIME(t, ca, caKey, "sender@example.com", ec)}
+
+		m := NewMail()
+		m.From("Mr. Sender", "sender@example.com")
+		m.To("Mr. Receiver", "receiver@example.com")
+		m.Subject = "secret"
+		m.PlainTextBody().Write([]byte("secret\n"))
+		if err := m.AddReader("data.txt", strings.NewReader("attached!")); err != nil {
+			t.Fatal(err)
+		}
+
+		enc, err := m.SMIMEEncrypt(to, sender)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// the receiver and the sender can both decrypt it.
+		for _, recipient := range []*Account{to, sender} {
+			msg, err := ReadSMIME(bytes.NewReader(enc), recipient, roots)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !msg.Encrypted || msg.Header.Get("Subject") != "secret" {
+				t.Errorf("unexpected message: %+v", msg)
+			}
+			sig := msg.Signature
+			if sig == nil || sig.Err != nil || !sig.FromMatches || len(sig.Chain) != 2 || sig.Signer.EmailAddresses[0] != "sender@example.com" {
+				t.Fatalf("unexpected signature: %+v", sig)
+			}
+			parts := msg.Content.Parts()
+			if len(parts) != 2 {
+				t.Fatalf("expected 2 parts, got %d", len(parts))
+			}
+			if content, _ := parts[1].Content(); string(content) != "attached!" {
+				t.Errorf("unexpected attachment: %q", content)
+			}
+		}
+	}
+
+	sender := &Account{Address: "sender@example.com", SMIME: testSMIME(t, ca, caKey, "sender@example.com", false)}
+	m := NewMail()
+	m.From("Mr. Imposter", "imposter@example.com")
+	m.PlainTextBody().Write([]byte("hello\n"))
+	signed, err := m.SMIMESign(sender)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	msg, err := ReadSMIME(bytes.NewReader(signed), nil, roots)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if msg.Encrypted || msg.Signature == nil || msg.Signature.Err != nil || msg.Signature.FromMatches {
+		t.Errorf("unexpected signature: %+v", msg.Signature)
+	}
+
+	// mail stored with LF line breaks (e.g. in mbox or maildir) verifies as well.
+	stored := bytes.Replace(signed, []byte("\r\n"), []byte("\n"), -1)
+	if msg, err = ReadSMIME(bytes.NewReader(stored), nil, roots); err != nil {
+		t.Fatal(err)
+	}
+	if msg.Signature == nil || msg.Signature.Err != nil {
+		t.Errorf("LF line breaks: unexpected signature: %+v", msg.Signature)
+	}
+
+	otherCA, _ := testSMIMECA(t)
+	untrusted := x509.NewCertPool()
+	untrusted.AddCert(otherCA)
+	if msg, _ := ReadSMIME(bytes.NewReader(signed), nil, untrusted); msg.Signature.Err == nil {
+		t.Error("signer chains up to an untrusted root")
+	}
+
+	tampered := bytes.Replace(signed, []byte("hello"), []byte("jello"), 1)
+	if msg, _ := ReadSMIME(bytes.NewReader(tampered), nil, roots); msg.Signature.Err == nil {
+		t.Error("tampered message verified")
+	}
+
+	// an invalid signature doesn't match the From address.
+	m.Addresses[AddrFrom] = nil
+	m.From("Mr. Sender", "sender@example.com")
+	if signed, err = m.SMIMESign(sender); err != nil {
+		t.Fatal(err)
+	}
+	tampered = bytes.Replace(signed, []byte("hello"), []byte("jello"), 1)
+	if msg, _ := ReadSMIME(bytes.NewReader(tampered), nil, roots); msg.Signature.Err == nil || msg.Signature.FromMatches {
+		t.Errorf("tampered message: unexpected signature: %+v", msg.Signature)
+	}
+	if msg, _ := ReadSMIME(bytes.NewReader(signed), nil, untrusted); msg.Signature.Err == nil || msg.Signature.FromMatches {
+		t.Errorf("untrusted signer: unexpected signature: %+v", msg.Signature)
+	}
+}
@@ -0,0 +1,84 @@
+package MIMEMail
+
+import (
+	"fmt"
+	"strings"
+)
+
+// VERP delimiters as used by qmail and postfix: bounce+user=example.com@bounce.example.org
+const (
+	verpDelim       = "+"
+	verpDomainDelim = "="
+)
+
+// VERP returns the Variable Envelope Return Path for rcpt using bounce as the
+// base address, e.g.:
+//
+//	VERP("bounces@example.org", "user@example.com") == "bounces+user=example.com@example.org"
+//
+// Bounces sent to that address can be matched to rcpt using DecodeVERP.
+func VERP(bounce, rcpt string) (string, error) {
+	bLocal, bDomain, err := splitAddress(bounce)
+	if err != nil {
+		return "", err
+	}
+	if strings.Contains(bLocal, verpDelim) {
+		return "", fmt.Errorf("VERP: bounce address %q must not contain %q", bounce, verpDelim)
+	}
+
+	rLocal, rDomain, err := splitAddress(rcpt)
+	if err != nil {
+		return "", err
+	}
+
+	return bLocal + verpDelim + rLocal + verpDomainDelim + rDomain + "@" + bDomain, nil
+}
+
+// DecodeVERP reverses VERP, returning the base bounce address and the original
+// recipient encoded in addr.
+func DecodeVERP(addr string) (bounce, rcpt string, err error) {
+	local, domain, err := splitAddress(addr)
+	if err != nil {
+		return "", "", err
+	}
+
+	i := strings.Index(local, verpDelim)
+	if i < 0 {
+		return "", "", fmt.Errorf("VERP: %q is not a VERP address", addr)
+	}
+	encoded := local[i+len(verpDelim):]
+
+	j := strings.LastIndex(encoded, verpDomainDelim)
+	if j <= 0 || j == len(encoded)-len(verpDomainDelim) {
+		return "", "", fmt.Errorf("VERP: %q is not a VERP address", addr)
+	}
+
+	return local[:i] + "@" + domain, encoded[:j] + "@" + encoded[j+len(verpDomainDelim):], nil
+}
+
+// splitAddress splits a plain mail address into it's local part and domain.
+func splitAddress(addr string) (local, domain string, err error) {
+	i := strings.LastIndex(addr, "@")
+	if i <= 0 || i == len(addr)-1 {
+		return "", "", fmt.Errorf("%q is not a valid mail address", addr)
+	}
+	return addr[:i], addr[i+1:], nil
+}
+
+// VERP splits the envelope into one envelope per recipient, each having it's own
+// VERP envelope sender based on bounce. If bounce is empty, e.From is used as the base address.
+func (e *Envelope) VERP(bounce string) ([]*Envelope, error) {
+	if bounce == "" {
+		bounce = e.From
+	}
+
+	envs := make([]*Envelope, 0, len(e.To))
+	for _, rcpt := range e.To {
+		from, err := VERP(bounce, rcpt.Address)
+		if err != nil {
+			return nil, err
+		}
+		envs = append(envs, &Envelope{From: from, To: []Rcpt{rcpt}})
+	}
+	return envs, nil
+}
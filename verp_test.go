@@ -0,0 +1,81 @@
+package MIMEMail
+
+import "testing"
+
+func TestVERP(t *testing.T) {
+	tests := []struct {
+		bounce, rcpt, verp string
+	}{
+		{"bounces@example.org", "user@example.com", "bounces+user=example.com@example.org"},
+		{"bounces@example.org", "first.last+tag@example.com", "bounces+first.last+tag=example.com@example.org"},
+		{"bounces@example.org", "a=b@example.com", "bounces+a=b=example.com@example.org"},
+	}
+
+	for _, test := range tests {
+		verp, err := VERP(test.bounce, test.rcpt)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if verp != test.verp {
+			t.Errorf("expected %q, got %q", test.verp, verp)
+		}
+
+		bounce, rcpt, err := DecodeVERP(verp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if bounce != test.bounce || rcpt != test.rcpt {
+			t.Errorf("decoding %q: expected %q, %q got %q, %q", verp, test.bounce, test.rcpt, bounce, rcpt)
+		}
+	}
+}
+
+func TestVERPInvalid(t *testing.T) {
+	if _, err := VERP("bounces+x@example.org", "user@example.com"); err == nil {
+		t.Error("expected error for bounce address containing the delimiter")
+	}
+	if _, err := VERP("bounces@example.org", "user"); err == nil {
+		t.Error("expected error for invalid recipient")
+	}
+	for _, addr := range []string{"bounces@example.org", "bounces+user@example.org", "bounces+user=@example.org"} {
+		if _, _, err := DecodeVERP(addr); err == nil {
+			t.Errorf("expected error decoding %q", addr)
+		}
+	}
+}
+
+func TestClientSendVERP(t *testing.T) {
+	srv := newFakeSMTP(t)
+	defer srv.Close()
+
+	m := NewMail()
+	m.From("Mr. Sender", "sender@example.com")
+	m.To("Mr. Receiver", "receiver@example.com")
+	m.Bcc("Mrs. Receiver", "other@example.net")
+
+	c, err := PlainClient(srv.account())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.SendVERP(m, "bounces@example.org"); err != nil {
+		t.Fatal(err)
+	}
+	c.Quit()
+
+	txs := srv.transactions()
+	if len(txs) != 2 {
+		t.Fatalf("expected 2 transactions, got %d", len(txs))
+	}
+	exp := []struct{ from, rcpt string }{
+		{"<bounces+receiver=example.com@example.org> BODY=8BITMIME", "<receiver@example.com>"},
+		{"<bounces+other=example.net@example.org> BODY=8BITMIME", "<other@example.net>"},
+	}
+	for i, tx := range txs {
+		if tx.from != exp[i].from {
+			t.Errorf("expected MAIL FROM %q, got %q", exp[i].from, tx.from)
+		}
+		if len(tx.rcpt) != 1 || tx.rcpt[0] != exp[i].rcpt {
+			t.Errorf("expected RCPT TO %q, got %q", exp[i].rcpt, tx.rcpt)
+		}
+	}
+}
@@ -0,0 +1,191 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/base32"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/openpgp"
+)
+
+// zbase32 is the z-base-32 encoding used for the hashed local part of WKD URLs.
+var zbase32 = base32.NewEncoding("ybndrfg8ejkmcpqxot1uwisza345h769").WithPadding(base32.NoPadding)
+
+// maxWKDKeySize limits the size of keys fetched from a Web Key Directory.
+const maxWKDKeySize = 1 << 20
+
+// WKD looks up the public keys of recipients in their domain's Web Key Directory
+// (draft-koch-openpgp-webkey-service), trying the advanced method first and falling
+// back to the direct method if the openpgpkey sub-domain doesn't resolve or can't be connected to.
+// Found keys are kept in the local key store, so every address is only looked up once.
+type WKD struct {
+	// Client is used for the HTTPS requests, if it is nil, http.DefaultClient is used.
+	Client *http.Client
+
+	// Dir is the directory of the local key store, the keys are saved as <address>.gpg.
+	// If it is empty, they are only kept in memory.
+	Dir string
+
+	mu   sync.Mutex
+	keys map[string][]byte
+}
+
+// Lookup returns the public keys for address, from the local key store or the Web Key Directory.
+// A KeyNotFound error is returned if there is no key with a user ID for address.
+func (w *WKD) Lookup(address string) (openpgp.EntityList, error) {
+	data, err := w.lookup(address)
+	if err != nil {
+		return nil, err
+	}
+	return ReadKeyRing(bytes.NewReader(data))
+}
+
+// lookup returns the keyring for address, from the local key store or the Web Key Directory.
+func (w *WKD) lookup(address string) ([]byte, error) {
+	if data, ok := w.stored(strings.ToLower(address)); ok {
+		return data, nil
+	}
+
+	urls, err := WKDURLs(address)
+	if err != nil {
+		return nil, err
+	}
+	data, err := w.fetch(urls[0])
+	if unreachable(err) {
+		// the advanced method is only used if the sub-domain exists.
+		data, err = w.fetch(urls[1])
+	}
+	if err != nil {
+		if _, ok := err.(KeyNotFound); ok {
+			return nil, KeyNotFound(address)
+		}
+		return nil, err
+	}
+
+	keys, err := ReadKeyRing(bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	if !hasUserID(keys, address) {
+		return nil, KeyNotFound(address)
+	}
+
+	return data, w.store(strings.ToLower(address), data)
+}
+
+// unreachable reports whether err is the failure to resolve or connect to a host.
+func unreachable(err error) bool {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	return errors.As(err, &dnsErr) || errors.As(err, &opErr) && opErr.Op == "dial"
+}
+
+// fetch gets the key from u, returning a KeyNotFound error if there is none.
+func (w *WKD) fetch(u string) ([]byte, error) {
+	client := w.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	resp, err := client.Get(u)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound:
+		return nil, KeyNotFound(u)
+	case resp.StatusCode != http.StatusOK:
+		return nil, fmt.Errorf("WKD: %s: %s", u, resp.Status)
+	}
+	return ioutil.ReadAll(io.LimitReader(resp.Body, maxWKDKeySize))
+}
+
+// stored returns the key for address from the local key store.
+func (w *WKD) stored(address string) ([]byte, bool) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if data, ok := w.keys[address]; ok {
+		return data, true
+	}
+	if w.Dir == "" {
+		return nil, false
+	}
+	data, err := ioutil.ReadFile(w.path(address))
+	return data, err == nil
+}
+
+// store saves the key for address in the local key store.
+func (w *WKD) store(address string, data []byte) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.keys == nil {
+		w.keys = make(map[string][]byte)
+	}
+	w.keys[address] = data
+	if w.Dir == "" {
+		return nil
+	}
+	if err := os.MkdirAll(w.Dir, 0700); err != nil {
+		return err
+	}
+	return ioutil.WriteFile(w.path(address), data, 0600)
+}
+
+// path returns the filename of the key for address in the local key store.
+func (w *WKD) path(address string) string {
+	return filepath.Join(w.Dir, strings.Replace(address, string(filepath.Separator), "_", -1)+".gpg")
+}
+
+// WKDURLs returns the advanced and direct method URLs of the Web Key Directory for address.
+// The local part is hashed in lower case but passed unmodified in the l parameter.
+func WKDURLs(address string) ([]string, error) {
+	at := strings.LastIndex(address, "@")
+	if at <= 0 || at == len(address)-1 {
+		return nil, fmt.Errorf("WKD: invalid address %q", address)
+	}
+	local, domain := address[:at], strings.ToLower(address[at+1:])
+
+	hash := sha1.Sum([]byte(strings.ToLower(local)))
+	path := "hu/" + zbase32.EncodeToString(hash[:]) + "?l=" + url.QueryEscape(local)
+	return []string{
+		"https://openpgpkey." + domain + "/.well-known/openpgpkey/" + domain + "/" + path,
+		"https://" + domain + "/.well-known/openpgpkey/" + path,
+	}, nil
+}
+
+// hasUserID reports whether one of keys has a user ID for address.
+func hasUserID(keys openpgp.EntityList, address string) bool {
+	for _, e := range keys {
+		for _, id := range e.Identities {
+			if id.UserId != nil && strings.EqualFold(id.UserId.Email, address) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// discoverKey returns an account for address with the key looked up by signer's WKD.
+func discoverKey(signer *Account, address string) (*Account, error) {
+	if signer == nil || signer.WKD == nil {
+		return nil, KeyNotFound(address)
+	}
+	data, err := signer.WKD.lookup(address)
+	if err != nil {
+		return nil, err
+	}
+	return &Account{Address: address, Key: &PGP{Key: string(data)}}, nil
+}
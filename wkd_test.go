@@ -0,0 +1,234 @@
+package MIMEMail
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestWKDURLs(t *testing.T) {
+	urls, err := WKDURLs("Joe.Doe@Example.ORG")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp := []string{
+		"https://openpgpkey.example.org/.well-known/openpgpkey/example.org/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+		"https://example.org/.well-known/openpgpkey/hu/iy9q119eutrkn8s1mk4r39qejnbu3n5q?l=Joe.Doe",
+	}
+	if len(urls) != 2 || urls[0] != exp[0] || urls[1] != exp[1] {
+		t.Errorf("unexpected URLs: %v", urls)
+	}
+
+	urls, err = WKDURLs("first.last+tag@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	exp = []string{
+		"https://openpgpkey.example.com/.well-known/openpgpkey/example.com/hu/6mbyui9a35t4diacf5978kitbkpswxot?l=first.last%2Btag",
+		"https://example.com/.well-known/openpgpkey/hu/6mbyui9a35t4diacf5978kitbkpswxot?l=first.last%2Btag",
+	}
+	if len(urls) != 2 || urls[0] != exp[0] || urls[1] != exp[1] {
+		t.Errorf("unexpected URLs: %v", urls)
+	}
+
+	if _, err := WKDURLs("no-domain"); err == nil {
+		t.Error("expected an error for an invalid address")
+	}
+}
+
+// fakeWKD is a Web Key Directory stand-in serving keys for any domain (and MTA-STS policies, see setMTASTSPolicy).
+type fakeWKD struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	keys     map[string][]byte // by request host and path
+	failing  map[string]bool   // hosts answering with an internal server error
+	requests []string
+}
+
+// newFakeWKD starts a fake WKD.
+func newFakeWKD(t *testing.T) *fakeWKD {
+	w := &fakeWKD{keys: make(map[string][]byte), failing: make(map[string]bool)}
+	w.Server = httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.requests = append(w.requests, r.Host+r.URL.RequestURI())
+		if w.failing[r.Host] {
+			http.Error(rw, "internal server error", http.StatusInternalServerError)
+			return
+		}
+		key, ok := w.keys[r.Host+r.URL.Path]
+		if !ok {
+			http.NotFound(rw, r)
+			return
+		}
+		rw.Write(key)
+	}))
+	return w
+}
+
+// client returns a http.Client connecting to w for all hosts except unreachable ones.
+func (w *fakeWKD) client(unreachable ...string) *http.Client {
+	tr := w.Client().Transport.(*http.Transport).Clone()
+	tr.TLSClientConfig = &tls.Config{ServerName: "example.com", RootCAs: tr.TLSClientConfig.RootCAs}
+	tr.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+		host, _, _ := net.SplitHostPort(addr)
+		for _, h := range unreachable {
+			if h == host {
+				return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+			}
+		}
+		var d net.Dialer
+		return d.DialContext(ctx, network, w.Listener.Addr().String())
+	}
+	return &http.Client{Transport: tr}
+}
+
+// add serves the armored public key pub at the URL of method (0 advanced, 1 direct) for address.
+func (w *fakeWKD) add(t *testing.T, address, pub string, method int) {
+	urls, err := WKDURLs(address)
+	if err != nil {
+		t.Fatal(err)
+	}
+	block, err := armor.Decode(strings.NewReader(pub))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var key bytes.Buffer
+	key.ReadFrom(block.Body)
+
+	u := strings.TrimPrefix(urls[method], "https://")
+	w.mu.Lock()
+	w.keys[u[:strings.Index(u, "?")]] = key.Bytes()
+	w.mu.Unlock()
+}
+
+func (w *fakeWKD) count() int {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return len(w.requests)
+}
+
+func TestWKDLookup(t *testing.T) {
+	srv := newFakeWKD(t)
+	defer srv.Close()
+
+	_, alice := testPGP(t, "alice@example.com")
+	_, bob := testPGP(t, "bob@example.net")
+	_, mallory := testPGP(t, "mallory@example.com")
+	srv.add(t, "alice@example.com", alice, 0)
+	srv.add(t, "bob@example.net", bob, 1)
+	srv.add(t, "carol@example.com", mallory, 0)
+
+	dir := tempDir(t)
+	wkd := &WKD{Client: srv.client("openpgpkey.example.net"), Dir: dir}
+
+	keys, err := wkd.Lookup("Alice@example.com")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || !hasUserID(keys, "alice@example.com") {
+		t.Errorf("unexpected keys: %v", keys)
+	}
+
+	// the direct method is used, as the sub-domain can't be reached.
+	if _, err := wkd.Lookup("bob@example.net"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := wkd.Lookup("dave@example.com"); err != KeyNotFound("dave@example.com") {
+		t.Errorf("expected KeyNotFound, got %v", err)
+	}
+	if _, err := wkd.Lookup("carol@example.com"); err != KeyNotFound("carol@example.com") {
+		t.Errorf("expected KeyNotFound for a key without matching user ID, got %v", err)
+	}
+
+	// the local part is sent unmodified.
+	if !strings.HasSuffix(srv.requests[0], "?l=Alice") {
+		t.Errorf("local part has been modified: %s", srv.requests[0])
+	}
+
+	// found keys are taken from the local key store.
+	n := srv.count()
+	if _, err := wkd.Lookup("alice@example.com"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := (&WKD{Client: srv.client(), Dir: dir}).Lookup("bob@example.net"); err != nil {
+		t.Fatal(err)
+	}
+	if srv.count() != n {
+		t.Errorf("stored keys have been fetched again: %v", srv.requests[n:])
+	}
+
+	// a failing sub-domain is an error, the direct method isn't tried.
+	_, erin := testPGP(t, "erin@example.org")
+	srv.add(t, "erin@example.org", erin, 1)
+	srv.failing["openpgpkey.example.org"] = true
+	n = srv.count()
+	if _, err := wkd.Lookup("erin@example.org"); err == nil || err == KeyNotFound("erin@example.org") {
+		t.Errorf("expected the server error, got %v", err)
+	}
+	if srv.count() != n+1 {
+		t.Errorf("the direct method has been tried: %v", srv.requests[n:])
+	}
+}
+
+func TestWKDEncrypt(t *testing.T) {
+	srv := newFakeWKD(t)
+	defer srv.Close()
+
+	priv, pub := testPGP(t, "blabla@example.com")
+	srv.add(t, "blabla@example.com", pub, 0)
+	_, other := testPGP(t, "xiao_mao@example.com")
+
+	signerKey, _ := testPGP(t, "foobar@example.com")
+	signer := &Account{Address: "foobar@example.com", Key: signerKey, WKD: &WKD{Client: srv.client()}}
+
+	m := MessageFactory()
+	m.PlainTextBody().Write([]byte("hello"))
+	enc, err := m.Encrypt(&Account{Address: "blabla@example.com"}, signer)
+	if err != nil {
+		t.Fatal(err)
+	}
+	receiver := &Account{Address: "blabla@example.com", Key: priv}
+	if _, err := ReadPGP(bytes.NewReader(enc), receiver, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// xiao_mao's key is configured, blabla's is looked up.
+	keys := []*Account{{Address: "xiao_mao@example.com", Key: &PGP{Key: other}}}
+	if enc, err = m.EncryptToAll(keys, signer); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadPGP(bytes.NewReader(enc), receiver, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	m.To("", "unknown@example.com")
+	var missing MissingKeys
+	if _, err := m.EncryptToAll(keys, signer); !errors.As(err, &missing) || len(missing) != 1 || missing[0] != "unknown@example.com" {
+		t.Errorf("expected MissingKeys for unknown@example.com, got %v", err)
+	}
+}
+
+// tempDir returns a temporary directory, which is removed when the test finishes.
+func tempDir(t *testing.T) string {
+	t.Helper()
+	dir, err := ioutil.TempDir("", "mimemail")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}